@@ -5,14 +5,17 @@ import (
 	"flag"
 	"log"
 	"log/slog"
+	"net/http"
 	"net/http/pprof"
 	"os"
 
+	"github.com/pluto-metrics/pluto/pkg/auth"
 	"github.com/pluto-metrics/pluto/pkg/config"
 	"github.com/pluto-metrics/pluto/pkg/insert"
 	"github.com/pluto-metrics/pluto/pkg/lg"
 	"github.com/pluto-metrics/pluto/pkg/listen"
 	"github.com/pluto-metrics/pluto/pkg/prom"
+	"github.com/pluto-metrics/pluto/pkg/tenant"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -42,16 +45,31 @@ func main() {
 	// set log level from config
 	logLevel.Set(cfg.Logging.Level)
 
-	httpManager := listen.NewHTTP()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpManager := listen.NewHTTP(cfg.Servers...)
+	if cfg.Tenant.Enabled {
+		slog.Info("multi-tenancy enabled", slog.String("header", cfg.Tenant.Header), slog.String("label", cfg.Tenant.Label))
+	}
+
 	// receiver
 	if cfg.Insert.Enabled {
 		slog.Info("insert enabled", slog.String("listen", cfg.Insert.Listen))
 		mux := httpManager.Mux(cfg.Insert.Listen)
-		rw := insert.NewPrometheusRemoteWrite(insert.Opts{
+		rw, err := insert.NewPrometheusRemoteWrite(ctx, insert.Opts{
 			Config: cfg,
 		})
+		if err != nil {
+			log.Fatal(err)
+		}
 
-		mux.Handle("/api/v1/write", rw)
+		insertAuth, err := auth.New(cfg.Insert.Auth)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		mux.Handle("/api/v1/write", insertAuth.Handler(auth.PermissionWrite, tenant.NewHandler(cfg, rw)))
 	}
 
 	//debug
@@ -59,30 +77,32 @@ func main() {
 		slog.Info("debug enabled", slog.String("listen", cfg.Debug.Listen))
 		mux := httpManager.Mux(cfg.Debug.Listen)
 
+		debugAuth, err := auth.New(cfg.Debug.Auth)
+		if err != nil {
+			log.Fatal(err)
+		}
+
 		if cfg.Debug.Metrics {
 			prometheus.MustRegister(
 				collectors.NewBuildInfoCollector(),
 			)
 
-			mux.Handle("/metrics", promhttp.HandlerFor(
+			mux.Handle("/metrics", debugAuth.Handler(auth.PermissionRead, promhttp.HandlerFor(
 				prometheus.DefaultGatherer, promhttp.HandlerOpts{
 					Registry: prometheus.DefaultRegisterer,
-				}))
+				})))
 		}
 
 		if cfg.Debug.Pprof {
-			mux.HandleFunc("/debug/pprof/", pprof.Index)
-			mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
-			mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
-			mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
-			mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+			mux.Handle("/debug/pprof/", debugAuth.Handler(auth.PermissionRead, http.HandlerFunc(pprof.Index)))
+			mux.Handle("/debug/pprof/cmdline", debugAuth.Handler(auth.PermissionRead, http.HandlerFunc(pprof.Cmdline)))
+			mux.Handle("/debug/pprof/profile", debugAuth.Handler(auth.PermissionRead, http.HandlerFunc(pprof.Profile)))
+			mux.Handle("/debug/pprof/symbol", debugAuth.Handler(auth.PermissionRead, http.HandlerFunc(pprof.Symbol)))
+			mux.Handle("/debug/pprof/trace", debugAuth.Handler(auth.PermissionRead, http.HandlerFunc(pprof.Trace)))
 		}
 
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-
 	// prometheus
 	if cfg.Prometheus.Enabled {
 		slog.Info("prometheus enabled", slog.String("listen", cfg.Prometheus.Listen))
@@ -0,0 +1,109 @@
+package aggregate
+
+import (
+	"context"
+	"iter"
+	"log/slog"
+	"time"
+
+	"github.com/pluto-metrics/pluto/pkg/config"
+	"github.com/pluto-metrics/pluto/pkg/insert/labels"
+	"github.com/pluto-metrics/pluto/pkg/lg"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+var matchedSamples = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "pluto_aggregation_matched_samples_total",
+	Help: "Samples matched by aggregation rule",
+}, []string{"rule"})
+
+var outputSeries = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "pluto_aggregation_output_series_total",
+	Help: "Series written by aggregation rule",
+}, []string{"rule"})
+
+var flushErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "pluto_aggregation_flush_errors_total",
+	Help: "Failed writes of aggregation results",
+}, []string{"rule"})
+
+// FlushFunc writes marshaled prompb.WriteRequest with aggregation results of the tenant
+type FlushFunc func(ctx context.Context, tenant string, req []byte) error
+
+// Aggregator applies aggregation rules to incoming series
+type Aggregator struct {
+	rules []*rule
+	flush FlushFunc
+}
+
+func New(ctx context.Context, rules []config.AggregationRule, flush FlushFunc) (*Aggregator, error) {
+	a := &Aggregator{flush: flush}
+	for _, cfg := range rules {
+		r, err := newRule(cfg)
+		if err != nil {
+			return nil, err
+		}
+		a.rules = append(a.rules, r)
+	}
+	for _, r := range a.rules {
+		go a.run(ctx, r)
+	}
+	return a, nil
+}
+
+// Push adds samples of the series to matched rules.
+// Returns true if the series should not be written because of drop_input
+func (a *Aggregator) Push(tenant string, lbs []labels.Bytes, samples iter.Seq2[int64, float64]) bool {
+	drop := false
+	for _, r := range a.rules {
+		if !r.match(lbs) {
+			continue
+		}
+		r.push(tenant, lbs, samples)
+		drop = drop || r.cfg.DropInput
+	}
+	return drop
+}
+
+// Match reports if the series is matched by any rule and if it should not be written because of drop_input
+func (a *Aggregator) Match(lbs []labels.Bytes) (bool, bool) {
+	matched, drop := false, false
+	for _, r := range a.rules {
+		if r.match(lbs) {
+			matched = true
+			drop = drop || r.cfg.DropInput
+		}
+	}
+	return matched, drop
+}
+
+func (a *Aggregator) run(ctx context.Context, r *rule) {
+	t := time.NewTicker(r.cfg.Interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			a.flushRule(ctx, r, now)
+		}
+	}
+}
+
+func (a *Aggregator) flushRule(ctx context.Context, r *rule, now time.Time) {
+	for tenant, series := range r.collect(now.UnixMilli()) {
+		raw, err := (&prompb.WriteRequest{Timeseries: series}).Marshal()
+		if err == nil {
+			err = a.flush(ctx, tenant, raw)
+		}
+		if err != nil {
+			flushErrors.WithLabelValues(r.cfg.Match).Inc()
+			slog.ErrorContext(ctx, "can't write aggregation result", slog.String("rule", r.cfg.Match), lg.Error(err))
+			continue
+		}
+		outputSeries.WithLabelValues(r.cfg.Match).Add(float64(len(series)))
+	}
+}
@@ -0,0 +1,177 @@
+package aggregate
+
+import (
+	"context"
+	"iter"
+	"math"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/pluto-metrics/pluto/pkg/config"
+	"github.com/pluto-metrics/pluto/pkg/insert/labels"
+	"github.com/prometheus/prometheus/model/value"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// lb returns sorted labels as insert does
+func lb(kv ...string) []labels.Bytes {
+	var ret []labels.Bytes
+	for i := 0; i < len(kv); i += 2 {
+		ret = append(ret, labels.Bytes{Name: []byte(kv[i]), Value: []byte(kv[i+1])})
+	}
+	sort.Slice(ret, func(i, j int) bool { return string(ret[i].Name) < string(ret[j].Name) })
+	return ret
+}
+
+func samples(values ...float64) iter.Seq2[int64, float64] {
+	return func(yield func(int64, float64) bool) {
+		for i, v := range values {
+			if !yield(int64(i+1)*1000, v) {
+				return
+			}
+		}
+	}
+}
+
+func results(t *testing.T, r *rule) map[string]float64 {
+	ret := make(map[string]float64)
+	for tenant, series := range r.collect(1000) {
+		for _, s := range series {
+			key := tenant + "/"
+			for _, l := range s.Labels {
+				key += l.Name + "=" + l.Value + ","
+			}
+			require.Len(t, s.Samples, 1)
+			ret[key] = s.Samples[0].Value
+		}
+	}
+	return ret
+}
+
+func TestRuleBy(t *testing.T) {
+	assert := assert.New(t)
+
+	r, err := newRule(config.AggregationRule{
+		Match:    `{__name__="cpu"}`,
+		Interval: time.Minute,
+		By:       []string{"job"},
+		Outputs:  []string{"sum", "count", "min", "max"},
+	})
+	require.NoError(t, err)
+
+	assert.True(r.match(lb("__name__", "cpu", "job", "a", "pod", "1")))
+	assert.False(r.match(lb("__name__", "mem", "job", "a", "pod", "1")))
+
+	// the last values of series are aggregated, pod 3 is gone
+	r.push("", lb("__name__", "cpu", "job", "a", "pod", "1"), samples(1, 2))
+	r.push("", lb("__name__", "cpu", "job", "a", "pod", "2"), samples(3, 4))
+	r.push("", lb("__name__", "cpu", "job", "a", "pod", "3"), samples(3, math.Float64frombits(value.StaleNaN)))
+	r.push("", lb("__name__", "cpu", "job", "a", "pod", "1"), func(yield func(int64, float64) bool) {
+		yield(5000, 5)
+	})
+	r.push("", lb("__name__", "cpu", "job", "b", "pod", "1"), samples(10))
+	r.push("t1", lb("__name__", "cpu", "job", "a", "pod", "1"), samples(5))
+
+	assert.Equal(map[string]float64{
+		"/__name__=cpu:1m_by_job_sum,job=a,":     9,
+		"/__name__=cpu:1m_by_job_count,job=a,":   2,
+		"/__name__=cpu:1m_by_job_min,job=a,":     4,
+		"/__name__=cpu:1m_by_job_max,job=a,":     5,
+		"/__name__=cpu:1m_by_job_sum,job=b,":     10,
+		"/__name__=cpu:1m_by_job_count,job=b,":   1,
+		"/__name__=cpu:1m_by_job_min,job=b,":     10,
+		"/__name__=cpu:1m_by_job_max,job=b,":     10,
+		"t1/__name__=cpu:1m_by_job_sum,job=a,":   5,
+		"t1/__name__=cpu:1m_by_job_count,job=a,": 1,
+		"t1/__name__=cpu:1m_by_job_min,job=a,":   5,
+		"t1/__name__=cpu:1m_by_job_max,job=a,":   5,
+	}, results(t, r))
+
+	// state is reset after collect
+	assert.Empty(results(t, r))
+}
+
+func TestRuleWithoutRateQuantiles(t *testing.T) {
+	assert := assert.New(t)
+
+	r, err := newRule(config.AggregationRule{
+		Match:     `{__name__="requests"}`,
+		Interval:  10 * time.Second,
+		Without:   []string{"pod"},
+		Outputs:   []string{"rate_sum", "quantiles"},
+		Quantiles: []float64{0, 0.5, 1},
+	})
+	require.NoError(t, err)
+
+	r.push("", lb("__name__", "requests", "job", "a", "pod", "1"), samples(10, 20))
+	// counter reset
+	r.push("", lb("__name__", "requests", "job", "a", "pod", "2"), samples(50, 5))
+
+	// increase: 10 + 5 during 10s, quantiles of the last values 20 and 5
+	assert.Equal(map[string]float64{
+		"/__name__=requests:10s_without_pod_rate_sum,job=a,":               1.5,
+		"/__name__=requests:10s_without_pod_quantiles,job=a,quantile=0,":   5,
+		"/__name__=requests:10s_without_pod_quantiles,job=a,quantile=0.5,": 12.5,
+		"/__name__=requests:10s_without_pod_quantiles,job=a,quantile=1,":   20,
+	}, results(t, r))
+
+	// the previous value is kept between intervals
+	r.push("", lb("__name__", "requests", "job", "a", "pod", "1"), func(yield func(int64, float64) bool) {
+		yield(3000, 30)
+	})
+	assert.Equal(1.0, results(t, r)["/__name__=requests:10s_without_pod_rate_sum,job=a,"])
+
+	// pod 2 was not updated during the interval
+	assert.Len(r.counters, 1)
+	results(t, r)
+	assert.Empty(r.counters)
+}
+
+func TestAggregatorDropInputAndFlush(t *testing.T) {
+	assert := assert.New(t)
+
+	var flushed []prompb.TimeSeries
+	a, err := New(context.Background(), nil, func(ctx context.Context, tenant string, raw []byte) error {
+		req := &prompb.WriteRequest{}
+		require.NoError(t, req.Unmarshal(raw))
+		assert.Equal("t1", tenant)
+		flushed = append(flushed, req.Timeseries...)
+		return nil
+	})
+	require.NoError(t, err)
+
+	for _, cfg := range []config.AggregationRule{
+		{Match: `{__name__="a"}`, Interval: time.Minute, Outputs: []string{"sum"}, DropInput: true},
+		{Match: `{__name__=~"a|b"}`, Interval: time.Minute, Outputs: []string{"count"}},
+	} {
+		r, err := newRule(cfg)
+		require.NoError(t, err)
+		a.rules = append(a.rules, r)
+	}
+
+	assert.True(a.Push("t1", lb("__name__", "a"), samples(1)))
+	assert.False(a.Push("t1", lb("__name__", "b"), samples(1)))
+	assert.False(a.Push("t1", lb("__name__", "c"), samples(1)))
+
+	a.flushRule(context.Background(), a.rules[0], time.UnixMilli(5000))
+	require.Len(t, flushed, 1)
+	assert.Equal([]prompb.Label{{Name: "__name__", Value: "a:1m_sum"}}, flushed[0].Labels)
+	assert.Equal([]prompb.Sample{{Value: 1, Timestamp: 5000}}, flushed[0].Samples)
+}
+
+func TestQuantile(t *testing.T) {
+	assert := assert.New(t)
+	assert.True(math.IsNaN(quantile(0.5, nil)))
+	assert.Equal(2.5, quantile(0.5, []float64{1, 2, 3, 4}))
+	assert.Equal(4.0, quantile(1, []float64{1, 2, 3, 4}))
+}
+
+func TestRuleInvalid(t *testing.T) {
+	_, err := newRule(config.AggregationRule{Match: `{`, Interval: time.Minute, Outputs: []string{"sum"}})
+	assert.Error(t, err)
+	_, err = newRule(config.AggregationRule{Match: `{job="a"}`, Interval: time.Minute, By: []string{"a"}, Without: []string{"b"}, Outputs: []string{"sum"}})
+	assert.Error(t, err)
+}
@@ -0,0 +1,296 @@
+package aggregate
+
+import (
+	"bytes"
+	"iter"
+	"math"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/pluto-metrics/pluto/pkg/config"
+	"github.com/pluto-metrics/pluto/pkg/insert/labels"
+	"github.com/prometheus/common/model"
+	promlabels "github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/value"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+var defaultQuantiles = []float64{0.5, 0.9, 0.99}
+
+var labelName = []byte("__name__")
+
+// group is an output of the rule for one set of labels
+type group struct {
+	tenant string
+	name   string
+	labels []prompb.Label // without __name__
+	// the last sample of each input series, sum, count, min, max and quantiles are computed over them
+	last map[string]lastSample
+	// sum of increases of input counters
+	increase float64
+}
+
+type lastSample struct {
+	timestamp int64
+	value     float64
+}
+
+// counter is a state of input series required for rate_sum
+type counter struct {
+	value     float64
+	timestamp int64
+	seen      bool // updated in the current interval
+}
+
+type rule struct {
+	cfg      config.AggregationRule
+	matchers []*promlabels.Matcher
+	by       [][]byte
+	without  [][]byte
+	suffix   string // ":<interval>_by_<labels>_"
+	rate     bool
+	keyBuf   []byte
+
+	sync.Mutex
+	groups   map[string]*group
+	counters map[string]*counter
+}
+
+func newRule(cfg config.AggregationRule) (*rule, error) {
+	matchers, err := parser.ParseMetricSelector(cfg.Match)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid aggregation match %q", cfg.Match)
+	}
+	if len(cfg.By) > 0 && len(cfg.Without) > 0 {
+		return nil, errors.Errorf("aggregation rule %q: by and without can't be used together", cfg.Match)
+	}
+	if slices.Contains(cfg.Outputs, "quantiles") && len(cfg.Quantiles) == 0 {
+		cfg.Quantiles = defaultQuantiles
+	}
+
+	r := &rule{
+		cfg:      cfg,
+		matchers: matchers,
+		rate:     slices.Contains(cfg.Outputs, "rate_sum"),
+		groups:   make(map[string]*group),
+		counters: make(map[string]*counter),
+	}
+
+	by := slices.Clone(cfg.By)
+	sort.Strings(by)
+	for _, l := range by {
+		r.by = append(r.by, []byte(l))
+	}
+	without := slices.Clone(cfg.Without)
+	sort.Strings(without)
+	for _, l := range without {
+		r.without = append(r.without, []byte(l))
+	}
+
+	r.suffix = ":" + model.Duration(cfg.Interval).String() + "_"
+	if len(by) > 0 {
+		r.suffix += "by_" + strings.Join(by, "_") + "_"
+	}
+	if len(without) > 0 {
+		r.suffix += "without_" + strings.Join(without, "_") + "_"
+	}
+
+	return r, nil
+}
+
+func (r *rule) match(lbs []labels.Bytes) bool {
+	return labels.Match(lbs, r.matchers)
+}
+
+// keep reports if the label is a part of the output labels
+func (r *rule) keep(name []byte) bool {
+	if bytes.Equal(name, labelName) {
+		return false
+	}
+	if len(r.by) > 0 {
+		for _, l := range r.by {
+			if bytes.Equal(l, name) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, l := range r.without {
+		if bytes.Equal(l, name) {
+			return false
+		}
+	}
+	return true
+}
+
+// appendKey writes tenant, metric name and labels selected by filter. Labels are sorted by insert, including the tenant label
+func appendKey(buf []byte, tenant string, lbs []labels.Bytes, filter func([]byte) bool) []byte {
+	buf = append(buf, tenant...)
+	buf = append(buf, 0xff)
+	buf = append(buf, labels.Value(lbs, "__name__")...)
+	for i := 0; i < len(lbs); i++ {
+		if filter != nil && !filter(lbs[i].Name) {
+			continue
+		}
+		buf = append(buf, 0xff)
+		buf = append(buf, lbs[i].Name...)
+		buf = append(buf, '=')
+		buf = append(buf, lbs[i].Value...)
+	}
+	return buf
+}
+
+func (r *rule) push(tenant string, lbs []labels.Bytes, samples iter.Seq2[int64, float64]) {
+	r.Lock()
+	defer r.Unlock()
+
+	r.keyBuf = appendKey(r.keyBuf[:0], tenant, lbs, r.keep)
+	g, ok := r.groups[string(r.keyBuf)]
+	if !ok {
+		g = &group{
+			tenant: tenant,
+			name:   string(labels.Value(lbs, "__name__")),
+			last:   make(map[string]lastSample),
+		}
+		for i := 0; i < len(lbs); i++ {
+			if r.keep(lbs[i].Name) {
+				g.labels = append(g.labels, prompb.Label{Name: string(lbs[i].Name), Value: string(lbs[i].Value)})
+			}
+		}
+		r.groups[string(r.keyBuf)] = g
+	}
+
+	r.keyBuf = appendKey(r.keyBuf[:0], tenant, lbs, nil)
+	last, seen := g.last[string(r.keyBuf)]
+
+	var c *counter
+	if r.rate {
+		c = r.counters[string(r.keyBuf)]
+		if c == nil {
+			c = &counter{timestamp: math.MinInt64}
+			r.counters[string(r.keyBuf)] = c
+		}
+		c.seen = true
+	}
+
+	matched := 0
+	for ts, v := range samples {
+		matched++
+		if math.IsNaN(v) && !value.IsStaleNaN(v) {
+			continue
+		}
+		if !seen || ts >= last.timestamp {
+			// staleness marker is kept as the last value: the series is gone
+			last, seen = lastSample{timestamp: ts, value: v}, true
+		}
+		if math.IsNaN(v) {
+			continue
+		}
+
+		if c != nil && ts > c.timestamp {
+			if c.timestamp != math.MinInt64 {
+				if v >= c.value {
+					g.increase += v - c.value
+				} else {
+					// counter reset
+					g.increase += v
+				}
+			}
+			c.value, c.timestamp = v, ts
+		}
+	}
+	if seen {
+		g.last[string(r.keyBuf)] = last
+	}
+	matchedSamples.WithLabelValues(r.cfg.Match).Add(float64(matched))
+}
+
+// collect returns results of the interval grouped by tenant and resets the state.
+// sum, count, min, max and quantiles aggregate the last values of input series, as the same
+// aggregation by PromQL at the end of the interval does
+func (r *rule) collect(timestamp int64) map[string][]prompb.TimeSeries {
+	r.Lock()
+	groups := r.groups
+	r.groups = make(map[string]*group, len(groups))
+	for k, c := range r.counters {
+		// forget series which were not updated during the whole interval
+		if !c.seen {
+			delete(r.counters, k)
+		}
+		c.seen = false
+	}
+	r.Unlock()
+
+	ret := make(map[string][]prompb.TimeSeries)
+	for _, g := range groups {
+		values := make([]float64, 0, len(g.last))
+		for _, s := range g.last {
+			if !math.IsNaN(s.value) {
+				values = append(values, s.value)
+			}
+		}
+		if len(values) == 0 {
+			continue
+		}
+		slices.Sort(values)
+
+		for _, output := range r.cfg.Outputs {
+			if output == "quantiles" {
+				for _, q := range r.cfg.Quantiles {
+					ret[g.tenant] = append(ret[g.tenant], r.series(g, output, timestamp, quantile(q, values),
+						prompb.Label{Name: "quantile", Value: strconv.FormatFloat(q, 'g', -1, 64)}))
+				}
+				continue
+			}
+
+			var v float64
+			switch output {
+			case "sum":
+				for _, x := range values {
+					v += x
+				}
+			case "count":
+				v = float64(len(values))
+			case "min":
+				v = values[0]
+			case "max":
+				v = values[len(values)-1]
+			case "rate_sum":
+				v = g.increase / r.cfg.Interval.Seconds()
+			}
+			ret[g.tenant] = append(ret[g.tenant], r.series(g, output, timestamp, v))
+		}
+	}
+	return ret
+}
+
+func (r *rule) series(g *group, output string, timestamp int64, v float64, extra ...prompb.Label) prompb.TimeSeries {
+	lbs := make([]prompb.Label, 0, len(g.labels)+len(extra)+1)
+	lbs = append(lbs, prompb.Label{Name: "__name__", Value: g.name + r.suffix + output})
+	lbs = append(lbs, g.labels...)
+	lbs = append(lbs, extra...)
+	return prompb.TimeSeries{
+		Labels:  lbs,
+		Samples: []prompb.Sample{{Value: v, Timestamp: timestamp}},
+	}
+}
+
+// quantile of sorted values, same as promql quantile()
+func quantile(q float64, values []float64) float64 {
+	if len(values) == 0 {
+		return math.NaN()
+	}
+	n := float64(len(values))
+	rank := q * (n - 1)
+
+	lower := math.Max(0, math.Floor(rank))
+	upper := math.Min(n-1, lower+1)
+
+	weight := rank - math.Floor(rank)
+	return values[int(lower)]*(1-weight) + values[int(upper)]*weight
+}
@@ -0,0 +1,224 @@
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/pluto-metrics/pluto/pkg/config"
+	"github.com/pluto-metrics/pluto/pkg/lg"
+	"github.com/pluto-metrics/pluto/pkg/tenant"
+)
+
+// Permission is a set of allowed operations
+type Permission int
+
+const (
+	PermissionRead      Permission = 1
+	PermissionWrite     Permission = 2
+	PermissionReadWrite            = PermissionRead | PermissionWrite
+	// admin API: deletion of series, backups and restore
+	PermissionAdmin Permission = 4
+)
+
+// ParsePermission parses permission from config or JWT claim. Empty permission is an error
+func ParsePermission(s string) (Permission, error) {
+	switch s {
+	case "read":
+		return PermissionRead, nil
+	case "write":
+		return PermissionWrite, nil
+	case "read_write":
+		return PermissionReadWrite, nil
+	case "admin":
+		return PermissionReadWrite | PermissionAdmin, nil
+	}
+	return 0, errors.Errorf("unknown permission %q", s)
+}
+
+// Identity is an authenticated client
+type Identity struct {
+	Name       string
+	Tenant     string
+	Permission Permission
+	// identity without tenant may select any tenant by header
+	AnyTenant bool
+}
+
+type ctxKey string
+
+const (
+	identityKey ctxKey = "identity"
+)
+
+// With returns context with identity
+func With(parent context.Context, id *Identity) context.Context {
+	return context.WithValue(parent, identityKey, id)
+}
+
+// FromContext returns identity or nil if auth is disabled
+func FromContext(ctx context.Context) *Identity {
+	if id, ok := ctx.Value(identityKey).(*Identity); ok {
+		return id
+	}
+	return nil
+}
+
+// Allowed checks permission of identity from context. Always true if auth is disabled
+func Allowed(ctx context.Context, perm Permission) bool {
+	id := FromContext(ctx)
+	if id == nil {
+		return true
+	}
+	return id.Permission&perm == perm
+}
+
+// authentication methods of identities
+const (
+	methodBasic       = "basic"
+	methodBearerToken = "bearer_token"
+	methodJWT         = "jwt"
+)
+
+// identityName is unique per method, so JWT subject doesn't match user or token with the same name
+type identityName struct {
+	method string
+	name   string
+}
+
+// Auth authenticates http requests
+type Auth struct {
+	enabled           bool
+	htpasswd          htpasswd
+	tokens            []config.AuthBearerToken
+	jwt               *jwtValidator
+	identities        map[identityName]Identity
+	defaultPermission Permission
+}
+
+// New ...
+func New(cfg config.Auth) (*Auth, error) {
+	a := &Auth{
+		enabled:    cfg.Enabled,
+		tokens:     cfg.BearerTokens,
+		identities: make(map[identityName]Identity),
+	}
+	if !cfg.Enabled {
+		return a, nil
+	}
+
+	var err error
+	if cfg.HtpasswdFile != "" {
+		a.htpasswd, err = loadHtpasswd(cfg.HtpasswdFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.JWT.JWKSFile != "" {
+		a.jwt, err = newJWTValidator(cfg)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, v := range cfg.Identities {
+		perm, err := ParsePermission(v.Permission)
+		if err != nil {
+			return nil, err
+		}
+		a.identities[identityName{method: v.Method, name: v.Name}] = Identity{Name: v.Name, Tenant: v.Tenant, Permission: perm, AnyTenant: v.AnyTenant}
+	}
+
+	if cfg.DefaultPermission != "" {
+		a.defaultPermission, err = ParsePermission(cfg.DefaultPermission)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if a.htpasswd == nil && len(a.tokens) == 0 && a.jwt == nil {
+		return nil, errors.New("auth enabled, but no htpasswd_file, bearer_tokens or jwt configured")
+	}
+
+	return a, nil
+}
+
+// identity applies mapping from config. Unmapped identity without permission gets the default one
+func (a *Auth) identity(method string, name string, tenantID string, perm Permission) *Identity {
+	if v, ok := a.identities[identityName{method: method, name: name}]; ok {
+		return &v
+	}
+	if perm == 0 {
+		perm = a.defaultPermission
+	}
+	return &Identity{Name: name, Tenant: tenantID, Permission: perm}
+}
+
+func (a *Auth) authenticate(r *http.Request) (*Identity, error) {
+	if user, password, ok := r.BasicAuth(); ok {
+		if a.htpasswd == nil || !a.htpasswd.check(user, password) {
+			return nil, errors.New("invalid user or password")
+		}
+		return a.identity(methodBasic, user, "", 0), nil
+	}
+
+	header := r.Header.Get("Authorization")
+	token, found := strings.CutPrefix(header, "Bearer ")
+	if !found || token == "" {
+		return nil, errors.New("no credentials")
+	}
+
+	for _, t := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(t.Token), []byte(token)) == 1 {
+			return a.identity(methodBearerToken, t.Name, "", 0), nil
+		}
+	}
+
+	if a.jwt != nil {
+		claims, err := a.jwt.validate(token)
+		if err != nil {
+			return nil, err
+		}
+		return a.identity(methodJWT, claims.subject, claims.tenant, claims.permission), nil
+	}
+
+	return nil, errors.New("invalid token")
+}
+
+// Handler requires authenticated identity with given permission
+func (a *Auth) Handler(perm Permission, next http.Handler) http.Handler {
+	if a == nil || !a.enabled {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, err := a.authenticate(r)
+		if err != nil {
+			slog.InfoContext(r.Context(), "unauthorized request", slog.String("path", r.URL.Path), lg.Error(err))
+			if a.htpasswd != nil {
+				w.Header().Set("WWW-Authenticate", `Basic realm="pluto"`)
+			}
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		ctx := lg.With(With(r.Context(), id), slog.String("identity", id.Name))
+		if id.Tenant != "" {
+			ctx = tenant.With(ctx, id.Tenant)
+		} else if !id.AnyTenant {
+			// rejected by tenant handler if multi-tenancy is enabled
+			ctx = tenant.WithoutBinding(ctx)
+		}
+
+		if !Allowed(ctx, perm) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
@@ -0,0 +1,220 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/pluto-metrics/pluto/pkg/config"
+	"github.com/pluto-metrics/pluto/pkg/tenant"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type testResult struct {
+	code    int
+	name    string
+	tenant  string
+	unbound bool
+}
+
+var multiTenancy = func() *config.Config {
+	cfg := &config.Config{}
+	cfg.Tenant.Enabled = true
+	cfg.Tenant.Default = "anonymous"
+	return cfg
+}()
+
+func serve(a *Auth, perm Permission, r *http.Request) testResult {
+	var ret testResult
+	h := a.Handler(perm, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id := FromContext(r.Context()); id != nil {
+			ret.name = id.Name
+		}
+		ret.tenant = tenant.FromContext(r.Context())
+		// unbound identity is rejected by tenant handler
+		tenantHandler := tenant.NewHandler(multiTenancy, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		rec := httptest.NewRecorder()
+		tenantHandler.ServeHTTP(rec, r)
+		ret.unbound = rec.Code == http.StatusForbidden
+	}))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	ret.code = w.Code
+	return ret
+}
+
+func TestDisabled(t *testing.T) {
+	a, err := New(config.Auth{})
+	require.NoError(t, err)
+
+	ret := serve(a, PermissionWrite, httptest.NewRequest(http.MethodPost, "/api/v1/write", nil))
+	assert.Equal(t, http.StatusOK, ret.code)
+	assert.Equal(t, "", ret.name)
+}
+
+func TestBasicAuth(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	require.NoError(t, err)
+
+	filename := filepath.Join(t.TempDir(), "htpasswd")
+	require.NoError(t, os.WriteFile(filename, []byte("# users\nalice:"+string(hash)+"\nbob:"+string(hash)+"\ndave:"+string(hash)+"\n"), 0600))
+
+	a, err := New(config.Auth{
+		Enabled:      true,
+		HtpasswdFile: filename,
+		Identities: []config.AuthIdentity{
+			{Method: "basic", Name: "bob", Tenant: "team2", Permission: "read"},
+			{Method: "basic", Name: "dave", Permission: "read", AnyTenant: true},
+			{Method: "bearer_token", Name: "alice", Permission: "admin"},
+		},
+	})
+	require.NoError(t, err)
+
+	tests := []struct {
+		user     string
+		password string
+		perm     Permission
+		want     testResult
+	}{
+		// not in identities and no default permission
+		{"alice", "secret", PermissionRead, testResult{code: http.StatusForbidden}},
+		{"alice", "wrong", PermissionRead, testResult{code: http.StatusUnauthorized}},
+		{"carol", "secret", PermissionRead, testResult{code: http.StatusUnauthorized}},
+		{"bob", "secret", PermissionRead, testResult{code: http.StatusOK, name: "bob", tenant: "team2"}},
+		{"bob", "secret", PermissionWrite, testResult{code: http.StatusForbidden}},
+		{"dave", "secret", PermissionRead, testResult{code: http.StatusOK, name: "dave"}},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/query", nil)
+		r.SetBasicAuth(tt.user, tt.password)
+		assert.Equal(t, tt.want, serve(a, tt.perm, r), "%s:%s", tt.user, tt.password)
+	}
+
+	a, err = New(config.Auth{Enabled: true, HtpasswdFile: filename, DefaultPermission: "write"})
+	require.NoError(t, err)
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/write", nil)
+	r.SetBasicAuth("alice", "secret")
+	assert.Equal(t, testResult{code: http.StatusOK, name: "alice", unbound: true}, serve(a, PermissionWrite, r))
+	assert.Equal(t, http.StatusForbidden, serve(a, PermissionRead, r).code)
+}
+
+func TestBearerToken(t *testing.T) {
+	a, err := New(config.Auth{
+		Enabled:      true,
+		BearerTokens: []config.AuthBearerToken{{Name: "prometheus", Token: "t0ken"}},
+		Identities:   []config.AuthIdentity{{Method: "bearer_token", Name: "prometheus", Tenant: "team1", Permission: "write"}},
+	})
+	require.NoError(t, err)
+
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/write", nil)
+	r.Header.Set("Authorization", "Bearer t0ken")
+	assert.Equal(t, testResult{code: http.StatusOK, name: "prometheus", tenant: "team1"}, serve(a, PermissionWrite, r))
+	assert.Equal(t, http.StatusForbidden, serve(a, PermissionRead, r).code)
+
+	r.Header.Set("Authorization", "Bearer wrong")
+	assert.Equal(t, http.StatusUnauthorized, serve(a, PermissionWrite, r).code)
+
+	r.Header.Del("Authorization")
+	assert.Equal(t, http.StatusUnauthorized, serve(a, PermissionWrite, r).code)
+}
+
+func TestJWT(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	jwks, err := json.Marshal(map[string]any{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "k1",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}},
+	})
+	require.NoError(t, err)
+
+	filename := filepath.Join(t.TempDir(), "jwks.json")
+	require.NoError(t, os.WriteFile(filename, jwks, 0600))
+
+	cfg := config.Auth{Enabled: true}
+	cfg.JWT.JWKSFile = filename
+	cfg.JWT.Issuer = "https://issuer"
+	cfg.JWT.TenantClaim = "org"
+	cfg.JWT.PermissionClaim = "perm"
+
+	a, err := New(cfg)
+	require.NoError(t, err)
+
+	sign := func(claims jwt.MapClaims) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		token.Header["kid"] = "k1"
+		s, err := token.SignedString(key)
+		require.NoError(t, err)
+		return s
+	}
+
+	request := func(token string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/query", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		return r
+	}
+
+	exp := time.Now().Add(time.Hour).Unix()
+
+	valid := sign(jwt.MapClaims{"sub": "grafana", "iss": "https://issuer", "exp": exp, "org": "team1", "perm": "read"})
+	assert.Equal(t, testResult{code: http.StatusOK, name: "grafana", tenant: "team1"}, serve(a, PermissionRead, request(valid)))
+	assert.Equal(t, http.StatusForbidden, serve(a, PermissionWrite, request(valid)).code)
+
+	expired := sign(jwt.MapClaims{"sub": "grafana", "iss": "https://issuer", "exp": time.Now().Add(-time.Hour).Unix()})
+	assert.Equal(t, http.StatusUnauthorized, serve(a, PermissionRead, request(expired)).code)
+
+	// least privilege: token without permission claim is rejected
+	noPermission := sign(jwt.MapClaims{"sub": "grafana", "iss": "https://issuer", "exp": exp, "org": "team1"})
+	assert.Equal(t, http.StatusUnauthorized, serve(a, PermissionRead, request(noPermission)).code)
+
+	wrongIssuer := sign(jwt.MapClaims{"sub": "grafana", "iss": "https://other", "exp": exp})
+	assert.Equal(t, http.StatusUnauthorized, serve(a, PermissionRead, request(wrongIssuer)).code)
+
+	// without permission claim unmapped subject gets the default permission, identities of other methods don't match
+	cfg.JWT.PermissionClaim = ""
+	cfg.DefaultPermission = "read"
+	cfg.Identities = []config.AuthIdentity{{Method: "basic", Name: "grafana", Permission: "admin"}}
+	a, err = New(cfg)
+	require.NoError(t, err)
+	assert.Equal(t, testResult{code: http.StatusOK, name: "grafana", tenant: "team1"}, serve(a, PermissionRead, request(noPermission)))
+	assert.Equal(t, http.StatusForbidden, serve(a, PermissionAdmin, request(noPermission)).code)
+
+	cfg.DefaultPermission = ""
+	a, err = New(cfg)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, serve(a, PermissionRead, request(noPermission)).code)
+}
+
+func TestParsePermission(t *testing.T) {
+	perm, err := ParsePermission("read")
+	require.NoError(t, err)
+	assert.Equal(t, PermissionRead, perm)
+
+	perm, err = ParsePermission("admin")
+	require.NoError(t, err)
+	assert.Equal(t, PermissionReadWrite|PermissionAdmin, perm)
+
+	_, err = ParsePermission("")
+	assert.Error(t, err)
+}
+
+func TestNewWithoutMethods(t *testing.T) {
+	_, err := New(config.Auth{Enabled: true})
+	assert.Error(t, err)
+}
@@ -0,0 +1,52 @@
+package auth
+
+import (
+	"bufio"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// htpasswd maps user name to bcrypt hash
+type htpasswd map[string][]byte
+
+func loadHtpasswd(filename string) (htpasswd, error) {
+	// #nosec G304
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer f.Close()
+
+	ret := make(htpasswd)
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, found := strings.Cut(line, ":")
+		if !found || user == "" {
+			return nil, errors.Errorf("%s:%d: malformed line", filename, lineNo)
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, errors.Errorf("%s:%d: only bcrypt hashes are supported", filename, lineNo)
+		}
+		ret[user] = []byte(hash)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return ret, nil
+}
+
+func (h htpasswd) check(user, password string) bool {
+	hash, ok := h[user]
+	if !ok {
+		return false
+	}
+	return bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil
+}
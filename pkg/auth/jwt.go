@@ -0,0 +1,192 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"os"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/pkg/errors"
+	"github.com/pluto-metrics/pluto/pkg/config"
+)
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type jwtClaims struct {
+	subject string
+	tenant  string
+	// zero if permission claim is not configured
+	permission Permission
+}
+
+type jwtValidator struct {
+	keys            map[string]any // kid -> public key
+	parser          *jwt.Parser
+	tenantClaim     string
+	permissionClaim string
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+func (k *jwk) publicKey() (any, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, errors.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, errors.Errorf("unsupported key type %q", k.Kty)
+}
+
+func loadJWKS(filename string) (map[string]any, error) {
+	// #nosec G304
+	body, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	var jwks struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(body, &jwks); err != nil {
+		return nil, errors.Wrapf(err, "can't parse %s", filename)
+	}
+
+	ret := make(map[string]any)
+	for _, k := range jwks.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pub, err := k.publicKey()
+		if err != nil {
+			return nil, errors.Wrapf(err, "key %q", k.Kid)
+		}
+		ret[k.Kid] = pub
+	}
+	if len(ret) == 0 {
+		return nil, errors.Errorf("no signing keys in %s", filename)
+	}
+
+	return ret, nil
+}
+
+func newJWTValidator(cfg config.Auth) (*jwtValidator, error) {
+	keys, err := loadJWKS(cfg.JWT.JWKSFile)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := []jwt.ParserOption{
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}),
+		jwt.WithExpirationRequired(),
+	}
+	if cfg.JWT.Issuer != "" {
+		opts = append(opts, jwt.WithIssuer(cfg.JWT.Issuer))
+	}
+	if cfg.JWT.Audience != "" {
+		opts = append(opts, jwt.WithAudience(cfg.JWT.Audience))
+	}
+
+	return &jwtValidator{
+		keys:            keys,
+		parser:          jwt.NewParser(opts...),
+		tenantClaim:     cfg.JWT.TenantClaim,
+		permissionClaim: cfg.JWT.PermissionClaim,
+	}, nil
+}
+
+func (v *jwtValidator) keyFunc(token *jwt.Token) (any, error) {
+	kid, _ := token.Header["kid"].(string)
+	if key, ok := v.keys[kid]; ok {
+		return key, nil
+	}
+	// single key without kid
+	if kid == "" && len(v.keys) == 1 {
+		for _, key := range v.keys {
+			return key, nil
+		}
+	}
+	return nil, errors.Errorf("unknown key id %q", kid)
+}
+
+func (v *jwtValidator) validate(token string) (*jwtClaims, error) {
+	claims := jwt.MapClaims{}
+	if _, err := v.parser.ParseWithClaims(token, claims, v.keyFunc); err != nil {
+		return nil, err
+	}
+
+	subject, err := claims.GetSubject()
+	if err != nil {
+		return nil, err
+	}
+	if subject == "" {
+		return nil, errors.New("token has no subject")
+	}
+
+	ret := &jwtClaims{
+		subject: subject,
+	}
+
+	if v.tenantClaim != "" {
+		ret.tenant, _ = claims[v.tenantClaim].(string)
+	}
+
+	if v.permissionClaim != "" {
+		s, _ := claims[v.permissionClaim].(string)
+		if s == "" {
+			return nil, errors.Errorf("token has no %s claim", v.permissionClaim)
+		}
+		ret.permission, err = ParsePermission(s)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return ret, nil
+}
@@ -2,6 +2,7 @@ package config
 
 import (
 	"context"
+	"fmt"
 	"log/slog"
 	"net/http"
 	"time"
@@ -9,6 +10,7 @@ import (
 	"github.com/expr-lang/expr/vm"
 	"github.com/go-playground/validator/v10"
 	"github.com/jinzhu/configor"
+	"github.com/prometheus/prometheus/model/relabel"
 )
 
 type ConfigWhen struct {
@@ -21,10 +23,119 @@ type ClickHouse struct {
 	Params map[string]string `yaml:"params"`
 }
 
+type AuthBearerToken struct {
+	Name  string `yaml:"name" validate:"required"`
+	Token string `yaml:"token" validate:"required"`
+}
+
+type AuthIdentity struct {
+	// basic (htpasswd user), bearer_token (token name) or jwt (subject)
+	Method     string `yaml:"method" validate:"required,oneof=basic bearer_token jwt"`
+	Name       string `yaml:"name" validate:"required"`
+	Tenant     string `yaml:"tenant"`
+	Permission string `yaml:"permission" validate:"required,oneof=read write read_write admin"`
+	// identity without tenant selects any tenant by header. Identities without tenant are rejected by multi-tenancy otherwise
+	AnyTenant bool `yaml:"any_tenant"`
+}
+
+type Auth struct {
+	Enabled bool `yaml:"enabled" default:"false"`
+	// bcrypt only
+	HtpasswdFile string            `yaml:"htpasswd_file"`
+	BearerTokens []AuthBearerToken `yaml:"bearer_tokens" validate:"dive"`
+	JWT          struct {
+		JWKSFile string `yaml:"jwks_file"`
+		Issuer   string `yaml:"issuer"`
+		Audience string `yaml:"audience"`
+		// optional claims with tenant id and permission for identities missing in the identities list
+		TenantClaim     string `yaml:"tenant_claim"`
+		PermissionClaim string `yaml:"permission_claim"`
+	} `yaml:"jwt"`
+	// maps user name, token name or JWT subject to tenant and permission
+	Identities []AuthIdentity `yaml:"identities" validate:"dive"`
+	// permission of clients missing in identities without permission claim, no permission if empty
+	DefaultPermission string `yaml:"default_permission" validate:"omitempty,oneof=read write read_write admin"`
+}
+
+type ServerTLS struct {
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	// require client certificates signed by this CA
+	ClientCAFile string `yaml:"client_ca_file"`
+	// how often cert and key files are checked for changes, 5s if zero
+	ReloadInterval time.Duration `yaml:"reload_interval"`
+}
+
+// Server is an optional http server settings for the listen address.
+// Zero values keep net/http defaults, except read_timeout which is 10s
+type Server struct {
+	Listen            string        `yaml:"listen" validate:"required"`
+	TLS               ServerTLS     `yaml:"tls"`
+	ReadTimeout       time.Duration `yaml:"read_timeout"`
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout"`
+	WriteTimeout      time.Duration `yaml:"write_timeout"`
+	IdleTimeout       time.Duration `yaml:"idle_timeout"`
+	MaxHeaderBytes    int           `yaml:"max_header_bytes"`
+	MaxConnections    int           `yaml:"max_connections"`
+}
+
+// Forwarder sends accepted series to a remote write endpoint.
+// Zero values are replaced by defaults: timeout 30s, 1 shard, queue_size 1000, max_retries 10, backoff 100ms..10s
+type Forwarder struct {
+	Name    string            `yaml:"name" validate:"required"`
+	URL     string            `yaml:"url" validate:"required,url"`
+	Headers map[string]string `yaml:"headers"`
+	Timeout time.Duration     `yaml:"timeout"`
+	// parallel senders, series are distributed between them by labels hash
+	Shards int `yaml:"shards"`
+	// requests waiting per shard, the oldest one is dropped on overflow
+	QueueSize  int           `yaml:"queue_size"`
+	MaxRetries int           `yaml:"max_retries"`
+	MinBackoff time.Duration `yaml:"min_backoff"`
+	MaxBackoff time.Duration `yaml:"max_backoff"`
+	// applied to series before sending, same as write_relabel_configs of Prometheus
+	RelabelConfigs []relabel.Config `yaml:"write_relabel_configs"`
+}
+
+// AggregationRule aggregates matched samples in memory and writes the result every interval
+// as new series named <metric>:<interval>[_by_<labels>|_without_<labels>]_<output>.
+// Outputs except rate_sum aggregate the last value of each input series in the interval
+type AggregationRule struct {
+	// series selector, e.g. {__name__=~"container_.*"}
+	Match    string        `yaml:"match" validate:"required"`
+	Interval time.Duration `yaml:"interval" validate:"required"`
+	By       []string      `yaml:"by"`
+	Without  []string      `yaml:"without"`
+	Outputs  []string      `yaml:"outputs" validate:"required,dive,oneof=sum count min max rate_sum quantiles"`
+	// levels of quantiles output, default 0.5, 0.9, 0.99
+	Quantiles []float64 `yaml:"quantiles" validate:"dive,gte=0,lte=1"`
+	// don't write matched input samples
+	DropInput bool `yaml:"drop_input"`
+}
+
+// ThinningRule sets resolution for series matched by selector
+type ThinningRule struct {
+	Match      string        `yaml:"match" validate:"required"`
+	Resolution time.Duration `yaml:"resolution"`
+}
+
 type ConfigInsert struct {
+	// name of the destination without replicas and shards: insert or override_insert<index>
+	Name       string      `yaml:"-"`
 	Table      string      `yaml:"table"`
 	IDFunc     string      `yaml:"id_func" default:"" validate:"oneof='' 'name_with_sha256'"`
 	ClickHouse *ClickHouse `yaml:"clickhouse"`
+	// samples outside of [now-too_old, now+too_far_in_future] are dropped or clamped
+	TooOld         time.Duration `yaml:"too_old"`
+	TooFarInFuture time.Duration `yaml:"too_far_in_future"`
+	OutOfBounds    string        `yaml:"out_of_bounds" default:"" validate:"oneof='' drop clamp"`
+	// write to all replicas concurrently, table and clickhouse are inherited
+	Replicas []InsertDestination `yaml:"replicas"`
+	Ack      string              `yaml:"ack" default:"" validate:"oneof='' all quorum any"`
+	// split series between shards by hash of series id or shard_by labels. Table and clickhouse are inherited
+	Shards    []InsertDestination `yaml:"shards"`
+	ShardBy   []string            `yaml:"shard_by"`
+	ShardAlgo string              `yaml:"shard_algo" default:"" validate:"oneof='' jump rendezvous"`
 }
 
 type ConfigSeries struct {
@@ -33,12 +144,24 @@ type ConfigSeries struct {
 	SeriesPartitionMs        int64         `yaml:"series_partition_ms"`
 	SeriesMaterializedLabels []string      `yaml:"series_materialized_labels"`
 	ClickHouse               *ClickHouse   `yaml:"clickhouse"`
+	Limits                   QueryLimits   `yaml:"limits"`
+}
+
+// QueryLimits restrict a single selector of the query. Zero value keeps the limit of lower priority
+// (select.limits < tenant.limits < override_series), negative value removes it
+type QueryLimits struct {
+	MaxSeries      int           `yaml:"max_series" comment:"max series found by selector"`
+	MaxSamples     int           `yaml:"max_samples" comment:"max samples fetched by selector"`
+	MaxResultBytes int64         `yaml:"max_result_bytes" comment:"max size of clickhouse response with samples"`
+	MaxTimeRange   time.Duration `yaml:"max_time_range" comment:"max time range of selector including lookback and range"`
 }
 
 type ConfigSamples struct {
 	Table                  string      `yaml:"table"`
 	SamplesTimestampUInt32 bool        `yaml:"samples_timestamp_uint32"`
 	ClickHouse             *ClickHouse `yaml:"clickhouse"`
+	// bucket width for range functions, usually the scrape interval. Raw samples are fetched if zero
+	RangeResolution time.Duration `yaml:"range_resolution"`
 }
 
 type Config struct {
@@ -46,10 +169,40 @@ type Config struct {
 
 	Insert struct {
 		Enabled          bool   `yaml:"enabled" default:"true"`
-		Listen           string `yaml:"listen" default:"0.0.0.0:9095" validate:"hostname_port"`
+		Listen           string `yaml:"listen" default:"0.0.0.0:9095" validate:"hostname_port|startswith=unix:"`
 		CloseConnections bool   `yaml:"close-connections" default:"false"`
 		Table            string `yaml:"table" default:"samples_null"`
 		IDFunc           string `yaml:"id_func" default:"name_with_sha256" validate:"oneof=name_with_sha256"`
+		// zero disables the check
+		TooOld         time.Duration `yaml:"too_old" default:"0s"`
+		TooFarInFuture time.Duration `yaml:"too_far_in_future" default:"0s"`
+		OutOfBounds    string        `yaml:"out_of_bounds" default:"drop" validate:"oneof=drop clamp"`
+		Auth           Auth          `yaml:"auth"`
+		// write to all replicas concurrently, table and clickhouse are inherited. Overridden by replicas or shards of override_insert
+		Replicas []InsertDestination `yaml:"replicas"`
+		// how many replicas should confirm the write
+		Ack string `yaml:"ack" default:"all" validate:"oneof=all quorum any"`
+		// failed writes to replicas are queued here and retried in background. Required for ack quorum and any
+		QueueDir string `yaml:"queue_dir" default:""`
+		// tee accepted series to other remote write endpoints
+		Forward []Forwarder `yaml:"forward" validate:"dive"`
+		// streaming aggregation of incoming samples
+		Aggregation []AggregationRule `yaml:"aggregation" validate:"dive"`
+		// drop duplicates and samples written more often than resolution
+		Thinning struct {
+			Enabled bool `yaml:"enabled" default:"false"`
+			// minimal interval between samples of a series, zero drops only duplicated timestamps
+			Resolution time.Duration `yaml:"resolution" default:"0s"`
+			// last timestamps of series not written during ttl are forgotten
+			TTL time.Duration `yaml:"ttl" default:"1h"`
+			// the first matched rule overrides resolution
+			Rules []ThinningRule `yaml:"rules" validate:"dive"`
+		} `yaml:"thinning"`
+		// requests being written hide newer samples of the tenant from select of the same process
+		Watermark struct {
+			MaxLag          time.Duration `yaml:"max_lag" default:"5m" comment:"samples older than now-max_lag don't hold the watermark, backfill doesn't hide recent samples. Zero is no limit"`
+			AllWritersLocal bool          `yaml:"all_writers_local" default:"false" comment:"all inserts of the storage run in this process, incomplete histograms are not dropped after select"`
+		} `yaml:"watermark"`
 	} `yaml:"insert"`
 
 	Select struct {
@@ -61,27 +214,79 @@ type Config struct {
 		// column names should be label_<label_name>
 		SeriesMaterializedLabels []string `yaml:"series_materialize_labels"`
 		SamplesTimestampUInt32   bool     `yaml:"samples_timestamp_uint32"`
+		// samples of range functions (rate, *_over_time, ...) are bucketed by range_resolution instead of step
+		RangeResolution time.Duration `yaml:"range_resolution"`
+		// default limits, tenant.limits and override_series can change them
+		Limits QueryLimits `yaml:"limits"`
+		// samples of long selects are read by slices aligned to the interval, usually the samples table partition. Zero disables splitting
+		SplitInterval    time.Duration `yaml:"split_interval" default:"0s"`
+		SplitConcurrency int           `yaml:"split_concurrency" default:"4" comment:"max concurrent queries of slices of one select"`
 	} `yaml:"select"`
 
 	Prometheus struct {
 		Enabled                    bool          `yaml:"enabled" default:"true"`
-		Listen                     string        `yaml:"listen" default:"0.0.0.0:9096" comment:"listen addr for prometheus ui and api"`
+		Listen                     string        `yaml:"listen" default:"0.0.0.0:9096" validate:"hostname_port|startswith=unix:" comment:"listen addr for prometheus ui and api"`
 		ExternalURL                string        `yaml:"external_url" default:"http://127.0.0.1:9096" comment:"allows to set URL for redirect manually"`
 		PageTitle                  string        `yaml:"page_title" default:"Pluto"`
 		RoutePrefix                string        `yaml:"route_prefix" default:"/" comment:"URL prefix for all routes, e.g. /prom"`
 		LookbackDelta              time.Duration `yaml:"lookback_delta" default:"5m"`
 		RemoteReadConcurrencyLimit int           `yaml:"remote_read_concurrency_limit" default:"10" comment:"concurrently handled remote read requests"`
+		RemoteReadSampleLimit      int           `yaml:"remote_read_sample_limit" default:"50000000" comment:"max samples in a single query of remote read with samples response type, 0 is no limit"`
+		RemoteReadBytesInFrame     int           `yaml:"remote_read_bytes_in_frame" default:"1048576" comment:"max bytes in a frame of streamed chunks response"`
+		AggregationPushdown        bool          `yaml:"aggregation_pushdown" default:"false" comment:"compute sum, min, max and count by() of instant selectors and of sum, count, min and max _over_time functions in clickhouse"`
+		QueryTimeout               time.Duration `yaml:"query_timeout" default:"1m" comment:"max execution time of promql query"`
+		QueryMaxSamples            int           `yaml:"query_max_samples" default:"50000000" comment:"max samples loaded into memory by promql engine at once"`
+		QueryShards                int           `yaml:"query_shards" default:"0" comment:"split sum, min, max and count by() into shards executed concurrently, 0 or 1 disables"`
+		Auth                       Auth          `yaml:"auth"`
+		// cache of query_range results split by days
+		ResultsCache struct {
+			Enabled     bool          `yaml:"enabled" default:"false"`
+			MaxItems    int           `yaml:"max_items" default:"10000" comment:"max cached extents (query and day) in memory"`
+			Freshness   time.Duration `yaml:"freshness" default:"10m" comment:"results newer than now-freshness are not cached"`
+			Dir         string        `yaml:"dir" default:"" comment:"optional directory for on-disk cache"`
+			TTL         time.Duration `yaml:"ttl" default:"168h" comment:"max age of on-disk cache items"`
+			Concurrency int           `yaml:"concurrency" default:"4" comment:"max concurrent queries of not cached extents of one request"`
+		} `yaml:"results_cache"`
+		// cardinality statistics of /api/v1/status/tsdb computed from the series table
+		TSDBStatus struct {
+			Enabled         bool          `yaml:"enabled" default:"false"`
+			Window          time.Duration `yaml:"window" default:"24h" comment:"series seen during the window are counted"`
+			RefreshInterval time.Duration `yaml:"refresh_interval" default:"15m"`
+			Limit           int           `yaml:"limit" default:"100" comment:"max items of each top list"`
+		} `yaml:"tsdb_status"`
+		// admin API: series deletion and backups
+		Admin struct {
+			Enabled    bool   `yaml:"enabled" default:"false" comment:"enables /api/v1/admin/tsdb/* and /api/v1/pluto/admin/*, requires prometheus.auth with admin permission"`
+			DeleteMode string `yaml:"delete_mode" default:"lightweight" validate:"oneof=lightweight mutation" comment:"lightweight DELETE FROM or ALTER TABLE ... DELETE mutation"`
+			Cluster    string `yaml:"cluster" default:"" comment:"runs statements ON CLUSTER"`
+			BackupDisk string `yaml:"backup_disk" default:"backups" comment:"snapshots are written by BACKUP ... TO Disk(backup_disk, name), File(name) if empty"`
+		} `yaml:"admin"`
 	} `yaml:"prometheus"`
 
+	Tenant struct {
+		Enabled bool   `yaml:"enabled" default:"false"`
+		Header  string `yaml:"header" default:"X-Scope-OrgID"`
+		// used for requests without header, empty value rejects such requests
+		Default string `yaml:"default" default:""`
+		// inject tenant as label on insert and filter series by it on select. Required unless override_series selects tables by tenant
+		Label string `yaml:"label" default:""`
+		// query limits by tenant id
+		Limits map[string]QueryLimits `yaml:"limits"`
+	} `yaml:"tenant"`
+
+	// settings for listen addresses of insert, prometheus and debug. Address can be unix:/path/to.sock
+	Servers []Server `yaml:"servers" validate:"dive"`
+
 	Logging struct {
 		Level slog.Level `yaml:"level" default:"info"`
 	} `yaml:"logging"`
 
 	Debug struct {
 		Enabled bool   `yaml:"enabled" default:"true"`
-		Listen  string `yaml:"listen" default:"0.0.0.0:9095"`
+		Listen  string `yaml:"listen" default:"0.0.0.0:9095" validate:"hostname_port|startswith=unix:"`
 		Pprof   bool   `yaml:"pprof" default:"true"`
 		Metrics bool   `yaml:"metrics" default:"true"`
+		Auth    Auth   `yaml:"auth"`
 	} `yaml:"debug"`
 
 	OverrideInsert []struct {
@@ -107,7 +312,61 @@ type Config struct {
 
 // Validate ...
 func (cfg *Config) Validate() error {
-	return validator.New(validator.WithRequiredStructEnabled()).Struct(cfg)
+	if err := validator.New(validator.WithRequiredStructEnabled()).Struct(cfg); err != nil {
+		return err
+	}
+	if err := cfg.validateTenant(); err != nil {
+		return err
+	}
+	if err := cfg.validateInsertDestinations(); err != nil {
+		return err
+	}
+	if err := cfg.validateAdmin(); err != nil {
+		return err
+	}
+	return cfg.validateServers()
+}
+
+// validateAdmin requires prometheus.auth for the admin API, without it anyone could delete series
+func (cfg *Config) validateAdmin() error {
+	if !cfg.Prometheus.Enabled || !cfg.Prometheus.Admin.Enabled || cfg.Prometheus.Auth.Enabled {
+		return nil
+	}
+	return fmt.Errorf("prometheus: admin requires auth enabled")
+}
+
+// validateTenant requires tenant.label or a series table selected by tenant in override_series,
+// otherwise all tenants read the same series
+func (cfg *Config) validateTenant() error {
+	if !cfg.Tenant.Enabled || cfg.Tenant.Label != "" {
+		return nil
+	}
+	for _, o := range cfg.OverrideSeries {
+		if o.Table != "" && o.uses("tenant") {
+			return nil
+		}
+	}
+	return fmt.Errorf("tenant: label or override_series with table selected by tenant is required")
+}
+
+// validateServers rejects servers settings for addresses not listened by enabled insert, prometheus or debug
+func (cfg *Config) validateServers() error {
+	listen := make(map[string]bool)
+	if cfg.Insert.Enabled {
+		listen[cfg.Insert.Listen] = true
+	}
+	if cfg.Prometheus.Enabled {
+		listen[cfg.Prometheus.Listen] = true
+	}
+	if cfg.Debug.Enabled {
+		listen[cfg.Debug.Listen] = true
+	}
+	for _, s := range cfg.Servers {
+		if !listen[s.Listen] {
+			return fmt.Errorf("servers: no enabled listener with address %q", s.Listen)
+		}
+	}
+	return nil
 }
 
 // Compile ...
@@ -116,6 +375,10 @@ func (cfg *Config) Compile() error {
 		return err
 	}
 
+	if err := cfg.compileAck(cfg.Insert.Ack); err != nil {
+		return err
+	}
+
 	for i := 0; i < len(cfg.OverrideInsert); i++ {
 		if err := cfg.OverrideInsert[i].ClickHouse.compile(); err != nil {
 			return err
@@ -123,6 +386,12 @@ func (cfg *Config) Compile() error {
 		if err := cfg.OverrideInsert[i].compileWhen(EnvInsert{}); err != nil {
 			return err
 		}
+		if err := cfg.compileAck(cfg.OverrideInsert[i].Ack); err != nil {
+			return err
+		}
+		if err := cfg.OverrideInsert[i].compileShards(); err != nil {
+			return err
+		}
 	}
 
 	for i := 0; i < len(cfg.OverrideSeries); i++ {
@@ -0,0 +1,112 @@
+package config
+
+import (
+	"reflect"
+
+	"github.com/pkg/errors"
+)
+
+// InsertDestination is a replica or a shard of the insert. Name must be unique, it is used
+// in metrics and in the queue directory
+type InsertDestination struct {
+	Name       string      `yaml:"name"`
+	Table      string      `yaml:"table"`
+	ClickHouse *ClickHouse `yaml:"clickhouse"`
+}
+
+// Destinations returns ClickHouse targets of the insert
+func (c ConfigInsert) Destinations() []InsertDestination {
+	if len(c.Replicas) == 0 {
+		return []InsertDestination{{
+			Name:       c.Name,
+			Table:      c.Table,
+			ClickHouse: c.ClickHouse,
+		}}
+	}
+
+	ret := make([]InsertDestination, len(c.Replicas))
+	for i, r := range c.Replicas {
+		ret[i] = InsertDestination{
+			Name:       r.Name,
+			Table:      mergeZero(c.Table, r.Table),
+			ClickHouse: mergeClickHouse(c.ClickHouse, r.ClickHouse),
+		}
+	}
+	return ret
+}
+
+// ShardDestinations returns shards of the insert or nil if sharding is disabled
+func (c ConfigInsert) ShardDestinations() []InsertDestination {
+	if len(c.Shards) == 0 {
+		return nil
+	}
+
+	ret := make([]InsertDestination, len(c.Shards))
+	for i, s := range c.Shards {
+		ret[i] = InsertDestination{
+			Name:       s.Name,
+			Table:      mergeZero(c.Table, s.Table),
+			ClickHouse: mergeClickHouse(c.ClickHouse, s.ClickHouse),
+		}
+	}
+	return ret
+}
+
+// InsertDestinations returns destinations of insert and all override_insert
+func (cfg *Config) InsertDestinations() []InsertDestination {
+	configs := []ConfigInsert{cfg.baseInsert()}
+	for i := range cfg.OverrideInsert {
+		configs = append(configs, cfg.overrideInsert(i))
+	}
+
+	var ret []InsertDestination
+	for _, c := range configs {
+		ret = append(ret, c.Destinations()...)
+		ret = append(ret, c.ShardDestinations()...)
+	}
+	return ret
+}
+
+// validateInsertDestinations requires names of replicas and shards and rejects the same name for different
+// destinations, e.g. replicas inherited by override_insert with another clickhouse
+func (cfg *Config) validateInsertDestinations() error {
+	seen := make(map[string]InsertDestination)
+	for _, d := range cfg.InsertDestinations() {
+		if d.Name == "" {
+			return errors.New("insert replicas and shards require name")
+		}
+		if prev, ok := seen[d.Name]; ok && !reflect.DeepEqual(prev, d) {
+			return errors.Errorf("insert destination name %q is used for different destinations, override_insert with other table or clickhouse needs own replicas", d.Name)
+		}
+		seen[d.Name] = d
+	}
+	return nil
+}
+
+// AckRequired returns number of destinations which should confirm the write
+func (c ConfigInsert) AckRequired(destinations int) int {
+	switch c.Ack {
+	case "any":
+		return 1
+	case "quorum":
+		return destinations/2 + 1
+	}
+	return destinations
+}
+
+func (cfg *Config) compileAck(ack string) error {
+	if (ack == "quorum" || ack == "any") && cfg.Insert.QueueDir == "" {
+		return errors.Errorf("ack %q requires insert.queue_dir", ack)
+	}
+	return nil
+}
+
+func (c ConfigInsert) compileShards() error {
+	if len(c.Shards) > 0 && len(c.Replicas) > 0 {
+		return errors.New("insert shards and replicas can't be used together")
+	}
+	if len(c.Shards) == 0 && (len(c.ShardBy) > 0 || c.ShardAlgo != "") {
+		return errors.New("shard_by and shard_algo require shards")
+	}
+	return nil
+}
@@ -5,7 +5,7 @@ import (
 )
 
 type nullable interface {
-	map[string]string | *vm.Program | []string
+	map[string]string | *vm.Program | []string | []InsertDestination
 }
 
 func mergeZero[T comparable](values ...T) T {
@@ -39,3 +39,15 @@ func mergeClickHouse(values ...*ClickHouse) *ClickHouse {
 	}
 	return ret
 }
+
+// mergeQueryLimits returns the last non-zero limits, negative values mean no limit
+func mergeQueryLimits(values ...QueryLimits) QueryLimits {
+	ret := QueryLimits{}
+	for i := 0; i < len(values); i++ {
+		ret.MaxSeries = mergeZero(ret.MaxSeries, values[i].MaxSeries)
+		ret.MaxSamples = mergeZero(ret.MaxSamples, values[i].MaxSamples)
+		ret.MaxResultBytes = mergeZero(ret.MaxResultBytes, values[i].MaxResultBytes)
+		ret.MaxTimeRange = mergeZero(ret.MaxTimeRange, values[i].MaxTimeRange)
+	}
+	return ret
+}
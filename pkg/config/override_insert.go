@@ -1,12 +1,14 @@
 package config
 
 import (
+	"fmt"
 	"net/http"
 )
 
 type EnvInsert struct {
 	GetParams map[string]string `expr:"GET"`
 	Headers   map[string]string `expr:"HEADER"`
+	Tenant    string            `expr:"tenant"`
 }
 
 func NewEnvInsert() *EnvInsert {
@@ -17,29 +19,62 @@ func NewEnvInsert() *EnvInsert {
 }
 
 func (cfg *Config) GetInsert(values *EnvInsert) (ConfigInsert, error) {
-	ret := ConfigInsert{
-		Table:      cfg.Insert.Table,
-		IDFunc:     cfg.Insert.IDFunc,
-		ClickHouse: &cfg.ClickHouse,
-	}
+	ret := cfg.baseInsert()
 
-	for _, o := range cfg.OverrideInsert {
+	for i, o := range cfg.OverrideInsert {
 		result, err := o.When(values)
 		if err != nil {
 			return ret, err
 		}
 
 		if result {
-			ret.Table = mergeZero(ret.Table, o.Table)
-			ret.IDFunc = mergeZero(ret.IDFunc, o.IDFunc)
-			ret.ClickHouse = mergeClickHouse(ret.ClickHouse, o.ClickHouse)
-			return ret, nil
+			return cfg.overrideInsert(i), nil
 		}
 	}
 
 	return ret, nil
 }
 
+// overrideInsert returns override_insert merged with insert
+func (cfg *Config) overrideInsert(i int) ConfigInsert {
+	ret := mergeInsert(cfg.baseInsert(), cfg.OverrideInsert[i].ConfigInsert)
+	ret.Name = fmt.Sprintf("override_insert%d", i)
+	return ret
+}
+
+func (cfg *Config) baseInsert() ConfigInsert {
+	return ConfigInsert{
+		Name:           "insert",
+		Table:          cfg.Insert.Table,
+		IDFunc:         cfg.Insert.IDFunc,
+		ClickHouse:     &cfg.ClickHouse,
+		TooOld:         cfg.Insert.TooOld,
+		TooFarInFuture: cfg.Insert.TooFarInFuture,
+		OutOfBounds:    cfg.Insert.OutOfBounds,
+		Replicas:       cfg.Insert.Replicas,
+		Ack:            cfg.Insert.Ack,
+	}
+}
+
+func mergeInsert(ret ConfigInsert, o ConfigInsert) ConfigInsert {
+	ret.Table = mergeZero(ret.Table, o.Table)
+	ret.IDFunc = mergeZero(ret.IDFunc, o.IDFunc)
+	ret.ClickHouse = mergeClickHouse(ret.ClickHouse, o.ClickHouse)
+	ret.TooOld = mergeZero(ret.TooOld, o.TooOld)
+	ret.TooFarInFuture = mergeZero(ret.TooFarInFuture, o.TooFarInFuture)
+	ret.OutOfBounds = mergeZero(ret.OutOfBounds, o.OutOfBounds)
+	ret.Replicas = mergeNil(ret.Replicas, o.Replicas)
+	if len(o.Shards) > 0 {
+		// replicas of insert are not inherited by sharded override
+		ret.Replicas = nil
+	}
+	ret.Ack = mergeZero(ret.Ack, o.Ack)
+	ret.Shards = mergeNil(ret.Shards, o.Shards)
+	ret.ShardBy = mergeNil(ret.ShardBy, o.ShardBy)
+	ret.ShardAlgo = mergeZero(ret.ShardAlgo, o.ShardAlgo)
+	return ret
+}
+
 func (env *EnvInsert) WithRequest(r *http.Request) *EnvInsert {
 	for k := range r.URL.Query() {
 		env.GetParams[k] = r.URL.Query().Get(k)
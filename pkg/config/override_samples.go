@@ -11,6 +11,7 @@ func (cfg *Config) GetSamples(values *EnvSamples) (ConfigSamples, error) {
 		Table:                  cfg.Select.TableSamples,
 		ClickHouse:             &cfg.ClickHouse,
 		SamplesTimestampUInt32: cfg.Select.SamplesTimestampUInt32,
+		RangeResolution:        cfg.Select.RangeResolution,
 	}
 
 	for _, o := range cfg.OverrideSamples {
@@ -23,6 +24,7 @@ func (cfg *Config) GetSamples(values *EnvSamples) (ConfigSamples, error) {
 			ret.Table = mergeZero(ret.Table, o.Table)
 			ret.ClickHouse = mergeClickHouse(ret.ClickHouse, o.ClickHouse)
 			ret.SamplesTimestampUInt32 = mergeZero(ret.SamplesTimestampUInt32, o.SamplesTimestampUInt32)
+			ret.RangeResolution = mergeZero(ret.RangeResolution, o.RangeResolution)
 			return ret, nil
 		}
 	}
@@ -12,6 +12,7 @@ type EnvSeries struct {
 	ShardCount      uint64   `expr:"shard_count"`
 	ShardIndex      uint64   `expr:"shard_index"`
 	DisableTrimming bool     `expr:"disable_trimming"`
+	Tenant          string   `expr:"tenant"`
 }
 
 func NewEnvSeries() *EnvSeries {
@@ -25,6 +26,11 @@ func (cfg *Config) GetSeries(values *EnvSeries) (ConfigSeries, error) {
 		SeriesPartitionMs:        cfg.Select.SeriesPartitionMs,
 		SeriesMaterializedLabels: cfg.Select.SeriesMaterializedLabels,
 		ClickHouse:               &cfg.ClickHouse,
+		Limits:                   cfg.Select.Limits,
+	}
+
+	if limits, ok := cfg.Tenant.Limits[values.Tenant]; ok && cfg.Tenant.Enabled {
+		ret.Limits = mergeQueryLimits(ret.Limits, limits)
 	}
 
 	for _, o := range cfg.OverrideSeries {
@@ -39,6 +45,7 @@ func (cfg *Config) GetSeries(values *EnvSeries) (ConfigSeries, error) {
 			ret.SeriesPartitionMs = mergeZero(ret.SeriesPartitionMs, o.SeriesPartitionMs)
 			ret.SeriesMaterializedLabels = mergeNil(ret.SeriesMaterializedLabels, o.SeriesMaterializedLabels)
 			ret.ClickHouse = mergeClickHouse(ret.ClickHouse, o.ClickHouse)
+			ret.Limits = mergeQueryLimits(ret.Limits, o.Limits)
 			return ret, nil
 		}
 	}
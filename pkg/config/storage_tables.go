@@ -0,0 +1,47 @@
+package config
+
+// StorageTable is a series or samples table from select settings or one of overrides
+type StorageTable struct {
+	Table                  string
+	ClickHouse             *ClickHouse
+	Series                 bool
+	SamplesTimestampUInt32 bool
+}
+
+// StorageTables returns unique tables of select, override_series and override_samples.
+// Admin operations like deletion apply to all of them, including downsampled tables
+func (cfg *Config) StorageTables() []StorageTable {
+	var ret []StorageTable
+	seen := make(map[string]bool)
+	add := func(t StorageTable) {
+		if t.Table == "" {
+			return
+		}
+		key := t.ClickHouse.DSN + "\xff" + t.Table
+		if seen[key] {
+			return
+		}
+		seen[key] = true
+		ret = append(ret, t)
+	}
+
+	add(StorageTable{Table: cfg.Select.TableSeries, ClickHouse: &cfg.ClickHouse, Series: true})
+	for _, o := range cfg.OverrideSeries {
+		add(StorageTable{
+			Table:      mergeZero(cfg.Select.TableSeries, o.Table),
+			ClickHouse: mergeClickHouse(&cfg.ClickHouse, o.ClickHouse),
+			Series:     true,
+		})
+	}
+
+	add(StorageTable{Table: cfg.Select.TableSamples, ClickHouse: &cfg.ClickHouse, SamplesTimestampUInt32: cfg.Select.SamplesTimestampUInt32})
+	for _, o := range cfg.OverrideSamples {
+		add(StorageTable{
+			Table:                  mergeZero(cfg.Select.TableSamples, o.Table),
+			ClickHouse:             mergeClickHouse(&cfg.ClickHouse, o.ClickHouse),
+			SamplesTimestampUInt32: mergeZero(cfg.Select.SamplesTimestampUInt32, o.SamplesTimestampUInt32),
+		})
+	}
+
+	return ret
+}
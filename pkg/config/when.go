@@ -4,6 +4,8 @@ import (
 	"log/slog"
 
 	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/ast"
+	"github.com/expr-lang/expr/parser"
 	"github.com/pluto-metrics/pluto/pkg/lg"
 	"github.com/spf13/cast"
 )
@@ -45,3 +47,28 @@ func (w *ConfigWhen) Pass() bool {
 	}
 	return false
 }
+
+type identifierVisitor struct {
+	name  string
+	found bool
+}
+
+func (v *identifierVisitor) Visit(node *ast.Node) {
+	if n, ok := (*node).(*ast.IdentifierNode); ok && n.Value == v.name {
+		v.found = true
+	}
+}
+
+// uses reports if the expression refers to the variable
+func (w *ConfigWhen) uses(name string) bool {
+	if w == nil || w.WhenStr == "" {
+		return false
+	}
+	tree, err := parser.Parse(w.WhenStr)
+	if err != nil {
+		return false
+	}
+	v := &identifierVisitor{name: name}
+	ast.Walk(&tree.Node, v)
+	return v.found
+}
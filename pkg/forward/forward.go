@@ -0,0 +1,254 @@
+package forward
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/pkg/errors"
+	"github.com/pluto-metrics/pluto/pkg/config"
+	"github.com/pluto-metrics/pluto/pkg/lg"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/relabel"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+const (
+	defaultTimeout    = 30 * time.Second
+	defaultQueueSize  = 1000
+	defaultMaxRetries = 10
+	defaultMinBackoff = 100 * time.Millisecond
+	defaultMaxBackoff = 10 * time.Second
+)
+
+var sentSamples = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "pluto_forward_sent_samples_total",
+	Help: "Samples sent to remote write endpoint",
+}, []string{"forwarder"})
+
+var droppedSamples = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "pluto_forward_dropped_samples_total",
+	Help: "Samples not sent to remote write endpoint",
+}, []string{"forwarder", "reason"})
+
+var retries = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "pluto_forward_retries_total",
+	Help: "Retried requests to remote write endpoint",
+}, []string{"forwarder"})
+
+var queueLength = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "pluto_forward_queue_length",
+	Help: "Requests waiting to be sent to remote write endpoint",
+}, []string{"forwarder"})
+
+type batch struct {
+	tenant  string
+	series  []prompb.TimeSeries
+	samples int
+}
+
+// Forwarder re-encodes series as Prometheus remote write and sends them to the endpoint in background
+type Forwarder struct {
+	cfg          config.Forwarder
+	client       *http.Client
+	tenantHeader string
+	relabel      []*relabel.Config
+	queues       []chan *batch
+}
+
+func New(ctx context.Context, cfg config.Forwarder, tenantHeader string, client *http.Client) *Forwarder {
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultTimeout
+	}
+	if cfg.Shards <= 0 {
+		cfg.Shards = 1
+	}
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = defaultQueueSize
+	}
+	if cfg.MaxRetries <= 0 {
+		cfg.MaxRetries = defaultMaxRetries
+	}
+	if cfg.MinBackoff <= 0 {
+		cfg.MinBackoff = defaultMinBackoff
+	}
+	if cfg.MaxBackoff <= 0 {
+		cfg.MaxBackoff = defaultMaxBackoff
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	f := &Forwarder{
+		cfg:          cfg,
+		client:       client,
+		tenantHeader: tenantHeader,
+		queues:       make([]chan *batch, cfg.Shards),
+	}
+	for i := range cfg.RelabelConfigs {
+		f.relabel = append(f.relabel, &cfg.RelabelConfigs[i])
+	}
+	for i := range f.queues {
+		f.queues[i] = make(chan *batch, cfg.QueueSize)
+		go f.worker(ctx, f.queues[i])
+	}
+	return f
+}
+
+// Push relabels series and puts them to the queues of shards. It never blocks:
+// the oldest request of the shard is dropped if the queue is full
+func (f *Forwarder) Push(tenant string, series []prompb.TimeSeries) {
+	batches := make([]*batch, len(f.queues))
+	sb := labels.NewScratchBuilder(0)
+
+	for _, ts := range series {
+		sb.Reset()
+		for _, l := range ts.Labels {
+			sb.Add(l.Name, l.Value)
+		}
+		sb.Sort()
+		lb := sb.Labels()
+
+		if len(f.relabel) > 0 {
+			var keep bool
+			lb, keep = relabel.Process(lb, f.relabel...)
+			if !keep {
+				droppedSamples.WithLabelValues(f.cfg.Name, "relabel").Add(float64(len(ts.Samples)))
+				continue
+			}
+		}
+
+		shard := 0
+		if len(f.queues) > 1 {
+			shard = int(lb.Hash() % uint64(len(f.queues)))
+		}
+		if batches[shard] == nil {
+			batches[shard] = &batch{tenant: tenant}
+		}
+		b := batches[shard]
+		b.series = append(b.series, prompb.TimeSeries{
+			Labels:     prompb.FromLabels(lb, nil),
+			Samples:    ts.Samples,
+			Exemplars:  ts.Exemplars,
+			Histograms: ts.Histograms,
+		})
+		b.samples += len(ts.Samples)
+	}
+
+	for i, b := range batches {
+		if b != nil {
+			f.enqueue(f.queues[i], b)
+		}
+	}
+}
+
+func (f *Forwarder) enqueue(queue chan *batch, b *batch) {
+	for {
+		select {
+		case queue <- b:
+			queueLength.WithLabelValues(f.cfg.Name).Inc()
+			return
+		default:
+		}
+
+		// full, drop the oldest one
+		select {
+		case old := <-queue:
+			queueLength.WithLabelValues(f.cfg.Name).Dec()
+			droppedSamples.WithLabelValues(f.cfg.Name, "queue_full").Add(float64(old.samples))
+		default:
+		}
+	}
+}
+
+func (f *Forwarder) worker(ctx context.Context, queue chan *batch) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case b := <-queue:
+			queueLength.WithLabelValues(f.cfg.Name).Dec()
+			if err := f.sendWithRetries(ctx, b); err != nil {
+				slog.Error("can't forward series", slog.String("forwarder", f.cfg.Name), lg.Error(err))
+				droppedSamples.WithLabelValues(f.cfg.Name, "failed").Add(float64(b.samples))
+				continue
+			}
+			sentSamples.WithLabelValues(f.cfg.Name).Add(float64(b.samples))
+		}
+	}
+}
+
+// recoverableError can be fixed by retry
+type recoverableError struct {
+	error
+}
+
+func (f *Forwarder) sendWithRetries(ctx context.Context, b *batch) error {
+	raw, err := (&prompb.WriteRequest{Timeseries: b.series}).Marshal()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	body := snappy.Encode(nil, raw)
+
+	backoff := f.cfg.MinBackoff
+	for attempt := 0; ; attempt++ {
+		err = f.send(ctx, b.tenant, body)
+		if err == nil {
+			return nil
+		}
+		if _, ok := err.(recoverableError); !ok || attempt >= f.cfg.MaxRetries {
+			return err
+		}
+
+		retries.WithLabelValues(f.cfg.Name).Inc()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, f.cfg.MaxBackoff)
+	}
+}
+
+func (f *Forwarder) send(ctx context.Context, tenant string, body []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, f.cfg.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, f.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	for k, v := range f.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+	if tenant != "" && f.tenantHeader != "" {
+		req.Header.Set(f.tenantHeader, tenant)
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return recoverableError{errors.WithStack(err)}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 == 2 {
+		io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	err = errors.Errorf("server returned HTTP status %s: %s", resp.Status, bytes.TrimSpace(msg))
+	if resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests {
+		return recoverableError{err}
+	}
+	return err
+}
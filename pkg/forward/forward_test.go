@@ -0,0 +1,151 @@
+package forward
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/pluto-metrics/pluto/pkg/config"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/relabel"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type receiver struct {
+	sync.Mutex
+	srv      *httptest.Server
+	failures atomic.Int32
+	status   int
+	series   []prompb.TimeSeries
+	tenants  []string
+}
+
+func newReceiver(t *testing.T) *receiver {
+	rcv := &receiver{status: http.StatusServiceUnavailable}
+	rcv.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rcv.failures.Add(-1) >= 0 {
+			w.WriteHeader(rcv.status)
+			return
+		}
+		compressed, _ := io.ReadAll(r.Body)
+		raw, err := snappy.Decode(nil, compressed)
+		require.NoError(t, err)
+		req := &prompb.WriteRequest{}
+		require.NoError(t, req.Unmarshal(raw))
+
+		rcv.Lock()
+		rcv.series = append(rcv.series, req.Timeseries...)
+		rcv.tenants = append(rcv.tenants, r.Header.Get("X-Scope-OrgID"))
+		rcv.Unlock()
+	}))
+	t.Cleanup(rcv.srv.Close)
+	return rcv
+}
+
+func (rcv *receiver) received() ([]prompb.TimeSeries, []string) {
+	rcv.Lock()
+	defer rcv.Unlock()
+	return append([]prompb.TimeSeries{}, rcv.series...), append([]string{}, rcv.tenants...)
+}
+
+func testSeries(names ...string) []prompb.TimeSeries {
+	var ret []prompb.TimeSeries
+	for _, n := range names {
+		ret = append(ret, prompb.TimeSeries{
+			Labels:  []prompb.Label{{Name: "__name__", Value: n}, {Name: "job", Value: "test"}},
+			Samples: []prompb.Sample{{Value: 1, Timestamp: 1000}},
+		})
+	}
+	return ret
+}
+
+func TestForwardRelabelAndTenant(t *testing.T) {
+	assert := assert.New(t)
+
+	rcv := newReceiver(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	f := New(ctx, config.Forwarder{
+		Name: "test",
+		URL:  rcv.srv.URL,
+		RelabelConfigs: []relabel.Config{{
+			SourceLabels: []model.LabelName{"__name__"},
+			Separator:    ";",
+			Regex:        relabel.MustNewRegexp("go_.*"),
+			Replacement:  "$1",
+			Action:       relabel.Drop,
+		}},
+	}, "X-Scope-OrgID", nil)
+
+	f.Push("tenant1", testSeries("up", "go_goroutines"))
+
+	assert.Eventually(func() bool {
+		series, _ := rcv.received()
+		return len(series) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	series, tenants := rcv.received()
+	assert.Equal([]prompb.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "test"}}, series[0].Labels)
+	assert.Equal([]string{"tenant1"}, tenants)
+}
+
+func TestForwardRetries(t *testing.T) {
+	assert := assert.New(t)
+
+	rcv := newReceiver(t)
+	rcv.failures.Store(2)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	f := New(ctx, config.Forwarder{
+		Name:       "test",
+		URL:        rcv.srv.URL,
+		Shards:     4,
+		MinBackoff: time.Millisecond,
+	}, "", nil)
+
+	f.Push("", testSeries("a", "b", "c", "d", "e", "f", "g", "h"))
+
+	assert.Eventually(func() bool {
+		series, _ := rcv.received()
+		return len(series) == 8
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestForwardNotRecoverable(t *testing.T) {
+	rcv := newReceiver(t)
+	rcv.status = http.StatusBadRequest
+	rcv.failures.Store(1)
+
+	f := New(context.Background(), config.Forwarder{Name: "test", URL: rcv.srv.URL, MinBackoff: time.Millisecond}, "", nil)
+
+	b := &batch{series: testSeries("up"), samples: 1}
+	assert.Error(t, f.sendWithRetries(context.Background(), b))
+	// the next attempt is successful, but there should be no retry on 4xx
+	series, _ := rcv.received()
+	assert.Empty(t, series)
+}
+
+func TestForwardQueueOverflow(t *testing.T) {
+	assert := assert.New(t)
+
+	f := &Forwarder{cfg: config.Forwarder{Name: "test"}}
+	queue := make(chan *batch, 2)
+
+	for i := 1; i <= 3; i++ {
+		f.enqueue(queue, &batch{samples: i})
+	}
+
+	// the oldest one is dropped
+	assert.Equal(2, (<-queue).samples)
+	assert.Equal(3, (<-queue).samples)
+}
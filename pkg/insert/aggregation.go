@@ -0,0 +1,60 @@
+package insert
+
+import (
+	"github.com/pluto-metrics/pluto/pkg/aggregate"
+	"github.com/pluto-metrics/pluto/pkg/insert/labels"
+)
+
+type aggregatedSeries struct {
+	labels  []labels.Bytes
+	samples []pbSample
+}
+
+// aggregationBatch keeps accepted samples of a request matched by aggregation rules. They are pushed
+// to the aggregator by commit only after successful write, so retried requests are not counted twice
+type aggregationBatch struct {
+	aggregator *aggregate.Aggregator
+	tenant     string
+	series     []aggregatedSeries
+}
+
+// newAggregationBatch returns nil batch which matches nothing if aggregator is nil
+func newAggregationBatch(aggregator *aggregate.Aggregator, tenant string) *aggregationBatch {
+	if aggregator == nil {
+		return nil
+	}
+	return &aggregationBatch{aggregator: aggregator, tenant: tenant}
+}
+
+// add keeps copy of matched series. Returns true if the series should not be written because of drop_input.
+// Label bytes refer to the request which outlives the batch
+func (b *aggregationBatch) add(lbs []labels.Bytes, samples []pbSample) bool {
+	if b == nil {
+		return false
+	}
+	matched, drop := b.aggregator.Match(lbs)
+	if matched {
+		b.series = append(b.series, aggregatedSeries{
+			labels:  append([]labels.Bytes(nil), lbs...),
+			samples: append([]pbSample(nil), samples...),
+		})
+	}
+	return drop
+}
+
+// commit pushes samples to the aggregator
+func (b *aggregationBatch) commit() {
+	if b == nil {
+		return
+	}
+	for _, s := range b.series {
+		b.aggregator.Push(b.tenant, s.labels, func(yield func(int64, float64) bool) {
+			for _, sample := range s.samples {
+				if !yield(sample.Timestamp, sample.Value) {
+					return
+				}
+			}
+		})
+	}
+	b.series = nil
+}
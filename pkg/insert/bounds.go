@@ -0,0 +1,97 @@
+package insert
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/pluto-metrics/pluto/pkg/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	minTimestamp = math.MinInt64
+	maxTimestamp = math.MaxInt64
+)
+
+const (
+	reasonTooOld         = "too_old"
+	reasonTooFarInFuture = "too_far_in_future"
+)
+
+var discardedSamples = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "pluto_insert_discarded_samples_total",
+	Help: "Samples dropped on insert",
+}, []string{"reason"})
+
+var clampedSamples = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "pluto_insert_clamped_samples_total",
+	Help: "Samples with timestamp moved into the allowed window on insert",
+}, []string{"reason"})
+
+// timestampBounds rejects or clamps samples with timestamps outside of the allowed window
+type timestampBounds struct {
+	min   int64
+	max   int64
+	clamp bool
+
+	tooOld         int
+	tooFarInFuture int
+}
+
+// newTimestampBounds returns nil if no window is configured
+func newTimestampBounds(cfg config.ConfigInsert, now time.Time) *timestampBounds {
+	if cfg.TooOld <= 0 && cfg.TooFarInFuture <= 0 {
+		return nil
+	}
+
+	b := &timestampBounds{
+		min:   minTimestamp,
+		max:   maxTimestamp,
+		clamp: cfg.OutOfBounds == "clamp",
+	}
+	if cfg.TooOld > 0 {
+		b.min = now.Add(-cfg.TooOld).UnixMilli()
+	}
+	if cfg.TooFarInFuture > 0 {
+		b.max = now.Add(cfg.TooFarInFuture).UnixMilli()
+	}
+	return b
+}
+
+// check returns timestamp to write and false if the sample should be skipped
+func (b *timestampBounds) check(ts int64) (int64, bool) {
+	if b == nil {
+		return ts, true
+	}
+	if ts < b.min {
+		b.tooOld++
+		return b.min, b.clamp
+	}
+	if ts > b.max {
+		b.tooFarInFuture++
+		return b.max, b.clamp
+	}
+	return ts, true
+}
+
+// report updates metrics and returns error for the client if some samples were dropped
+func (b *timestampBounds) report() error {
+	if b == nil || (b.tooOld == 0 && b.tooFarInFuture == 0) {
+		return nil
+	}
+
+	counter := discardedSamples
+	if b.clamp {
+		counter = clampedSamples
+	}
+	counter.WithLabelValues(reasonTooOld).Add(float64(b.tooOld))
+	counter.WithLabelValues(reasonTooFarInFuture).Add(float64(b.tooFarInFuture))
+
+	if b.clamp {
+		return nil
+	}
+
+	return fmt.Errorf("out of bounds: %d samples too old, %d samples too far in future", b.tooOld, b.tooFarInFuture)
+}
@@ -0,0 +1,67 @@
+package insert
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pluto-metrics/pluto/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTimestampBoundsDisabled(t *testing.T) {
+	assert := assert.New(t)
+
+	b := newTimestampBounds(config.ConfigInsert{}, time.Now())
+	assert.Nil(b)
+
+	ts, ok := b.check(0)
+	assert.True(ok)
+	assert.Equal(int64(0), ts)
+	assert.NoError(b.report())
+}
+
+func TestTimestampBoundsDrop(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.UnixMilli(100000)
+	b := newTimestampBounds(config.ConfigInsert{
+		TooOld:         10 * time.Second,
+		TooFarInFuture: time.Second,
+		OutOfBounds:    "drop",
+	}, now)
+
+	_, ok := b.check(89999)
+	assert.False(ok)
+	_, ok = b.check(101001)
+	assert.False(ok)
+
+	ts, ok := b.check(90000)
+	assert.True(ok)
+	assert.Equal(int64(90000), ts)
+
+	ts, ok = b.check(101000)
+	assert.True(ok)
+	assert.Equal(int64(101000), ts)
+
+	assert.EqualError(b.report(), "out of bounds: 1 samples too old, 1 samples too far in future")
+}
+
+func TestTimestampBoundsClamp(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.UnixMilli(100000)
+	b := newTimestampBounds(config.ConfigInsert{
+		TooOld:      10 * time.Second,
+		OutOfBounds: "clamp",
+	}, now)
+
+	ts, ok := b.check(0)
+	assert.True(ok)
+	assert.Equal(int64(90000), ts)
+
+	ts, ok = b.check(1 << 50)
+	assert.True(ok)
+	assert.Equal(int64(1<<50), ts)
+
+	assert.NoError(b.report())
+}
@@ -0,0 +1,126 @@
+package insert
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/pluto-metrics/pluto/pkg/config"
+	"github.com/pluto-metrics/pluto/pkg/lg"
+	"github.com/pluto-metrics/pluto/pkg/query"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var destinationRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "pluto_insert_destination_requests_total",
+	Help: "Insert requests to ClickHouse destinations",
+}, []string{"destination", "status"})
+
+var destinationDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "pluto_insert_destination_duration_seconds",
+	Help:    "Duration of insert requests to ClickHouse destinations",
+	Buckets: prometheus.DefBuckets,
+}, []string{"destination"})
+
+// send writes RowBinaryWithNamesAndTypes body to the destination table
+func (rcv *PrometheusRemoteWrite) send(ctx context.Context, dest config.InsertDestination, body []byte) error {
+	start := time.Now()
+	err := rcv.sendBody(ctx, dest, body)
+	destinationDuration.WithLabelValues(dest.Name).Observe(time.Since(start).Seconds())
+
+	if err != nil {
+		destinationRequests.WithLabelValues(dest.Name, "error").Inc()
+		return err
+	}
+	destinationRequests.WithLabelValues(dest.Name, "ok").Inc()
+	return nil
+}
+
+func (rcv *PrometheusRemoteWrite) sendBody(ctx context.Context, dest config.InsertDestination, body []byte) error {
+	chRequest, err := query.NewRequest(ctx, *dest.ClickHouse, query.Opts{
+		Discovery:  rcv.opts.Config.Extension.ClickHouseDiscovery,
+		HTTPClient: rcv.opts.Config.Extension.HTTPClient,
+	})
+	if err != nil {
+		return errors.Wrap(err, "can't create request to clickhouse")
+	}
+	defer chRequest.Close()
+
+	if _, err = fmt.Fprintf(chRequest, "INSERT INTO %s FORMAT RowBinaryWithNamesAndTypes\n", dest.Table); err != nil {
+		return errors.Wrap(err, "can't write query to clickhouse")
+	}
+
+	if _, err = chRequest.Write(body); err != nil {
+		return errors.Wrap(err, "can't write request to clickhouse")
+	}
+
+	chResponse, err := chRequest.Finish()
+	if err != nil {
+		return errors.Wrap(err, "can't finish request to clickhouse")
+	}
+
+	if err = chResponse.Close(); err != nil {
+		return errors.Wrap(err, "can't close response from clickhouse")
+	}
+
+	return nil
+}
+
+// replicate writes body to all destinations concurrently and waits for required number of acks.
+// Writes that are still running or failed after the decision are completed in background via queue
+func (rcv *PrometheusRemoteWrite) replicate(ctx context.Context, insertCfg config.ConfigInsert, body []byte) error {
+	destinations := insertCfg.Destinations()
+	if len(destinations) == 1 {
+		return rcv.send(ctx, destinations[0], body)
+	}
+
+	required := insertCfg.AckRequired(len(destinations))
+	background := required < len(destinations)
+
+	sendCtx := ctx
+	if background {
+		// not acknowledged replicas should not be cancelled with client request
+		sendCtx = context.WithoutCancel(ctx)
+	}
+
+	type result struct {
+		dest config.InsertDestination
+		err  error
+	}
+
+	results := make(chan result, len(destinations))
+	for _, dest := range destinations {
+		go func() {
+			err := rcv.send(sendCtx, dest, body)
+			if err != nil {
+				slog.ErrorContext(ctx, "can't write to destination", slog.String("destination", dest.Name), lg.Error(err))
+				if background {
+					if qErr := rcv.queue.push(dest, body); qErr != nil {
+						slog.ErrorContext(ctx, "can't queue write to destination", slog.String("destination", dest.Name), lg.Error(qErr))
+					}
+				}
+			}
+			results <- result{dest: dest, err: err}
+		}()
+	}
+
+	var acked, failed int
+	var lastErr error
+	for acked < required {
+		r := <-results
+		if r.err == nil {
+			acked++
+			continue
+		}
+		failed++
+		lastErr = r.err
+		if len(destinations)-failed < required {
+			return errors.Wrapf(lastErr, "%d of %d destinations failed", failed, len(destinations))
+		}
+	}
+
+	return nil
+}
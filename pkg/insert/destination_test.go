@@ -0,0 +1,151 @@
+package insert
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pluto-metrics/pluto/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeClickHouse struct {
+	sync.Mutex
+	srv     *httptest.Server
+	fail    atomic.Bool
+	queries []string
+}
+
+func newFakeClickHouse(t *testing.T) *fakeClickHouse {
+	ch := &fakeClickHouse{}
+	ch.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if ch.fail.Load() {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		ch.Lock()
+		ch.queries = append(ch.queries, string(body))
+		ch.Unlock()
+	}))
+	t.Cleanup(ch.srv.Close)
+	return ch
+}
+
+func (ch *fakeClickHouse) received() []string {
+	ch.Lock()
+	defer ch.Unlock()
+	return append([]string{}, ch.queries...)
+}
+
+func (ch *fakeClickHouse) destination(name string) config.InsertDestination {
+	return config.InsertDestination{Name: name, ClickHouse: &config.ClickHouse{DSN: strings.Replace(ch.srv.URL, "://", "://default:secret@", 1)}}
+}
+
+func newTestReceiver(t *testing.T, queueDir string, overrides ...config.ConfigInsert) *PrometheusRemoteWrite {
+	cfg := &config.Config{}
+	cfg.Insert.QueueDir = queueDir
+	cfg.OverrideInsert = slices.Grow(cfg.OverrideInsert, len(overrides))[:len(overrides)]
+	for i, o := range overrides {
+		cfg.OverrideInsert[i].ConfigInsert = o
+	}
+	rcv, err := NewPrometheusRemoteWrite(context.Background(), Opts{Config: cfg})
+	require.NoError(t, err)
+	return rcv
+}
+
+func TestReplicateAll(t *testing.T) {
+	assert := assert.New(t)
+
+	ch1, ch2 := newFakeClickHouse(t), newFakeClickHouse(t)
+	rcv := newTestReceiver(t, "")
+
+	insertCfg := config.ConfigInsert{
+		Table:      "samples_null",
+		ClickHouse: &config.ClickHouse{},
+		Replicas:   []config.InsertDestination{ch1.destination("a"), ch2.destination("b")},
+		Ack:        "all",
+	}
+
+	assert.NoError(rcv.replicate(context.Background(), insertCfg, []byte("body")))
+	assert.Equal([]string{"INSERT INTO samples_null FORMAT RowBinaryWithNamesAndTypes\nbody"}, ch1.received())
+	assert.Equal([]string{"INSERT INTO samples_null FORMAT RowBinaryWithNamesAndTypes\nbody"}, ch2.received())
+
+	ch2.fail.Store(true)
+	assert.Error(rcv.replicate(context.Background(), insertCfg, []byte("body")))
+}
+
+func TestReplicateQuorumWithQueue(t *testing.T) {
+	assert := assert.New(t)
+
+	ch1, ch2, ch3 := newFakeClickHouse(t), newFakeClickHouse(t), newFakeClickHouse(t)
+	queueDir := t.TempDir()
+
+	insertCfg := config.ConfigInsert{
+		Table:      "samples_null",
+		ClickHouse: &config.ClickHouse{},
+		Replicas:   []config.InsertDestination{ch1.destination("a"), ch2.destination("b"), ch3.destination("c")},
+		Ack:        "quorum",
+	}
+	// destinations of queued writes are resolved from config
+	rcv := newTestReceiver(t, queueDir, insertCfg)
+
+	ch3.fail.Store(true)
+	assert.NoError(rcv.replicate(context.Background(), insertCfg, []byte("body")))
+
+	// failed write is queued without credentials
+	var files []string
+	assert.Eventually(func() bool {
+		files, _ = filepath.Glob(filepath.Join(queueDir, "c", "*"+queueFileExt))
+		return len(files) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	raw, err := os.ReadFile(files[0])
+	require.NoError(t, err)
+	assert.NotContains(string(raw), "secret")
+
+	// and delivered after recovery
+	ch3.fail.Store(false)
+	rcv.queue.wakeup("c")
+	assert.Eventually(func() bool {
+		return len(ch3.received()) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.True(strings.HasSuffix(ch3.received()[0], "\nbody"))
+
+	// two of three failed
+	ch2.fail.Store(true)
+	ch3.fail.Store(true)
+	assert.Error(rcv.replicate(context.Background(), insertCfg, []byte("body")))
+}
+
+func TestQueueDropsMalformedFiles(t *testing.T) {
+	queueDir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(queueDir, "a"), 0750))
+	filename := filepath.Join(queueDir, "a", fmt.Sprintf("%020d%s", 1, queueFileExt))
+	require.NoError(t, os.WriteFile(filename, []byte("garbage"), 0600))
+
+	newTestReceiver(t, queueDir)
+
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(filename)
+		return os.IsNotExist(err)
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestAckRequired(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal(3, config.ConfigInsert{Ack: "all"}.AckRequired(3))
+	assert.Equal(2, config.ConfigInsert{Ack: "quorum"}.AckRequired(3))
+	assert.Equal(2, config.ConfigInsert{Ack: "quorum"}.AckRequired(2))
+	assert.Equal(1, config.ConfigInsert{Ack: "any"}.AckRequired(3))
+}
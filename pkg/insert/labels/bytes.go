@@ -1,6 +1,30 @@
 package labels
 
+import (
+	"github.com/prometheus/prometheus/model/labels"
+)
+
 type Bytes struct {
 	Name  []byte
 	Value []byte
 }
+
+// Value returns value of the label or nil if there is no such label
+func Value(lbs []Bytes, name string) []byte {
+	for i := 0; i < len(lbs); i++ {
+		if unsafeBytesToString(lbs[i].Name) == name {
+			return lbs[i].Value
+		}
+	}
+	return nil
+}
+
+// Match reports if the labels match all matchers. Missing label has empty value
+func Match(lbs []Bytes, matchers []*labels.Matcher) bool {
+	for _, m := range matchers {
+		if !m.Matches(unsafeBytesToString(Value(lbs, m.Name))) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,260 @@
+package insert
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/pluto-metrics/pluto/pkg/config"
+	"github.com/pluto-metrics/pluto/pkg/lg"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	queueFileExt       = ".bin"
+	queuePollInterval  = 10 * time.Second
+	queueMinBackoff    = time.Second
+	queueMaxBackoff    = time.Minute
+	queueDirPermission = 0750
+)
+
+var queueFiles = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "pluto_insert_queue_files",
+	Help: "Writes waiting in the local queue for retry",
+}, []string{"destination"})
+
+var unsafeNameChars = regexp.MustCompile(`[^a-zA-Z0-9_.-]`)
+
+type sendFunc func(ctx context.Context, dest config.InsertDestination, body []byte) error
+
+// queueHeader identifies destination of the queued write. ClickHouse DSN with credentials is not stored,
+// the destination is resolved from config on replay
+type queueHeader struct {
+	Name  string `json:"name"`
+	Table string `json:"table"`
+	Host  string `json:"host"`
+}
+
+func newQueueHeader(dest config.InsertDestination) queueHeader {
+	h := queueHeader{Name: dest.Name, Table: dest.Table}
+	if dest.ClickHouse != nil {
+		if u, err := url.Parse(dest.ClickHouse.DSN); err == nil {
+			h.Host = u.Host
+		}
+	}
+	return h
+}
+
+// queue keeps failed writes on disk and retries them in background.
+// Each file contains queueHeader as json line followed by RowBinary body
+type queue struct {
+	sync.Mutex
+	ctx     context.Context
+	dir     string
+	send    sendFunc
+	dests   map[queueHeader]config.InsertDestination
+	seq     atomic.Uint64
+	workers map[string]chan struct{} // dir name -> wakeup
+}
+
+func newQueue(ctx context.Context, dir string, dests []config.InsertDestination, send sendFunc) (*queue, error) {
+	q := &queue{
+		ctx:     ctx,
+		dir:     dir,
+		send:    send,
+		dests:   make(map[queueHeader]config.InsertDestination, len(dests)),
+		workers: make(map[string]chan struct{}),
+	}
+	for _, d := range dests {
+		q.dests[newQueueHeader(d)] = d
+	}
+	if dir == "" {
+		return q, nil
+	}
+
+	if err := os.MkdirAll(dir, queueDirPermission); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	// continue with writes left from previous run
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	for _, e := range entries {
+		if e.IsDir() {
+			q.wakeup(e.Name())
+		}
+	}
+
+	return q, nil
+}
+
+func (q *queue) wakeup(name string) {
+	q.Lock()
+	defer q.Unlock()
+
+	ch, exists := q.workers[name]
+	if !exists {
+		ch = make(chan struct{}, 1)
+		q.workers[name] = ch
+		go q.worker(name, ch)
+	}
+
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+func (q *queue) push(dest config.InsertDestination, body []byte) error {
+	if q.dir == "" {
+		return errors.New("queue is not configured")
+	}
+
+	name := unsafeNameChars.ReplaceAllString(dest.Name, "_")
+	if err := os.MkdirAll(filepath.Join(q.dir, name), queueDirPermission); err != nil {
+		return errors.WithStack(err)
+	}
+
+	header, err := json.Marshal(newQueueHeader(dest))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	filename := filepath.Join(q.dir, name, fmt.Sprintf("%020d-%06d%s", time.Now().UnixNano(), q.seq.Add(1)%1000000, queueFileExt))
+	tmp := filename + ".tmp"
+
+	// #nosec G304
+	f, err := os.Create(tmp)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	w := bufio.NewWriter(f)
+	w.Write(header)
+	w.WriteByte('\n')
+	w.Write(body)
+	if err = w.Flush(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return errors.WithStack(err)
+	}
+	if err = f.Close(); err != nil {
+		os.Remove(tmp)
+		return errors.WithStack(err)
+	}
+	if err = os.Rename(tmp, filename); err != nil {
+		return errors.WithStack(err)
+	}
+
+	q.wakeup(name)
+	return nil
+}
+
+// readQueueFile returns the body and its destination from config
+func (q *queue) readQueueFile(filename string) (config.InsertDestination, []byte, error) {
+	var header queueHeader
+
+	// #nosec G304
+	raw, err := os.ReadFile(filename)
+	if err != nil {
+		return config.InsertDestination{}, nil, errors.WithStack(err)
+	}
+	headerRaw, body, found := bytes.Cut(raw, []byte{'\n'})
+	if !found {
+		return config.InsertDestination{}, nil, errors.Errorf("malformed queue file %s", filename)
+	}
+	if err := json.Unmarshal(headerRaw, &header); err != nil {
+		return config.InsertDestination{}, nil, errors.Wrapf(err, "malformed queue file %s", filename)
+	}
+	dest, ok := q.dests[header]
+	if !ok {
+		return dest, nil, errors.Errorf("destination %s of queue file %s is not found in config", header.Name, filename)
+	}
+	return dest, body, nil
+}
+
+func (q *queue) files(name string) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(q.dir, name))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	ret := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if !e.IsDir() && filepath.Ext(e.Name()) == queueFileExt {
+			ret = append(ret, filepath.Join(q.dir, name, e.Name()))
+		}
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
+
+func (q *queue) sleep(d time.Duration, wakeup chan struct{}) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-q.ctx.Done():
+		return false
+	case <-wakeup:
+		return true
+	case <-t.C:
+		return true
+	}
+}
+
+// worker sends queued writes of one destination in order
+func (q *queue) worker(name string, wakeup chan struct{}) {
+	backoff := queueMinBackoff
+
+	for {
+		files, err := q.files(name)
+		if err != nil {
+			slog.Error("can't read queue", slog.String("destination", name), lg.Error(err))
+		}
+		queueFiles.WithLabelValues(name).Set(float64(len(files)))
+
+		if len(files) == 0 {
+			if !q.sleep(queuePollInterval, wakeup) {
+				return
+			}
+			continue
+		}
+
+		dest, body, err := q.readQueueFile(files[0])
+		if err == nil {
+			err = q.send(q.ctx, dest, body)
+			if err == nil {
+				backoff = queueMinBackoff
+				os.Remove(files[0])
+				continue
+			}
+			slog.Warn("can't send queued write", slog.String("destination", name), lg.Error(err))
+		} else {
+			// can't be fixed by retry
+			slog.Error("drop queued write", slog.String("file", files[0]), lg.Error(err))
+			os.Remove(files[0])
+			continue
+		}
+
+		// sleep ignoring wakeups: the destination is still unavailable
+		select {
+		case <-q.ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, queueMaxBackoff)
+	}
+}
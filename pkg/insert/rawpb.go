@@ -1,7 +1,9 @@
 package insert
 
 import (
+	"bytes"
 	"io"
+	"slices"
 	"sync"
 	"unsafe"
 
@@ -10,6 +12,7 @@ import (
 	"github.com/pluto-metrics/rawpb"
 	"github.com/pluto-metrics/rowbinary"
 	"github.com/pluto-metrics/rowbinary/schema"
+	"github.com/prometheus/prometheus/prompb"
 )
 
 var pbTimeseriesPool = sync.Pool{
@@ -65,17 +68,70 @@ func (p *pbTimeseries) sampleTimestamp(v int64) error {
 	return nil
 }
 
-func payloadToRowBinary(raw []byte, w io.Writer, h id.Provider) error {
-	ws := schema.NewWriter(w).
-		Format(schema.RowBinaryWithNamesAndTypes).
-		Column("id", rowbinary.String).
-		Column("name", rowbinary.String).
-		Column("labels", labels.ColumnBytes).
-		Column("timestamp", rowbinary.Int64).
-		Column("value", rowbinary.Float64)
+type payloadOpts struct {
+	bounds *timestampBounds
+	// added to every series if not empty, replaces the label with the same name sent by client
+	extraLabel labels.Bytes
+	// selects one of writers for the series, nil writes everything to the first one
+	sharder *sharder
+	// accepted samples matched by aggregation rules, pushed to aggregator after writing
+	aggregation *aggregationBatch
+	// drops duplicates and too frequent samples
+	thinning *thinningBatch
+	// the oldest written sample for the ingestion watermark
+	written *writtenTimestamps
+	// written series are collected for forwarders if not nil
+	forward *[]prompb.TimeSeries
+}
 
-	if err := ws.WriteHeader(); err != nil {
-		return err
+// forwardSeries copies labels and written samples, the request buffer is reused after writing
+func forwardSeries(lbs []labels.Bytes, samples []pbSample) prompb.TimeSeries {
+	ret := prompb.TimeSeries{
+		Labels:  make([]prompb.Label, len(lbs)),
+		Samples: make([]prompb.Sample, len(samples)),
+	}
+	for i, l := range lbs {
+		ret.Labels[i] = prompb.Label{Name: string(l.Name), Value: string(l.Value)}
+	}
+	for i, s := range samples {
+		ret.Samples[i] = prompb.Sample{Timestamp: s.Timestamp, Value: s.Value}
+	}
+	return ret
+}
+
+func (p *pbTimeseries) setLabel(l labels.Bytes) {
+	if len(l.Name) == 0 {
+		return
+	}
+	n := 0
+	for i := 0; i < len(p.Labels); i++ {
+		if bytes.Equal(p.Labels[i].Name, l.Name) {
+			continue
+		}
+		p.Labels[n] = p.Labels[i]
+		n++
+	}
+	p.Labels = append(p.Labels[:n], l)
+	// aggregation rules and id providers expect sorted labels
+	slices.SortFunc(p.Labels, func(a, b labels.Bytes) int {
+		return bytes.Compare(a.Name, b.Name)
+	})
+}
+
+func payloadToRowBinary(raw []byte, w []io.Writer, h id.Provider, opts payloadOpts) error {
+	writers := make([]*schema.Writer, len(w))
+	for i := 0; i < len(w); i++ {
+		writers[i] = schema.NewWriter(w[i]).
+			Format(schema.RowBinaryWithNamesAndTypes).
+			Column("id", rowbinary.String).
+			Column("name", rowbinary.String).
+			Column("labels", labels.ColumnBytes).
+			Column("timestamp", rowbinary.Int64).
+			Column("value", rowbinary.Float64)
+
+		if err := writers[i].WriteHeader(); err != nil {
+			return err
+		}
 	}
 
 	ts := pbTimeseriesPool.Get().(*pbTimeseries)
@@ -98,18 +154,54 @@ func payloadToRowBinary(raw []byte, w io.Writer, h id.Provider) error {
 				if len(ts.Labels) == 0 || len(ts.Samples) == 0 {
 					return nil
 				}
+				ts.setLabel(opts.extraLabel)
 				h.Update(ts.Labels)
 
+				// samples within bounds only, timestamps may be clamped
+				accepted := ts.Samples[:0]
+				for j := 0; j < len(ts.Samples); j++ {
+					timestamp, ok := opts.bounds.check(ts.Samples[j].Timestamp)
+					if !ok {
+						continue
+					}
+					accepted = append(accepted, pbSample{Timestamp: timestamp, Value: ts.Samples[j].Value})
+				}
+				ts.Samples = accepted
+				if len(ts.Samples) == 0 {
+					return nil
+				}
+
+				if opts.aggregation.add(ts.Labels, ts.Samples) {
+					return nil
+				}
+				shard := opts.sharder.shard(ts.Labels, h.ID())
+				ws := writers[shard]
+
+				opts.thinning.begin(h.ID(), ts.Labels)
+
+				written := ts.Samples[:0]
 				for j := 0; j < len(ts.Samples); j++ {
+					timestamp := ts.Samples[j].Timestamp
+					if !opts.thinning.allow(timestamp, ts.Samples[j].Value) {
+						continue
+					}
+					written = append(written, ts.Samples[j])
 					if err := ws.WriteValues(
 						unsafeBytesToString(h.ID()),
 						unsafeBytesToString(h.Name()),
 						ts.Labels,
-						ts.Samples[j].Timestamp,
+						timestamp,
 						ts.Samples[j].Value,
 					); err != nil {
 						return err
 					}
+					opts.sharder.written(shard)
+					opts.written.add(timestamp)
+				}
+				opts.thinning.end()
+
+				if opts.forward != nil && len(written) > 0 {
+					*opts.forward = append(*opts.forward, forwardSeries(ts.Labels, written))
 				}
 
 				return nil
@@ -4,11 +4,19 @@ import (
 	"bufio"
 	"bytes"
 	"compress/gzip"
+	"context"
 	"io"
 	"os"
 	"testing"
+	"time"
 
+	"github.com/pluto-metrics/pluto/pkg/aggregate"
+	"github.com/pluto-metrics/pluto/pkg/config"
 	"github.com/pluto-metrics/pluto/pkg/insert/id"
+	"github.com/pluto-metrics/pluto/pkg/insert/labels"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
 	_ "github.com/k0kubun/pp" // just for keep dep
 )
@@ -36,7 +44,7 @@ func BenchmarkPayloadToRowBinaryWithSHA256(b *testing.B) {
 	b.ReportAllocs()
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		if err := payloadToRowBinary(raw, w, h); err != nil {
+		if err := payloadToRowBinary(raw, []io.Writer{w}, h, payloadOpts{}); err != nil {
 			panic(err)
 		}
 	}
@@ -49,8 +57,100 @@ func BenchmarkPayloadToRowBinaryWithNoop(b *testing.B) {
 	b.ReportAllocs()
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		if err := payloadToRowBinary(raw, w, h); err != nil {
+		if err := payloadToRowBinary(raw, []io.Writer{w}, h, payloadOpts{}); err != nil {
 			panic(err)
 		}
 	}
 }
+
+func TestSetLabel(t *testing.T) {
+	ts := &pbTimeseries{
+		Labels: []labels.Bytes{
+			{Name: []byte("__name__"), Value: []byte("up")},
+			{Name: []byte("tenant"), Value: []byte("spoofed")},
+			{Name: []byte("job"), Value: []byte("node")},
+		},
+	}
+
+	ts.setLabel(labels.Bytes{Name: []byte("tenant"), Value: []byte("team1")})
+
+	assert.Equal(t, []labels.Bytes{
+		{Name: []byte("__name__"), Value: []byte("up")},
+		{Name: []byte("job"), Value: []byte("node")},
+		{Name: []byte("tenant"), Value: []byte("team1")},
+	}, ts.Labels)
+
+	// empty label is ignored
+	ts.setLabel(labels.Bytes{})
+	assert.Len(t, ts.Labels, 3)
+
+	// labels stay sorted
+	ts.setLabel(labels.Bytes{Name: []byte("env"), Value: []byte("prod")})
+	assert.Equal(t, []byte("env"), ts.Labels[1].Name)
+}
+
+func TestPayloadAggregationAcceptedOnly(t *testing.T) {
+	assert := assert.New(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	aggregator, err := aggregate.New(ctx, []config.AggregationRule{
+		{Match: `{__name__="a"}`, Interval: time.Hour, Outputs: []string{"sum"}, DropInput: true},
+	}, func(ctx context.Context, tenant string, raw []byte) error { return nil })
+	require.NoError(t, err)
+
+	raw, err := (&prompb.WriteRequest{Timeseries: []prompb.TimeSeries{
+		{
+			Labels:  []prompb.Label{{Name: "__name__", Value: "a"}},
+			Samples: []prompb.Sample{{Timestamp: 1000, Value: 1}, {Timestamp: 95000, Value: 2}},
+		},
+		{
+			Labels:  []prompb.Label{{Name: "__name__", Value: "b"}},
+			Samples: []prompb.Sample{{Timestamp: 95000, Value: 3}},
+		},
+	}}).Marshal()
+	require.NoError(t, err)
+
+	batch := newAggregationBatch(aggregator, "t1")
+	w := bufio.NewWriter(io.Discard)
+	require.NoError(t, payloadToRowBinary(raw, []io.Writer{w}, id.NewNoop(), payloadOpts{
+		bounds:      newTimestampBounds(config.ConfigInsert{TooOld: 10 * time.Second, OutOfBounds: "drop"}, time.UnixMilli(100000)),
+		aggregation: batch,
+	}))
+
+	// too old sample is not aggregated
+	require.Len(t, batch.series, 1)
+	assert.Equal([]pbSample{{Timestamp: 95000, Value: 2}}, batch.series[0].samples)
+	assert.Equal("a", string(batch.series[0].labels[0].Value))
+
+	batch.commit()
+	assert.Nil(batch.series)
+}
+
+func TestPayloadForward(t *testing.T) {
+	raw, err := (&prompb.WriteRequest{Timeseries: []prompb.TimeSeries{
+		{
+			Labels:  []prompb.Label{{Name: "__name__", Value: "a"}, {Name: "tenant", Value: "spoofed"}},
+			Samples: []prompb.Sample{{Timestamp: 1000, Value: 1}, {Timestamp: 95000, Value: 2}},
+		},
+		{
+			Labels:  []prompb.Label{{Name: "__name__", Value: "b"}},
+			Samples: []prompb.Sample{{Timestamp: 1000, Value: 3}},
+		},
+	}}).Marshal()
+	require.NoError(t, err)
+
+	var forwarded []prompb.TimeSeries
+	require.NoError(t, payloadToRowBinary(raw, []io.Writer{bufio.NewWriter(io.Discard)}, id.NewNoop(), payloadOpts{
+		bounds:     newTimestampBounds(config.ConfigInsert{TooOld: 10 * time.Second, OutOfBounds: "drop"}, time.UnixMilli(100000)),
+		extraLabel: labels.Bytes{Name: []byte("tenant"), Value: []byte("t1")},
+		forward:    &forwarded,
+	}))
+
+	// rejected samples are not forwarded, tenant label is injected
+	assert.Equal(t, []prompb.TimeSeries{{
+		Labels:  []prompb.Label{{Name: "__name__", Value: "a"}, {Name: "tenant", Value: "t1"}},
+		Samples: []prompb.Sample{{Timestamp: 95000, Value: 2}},
+	}}, forwarded)
+}
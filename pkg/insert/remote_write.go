@@ -1,16 +1,25 @@
 package insert
 
 import (
-	"fmt"
+	"bytes"
+	"context"
 	"io"
 	"log/slog"
 	"net/http"
+	"time"
 
 	"github.com/golang/snappy"
+	"github.com/pkg/errors"
+	"github.com/pluto-metrics/pluto/pkg/aggregate"
 	"github.com/pluto-metrics/pluto/pkg/config"
+	"github.com/pluto-metrics/pluto/pkg/errs"
+	"github.com/pluto-metrics/pluto/pkg/forward"
 	"github.com/pluto-metrics/pluto/pkg/insert/id"
+	"github.com/pluto-metrics/pluto/pkg/insert/labels"
 	"github.com/pluto-metrics/pluto/pkg/lg"
-	"github.com/pluto-metrics/pluto/pkg/query"
+	"github.com/pluto-metrics/pluto/pkg/tenant"
+	"github.com/pluto-metrics/pluto/pkg/watermark"
+	"github.com/prometheus/prometheus/prompb"
 )
 
 type Opts struct {
@@ -18,11 +27,43 @@ type Opts struct {
 }
 
 type PrometheusRemoteWrite struct {
-	opts Opts
+	opts       Opts
+	queue      *queue
+	forwarders []*forward.Forwarder
+	aggregator *aggregate.Aggregator
+	thinner    *thinner
 }
 
-func NewPrometheusRemoteWrite(opts Opts) *PrometheusRemoteWrite {
-	return &PrometheusRemoteWrite{opts: opts}
+func NewPrometheusRemoteWrite(ctx context.Context, opts Opts) (*PrometheusRemoteWrite, error) {
+	rcv := &PrometheusRemoteWrite{opts: opts}
+
+	var err error
+	rcv.queue, err = newQueue(ctx, opts.Config.Insert.QueueDir, opts.Config.InsertDestinations(), rcv.send)
+	if err != nil {
+		return nil, err
+	}
+
+	tenantHeader := ""
+	if opts.Config.Tenant.Enabled {
+		tenantHeader = opts.Config.Tenant.Header
+	}
+	for _, f := range opts.Config.Insert.Forward {
+		rcv.forwarders = append(rcv.forwarders, forward.New(ctx, f, tenantHeader, opts.Config.Extension.HTTPClient))
+	}
+
+	rcv.thinner, err = newThinner(opts.Config)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(opts.Config.Insert.Aggregation) > 0 {
+		rcv.aggregator, err = aggregate.New(ctx, opts.Config.Insert.Aggregation, rcv.writeAggregated)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return rcv, nil
 }
 
 func (rcv *PrometheusRemoteWrite) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -44,66 +85,118 @@ func (rcv *PrometheusRemoteWrite) ServeHTTP(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	insertCfg, err := rcv.opts.Config.GetInsert(
-		config.NewEnvInsert().WithRequest(r),
-	)
-	if err != nil {
-		slog.ErrorContext(r.Context(), "can't get insert config", lg.Error(err))
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	envInsert := config.NewEnvInsert().WithRequest(r)
+	envInsert.Tenant = tenant.FromContext(r.Context())
+
+	if err := rcv.write(r.Context(), envInsert, reqRaw, rcv.aggregator); err != nil {
+		code := http.StatusInternalServerError
+		var errWithCode errs.ErrorWithCode
+		if errors.As(err, &errWithCode) {
+			code = errWithCode.Code
+		}
+		http.Error(w, err.Error(), code)
 		return
 	}
 
-	qq := fmt.Sprintf("INSERT INTO %s FORMAT RowBinaryWithNamesAndTypes\n", insertCfg.Table)
+	if rcv.opts.Config.Insert.CloseConnections {
+		hj, ok := w.(http.Hijacker)
+		if !ok {
+			return
+		}
+		conn, _, err := hj.Hijack()
+		if err != nil {
+			return
+		}
 
-	chRequest, err := query.NewRequest(r.Context(), *insertCfg.ClickHouse, query.Opts{
-		Discovery:  rcv.opts.Config.Extension.ClickHouseDiscovery,
-		HTTPClient: rcv.opts.Config.Extension.HTTPClient,
-	})
+		conn.Close()
+	}
+}
+
+// write converts remote write request to RowBinary and writes it to ClickHouse.
+// Series are passed to the aggregator if it is not nil. Returned errors have http status code
+func (rcv *PrometheusRemoteWrite) write(ctx context.Context, envInsert *config.EnvInsert, reqRaw []byte, aggregator *aggregate.Aggregator) error {
+	insertCfg, err := rcv.opts.Config.GetInsert(envInsert)
 	if err != nil {
-		slog.ErrorContext(r.Context(), "can't create request to clickhouse", lg.Error(err))
-		http.Error(w, err.Error(), http.StatusBadGateway)
-		return
+		slog.ErrorContext(ctx, "can't get insert config", lg.Error(err))
+		return errs.NewErrorWithCode(err.Error(), http.StatusInternalServerError)
 	}
 
-	defer chRequest.Close()
+	payload := payloadOpts{
+		bounds:      newTimestampBounds(insertCfg, time.Now()),
+		aggregation: newAggregationBatch(aggregator, envInsert.Tenant),
+		thinning:    rcv.thinner.batch(envInsert.Tenant),
+		written:     &writtenTimestamps{},
+	}
+	var forwarded []prompb.TimeSeries
+	if len(rcv.forwarders) > 0 {
+		payload.forward = &forwarded
+	}
+	if rcv.opts.Config.Tenant.Enabled && rcv.opts.Config.Tenant.Label != "" {
+		payload.extraLabel = labels.Bytes{
+			Name:  []byte(rcv.opts.Config.Tenant.Label),
+			Value: []byte(envInsert.Tenant),
+		}
+	}
 
-	_, err = fmt.Fprint(chRequest, qq)
-	if err != nil {
-		slog.ErrorContext(r.Context(), "can't write query to clickhouse", lg.Error(err))
-		http.Error(w, err.Error(), http.StatusBadGateway)
-		return
+	// encode once, the same body is sent to every replica. With shards there is a body per shard
+	shards := insertCfg.ShardDestinations()
+	bodies := make([]bytes.Buffer, max(len(shards), 1))
+	writers := make([]io.Writer, len(bodies))
+	for i := range bodies {
+		writers[i] = &bodies[i]
+	}
+	if len(shards) > 0 {
+		payload.sharder = newSharder(insertCfg, shards)
 	}
 
-	if err := payloadToRowBinary(reqRaw, chRequest, id.NewNameWithSha256()); err != nil {
-		slog.ErrorContext(r.Context(), "can't write request to clickhouse", lg.Error(err))
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	if err := payloadToRowBinary(reqRaw, writers, id.NewNameWithSha256(), payload); err != nil {
+		slog.ErrorContext(ctx, "can't convert request to RowBinary", lg.Error(err))
+		return errs.NewErrorWithCode(err.Error(), http.StatusBadRequest)
 	}
 
-	chResponse, err := chRequest.Finish()
+	// samples of the request are not returned by select of the tenant until they are written
+	defer beginWatermark(watermark.Default, envInsert.Tenant, payload.written, time.Now(), rcv.opts.Config.Insert.Watermark.MaxLag)()
+
+	if len(shards) > 0 {
+		bodyBytes := make([][]byte, len(bodies))
+		for i := range bodies {
+			bodyBytes[i] = bodies[i].Bytes()
+		}
+		err = rcv.writeShards(ctx, shards, bodyBytes, payload.sharder)
+	} else {
+		err = rcv.replicate(ctx, insertCfg, bodies[0].Bytes())
+	}
 	if err != nil {
-		slog.ErrorContext(r.Context(), "can't finish request to clickhouse", lg.Error(err))
-		http.Error(w, err.Error(), http.StatusBadGateway)
-		return
+		slog.ErrorContext(ctx, "can't write request to clickhouse", lg.Error(err))
+		return errs.NewErrorWithCode(err.Error(), http.StatusBadGateway)
 	}
 
-	err = chResponse.Close()
-	if err != nil {
-		slog.ErrorContext(r.Context(), "can't close response from clickhouse", lg.Error(err))
-		http.Error(w, err.Error(), http.StatusBadGateway)
-		return
+	payload.thinning.commit()
+	payload.aggregation.commit()
+	rcv.forward(envInsert.Tenant, forwarded)
+
+	// accepted samples are already written, report the rest to the client as a non-retryable error
+	if err := payload.bounds.report(); err != nil {
+		slog.WarnContext(ctx, "samples rejected", lg.Error(err))
+		return errs.NewErrorWithCode(err.Error(), http.StatusBadRequest)
 	}
 
-	if rcv.opts.Config.Insert.CloseConnections {
-		hj, ok := w.(http.Hijacker)
-		if !ok {
-			return
-		}
-		conn, _, err := hj.Hijack()
-		if err != nil {
-			return
-		}
+	return nil
+}
 
-		conn.Close()
+// writeAggregated writes results of aggregation rules. They are not aggregated again
+func (rcv *PrometheusRemoteWrite) writeAggregated(ctx context.Context, tenant string, reqRaw []byte) error {
+	envInsert := config.NewEnvInsert()
+	envInsert.Tenant = tenant
+	return rcv.write(ctx, envInsert, reqRaw, nil)
+}
+
+// forward sends written series to forwarders in background
+func (rcv *PrometheusRemoteWrite) forward(tenant string, series []prompb.TimeSeries) {
+	if len(series) == 0 {
+		return
+	}
+	for _, f := range rcv.forwarders {
+		f.Push(tenant, series)
 	}
 }
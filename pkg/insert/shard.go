@@ -0,0 +1,148 @@
+package insert
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+
+	"github.com/OneOfOne/xxhash"
+	"github.com/pkg/errors"
+	"github.com/pluto-metrics/pluto/pkg/config"
+	"github.com/pluto-metrics/pluto/pkg/insert/labels"
+	"github.com/pluto-metrics/pluto/pkg/lg"
+	"golang.org/x/sync/errgroup"
+)
+
+var (
+	shardKeyEq  = []byte{'='}
+	shardKeySep = []byte{0xff}
+)
+
+// sharder selects shard of the series.
+// Jump hash keeps series on their shards when shards are appended to the end of the list,
+// rendezvous hash is bound to shard names and allows to remove or reorder shards
+type sharder struct {
+	count      int
+	rendezvous bool
+	seeds      []uint64
+	by         [][]byte
+	h          *xxhash.XXHash64
+	// rows written to each shard
+	rows []int
+}
+
+func newSharder(insertCfg config.ConfigInsert, shards []config.InsertDestination) *sharder {
+	s := &sharder{
+		count:      len(shards),
+		rendezvous: insertCfg.ShardAlgo == "rendezvous",
+		h:          xxhash.New64(),
+		rows:       make([]int, len(shards)),
+	}
+	if s.rendezvous {
+		s.seeds = make([]uint64, len(shards))
+		for i, d := range shards {
+			s.seeds[i] = xxhash.ChecksumString64(d.Name)
+		}
+	}
+	for _, name := range insertCfg.ShardBy {
+		s.by = append(s.by, []byte(name))
+	}
+	return s
+}
+
+func (s *sharder) key(lb []labels.Bytes, id []byte) uint64 {
+	if len(s.by) == 0 {
+		return xxhash.Checksum64(id)
+	}
+
+	s.h.Reset()
+	for _, name := range s.by {
+		s.h.Write(name)
+		s.h.Write(shardKeyEq)
+		for i := 0; i < len(lb); i++ {
+			if bytes.Equal(lb[i].Name, name) {
+				s.h.Write(lb[i].Value)
+				break
+			}
+		}
+		s.h.Write(shardKeySep)
+	}
+	return s.h.Sum64()
+}
+
+// shard returns index of the series shard. Nil sharder always returns 0
+func (s *sharder) shard(lb []labels.Bytes, id []byte) int {
+	if s == nil || s.count <= 1 {
+		return 0
+	}
+
+	key := s.key(lb, id)
+	if s.rendezvous {
+		return rendezvousHash(key, s.seeds)
+	}
+	return jumpHash(key, s.count)
+}
+
+func (s *sharder) written(shard int) {
+	if s != nil {
+		s.rows[shard]++
+	}
+}
+
+// jumpHash is "A Fast, Minimal Memory, Consistent Hash Algorithm" by Lamping and Veach
+func jumpHash(key uint64, buckets int) int {
+	var b, j int64 = -1, 0
+	for j < int64(buckets) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int(b)
+}
+
+// mix64 is the finalizer of splitmix64
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+func rendezvousHash(key uint64, seeds []uint64) int {
+	var best int
+	var bestScore uint64
+	for i, seed := range seeds {
+		score := mix64(key ^ seed)
+		if i == 0 || score > bestScore {
+			best, bestScore = i, score
+		}
+	}
+	return best
+}
+
+// writeShards sends bodies to the shards in parallel. Shards without rows are skipped.
+// Failed writes are queued if queue_dir is set, so the client doesn't retry rows already written to other shards
+func (rcv *PrometheusRemoteWrite) writeShards(ctx context.Context, shards []config.InsertDestination, bodies [][]byte, s *sharder) error {
+	g, gCtx := errgroup.WithContext(ctx)
+	for i, dest := range shards {
+		if s.rows[i] == 0 {
+			continue
+		}
+		g.Go(func() error {
+			err := rcv.send(gCtx, dest, bodies[i])
+			if err == nil {
+				return nil
+			}
+			if rcv.opts.Config.Insert.QueueDir != "" {
+				slog.ErrorContext(ctx, "can't write to shard, queued", slog.String("destination", dest.Name), lg.Error(err))
+				if err = rcv.queue.push(dest, bodies[i]); err == nil {
+					return nil
+				}
+			}
+			return errors.Wrapf(err, "shard %s", dest.Name)
+		})
+	}
+	return g.Wait()
+}
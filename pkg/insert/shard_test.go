@@ -0,0 +1,135 @@
+package insert
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pluto-metrics/pluto/pkg/config"
+	"github.com/pluto-metrics/pluto/pkg/insert/id"
+	"github.com/pluto-metrics/pluto/pkg/insert/labels"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testShards(names ...string) []config.InsertDestination {
+	ret := make([]config.InsertDestination, len(names))
+	for i, n := range names {
+		ret[i] = config.InsertDestination{Name: n}
+	}
+	return ret
+}
+
+func TestShardRebalance(t *testing.T) {
+	for _, algo := range []string{"jump", "rendezvous"} {
+		t.Run(algo, func(t *testing.T) {
+			assert := assert.New(t)
+
+			cfg := config.ConfigInsert{ShardAlgo: algo}
+			s3 := newSharder(cfg, testShards("a", "b", "c"))
+			s4 := newSharder(cfg, testShards("a", "b", "c", "d"))
+
+			moved := 0
+			counts := make([]int, 4)
+			for i := 0; i < 10000; i++ {
+				id := []byte(fmt.Sprintf("series%d", i))
+				before, after := s3.shard(nil, id), s4.shard(nil, id)
+				counts[after]++
+				if before != after {
+					// only to the new shard
+					assert.Equal(3, after)
+					moved++
+				}
+			}
+
+			assert.InDelta(2500, moved, 250)
+			for _, c := range counts {
+				assert.InDelta(2500, c, 250)
+			}
+		})
+	}
+}
+
+func TestShardBy(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newSharder(config.ConfigInsert{ShardBy: []string{"job"}}, testShards("a", "b", "c", "d"))
+
+	lb := func(job, instance string) []labels.Bytes {
+		return []labels.Bytes{
+			{Name: []byte("instance"), Value: []byte(instance)},
+			{Name: []byte("job"), Value: []byte(job)},
+		}
+	}
+
+	// series of the same job are on the same shard
+	for i := 0; i < 10; i++ {
+		assert.Equal(s.shard(lb("node", "host1"), []byte("id1")), s.shard(lb("node", fmt.Sprintf("host%d", i)), []byte(fmt.Sprintf("id%d", i))))
+	}
+}
+
+func TestPayloadToRowBinarySharded(t *testing.T) {
+	assert := assert.New(t)
+
+	req := &prompb.WriteRequest{}
+	for i := 0; i < 100; i++ {
+		req.Timeseries = append(req.Timeseries, prompb.TimeSeries{
+			Labels:  []prompb.Label{{Name: "__name__", Value: "up"}, {Name: "instance", Value: fmt.Sprintf("host%d", i)}},
+			Samples: []prompb.Sample{{Value: 1, Timestamp: 1000}, {Value: 1, Timestamp: 2000}},
+		})
+	}
+	raw, err := req.Marshal()
+	require.NoError(t, err)
+
+	bodies := make([]bytes.Buffer, 2)
+	s := newSharder(config.ConfigInsert{}, testShards("a", "b"))
+	require.NoError(t, payloadToRowBinary(raw, []io.Writer{&bodies[0], &bodies[1]}, id.NewNameWithSha256(), payloadOpts{sharder: s}))
+
+	assert.Equal(200, s.rows[0]+s.rows[1])
+	assert.NotZero(s.rows[0])
+	assert.NotZero(s.rows[1])
+	assert.Greater(bodies[0].Len(), 0)
+	assert.Greater(bodies[1].Len(), 0)
+}
+
+func TestWriteShardsQueuesFailedShard(t *testing.T) {
+	assert := assert.New(t)
+
+	ch1, ch2 := newFakeClickHouse(t), newFakeClickHouse(t)
+	insertCfg := config.ConfigInsert{
+		Table:      "samples_null",
+		ClickHouse: &config.ClickHouse{},
+		Shards:     []config.InsertDestination{ch1.destination("a"), ch2.destination("b")},
+	}
+	shards := insertCfg.ShardDestinations()
+	s := newSharder(insertCfg, shards)
+	s.rows = []int{1, 1}
+	bodies := [][]byte{[]byte("body1"), []byte("body2")}
+
+	// with queue the failed shard is written later and the request succeeds
+	queueDir := t.TempDir()
+	rcv := newTestReceiver(t, queueDir, insertCfg)
+	ch2.fail.Store(true)
+	assert.NoError(rcv.writeShards(context.Background(), shards, bodies, s))
+	assert.Len(ch1.received(), 1)
+	files, err := filepath.Glob(filepath.Join(queueDir, "b", "*"+queueFileExt))
+	require.NoError(t, err)
+	assert.Len(files, 1)
+
+	ch2.fail.Store(false)
+	rcv.queue.wakeup("b")
+	assert.Eventually(func() bool {
+		return len(ch2.received()) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.True(strings.HasSuffix(ch2.received()[0], "\nbody2"))
+
+	// without queue the request fails
+	ch2.fail.Store(true)
+	assert.Error(newTestReceiver(t, "", insertCfg).writeShards(context.Background(), shards, bodies, s))
+}
@@ -0,0 +1,177 @@
+package insert
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/pluto-metrics/pluto/pkg/config"
+	"github.com/pluto-metrics/pluto/pkg/insert/labels"
+	promlabels "github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/value"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+const (
+	reasonDuplicate   = "duplicate"
+	reasonTooFrequent = "too_frequent"
+)
+
+type thinningRule struct {
+	matchers   []*promlabels.Matcher
+	resolution int64
+}
+
+// thinner keeps last written timestamp of every series.
+// Series are stored in two generations, the older one is dropped every ttl
+type thinner struct {
+	resolution int64
+	rules      []thinningRule
+	ttl        time.Duration
+
+	sync.RWMutex
+	current  map[string]int64
+	previous map[string]int64
+	rotated  time.Time
+}
+
+// newThinner returns nil if thinning is disabled
+func newThinner(cfg *config.Config) (*thinner, error) {
+	if !cfg.Insert.Thinning.Enabled {
+		return nil, nil
+	}
+
+	t := &thinner{
+		resolution: cfg.Insert.Thinning.Resolution.Milliseconds(),
+		ttl:        cfg.Insert.Thinning.TTL,
+		current:    make(map[string]int64),
+		previous:   make(map[string]int64),
+		rotated:    time.Now(),
+	}
+	for _, r := range cfg.Insert.Thinning.Rules {
+		matchers, err := parser.ParseMetricSelector(r.Match)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid thinning rule match %q", r.Match)
+		}
+		t.rules = append(t.rules, thinningRule{matchers: matchers, resolution: r.Resolution.Milliseconds()})
+	}
+	return t, nil
+}
+
+func (t *thinner) seriesResolution(lbs []labels.Bytes) int64 {
+	for _, r := range t.rules {
+		if labels.Match(lbs, r.matchers) {
+			return r.resolution
+		}
+	}
+	return t.resolution
+}
+
+func (t *thinner) last(key string) (int64, bool) {
+	t.RLock()
+	defer t.RUnlock()
+
+	if ts, ok := t.current[key]; ok {
+		return ts, true
+	}
+	ts, ok := t.previous[key]
+	return ts, ok
+}
+
+func (t *thinner) update(pending map[string]int64) {
+	t.Lock()
+	defer t.Unlock()
+
+	if t.ttl > 0 && time.Since(t.rotated) > t.ttl {
+		t.previous = t.current
+		t.current = make(map[string]int64, len(t.previous))
+		t.rotated = time.Now()
+	}
+	for k, ts := range pending {
+		if old, ok := t.current[k]; !ok || ts > old {
+			t.current[k] = ts
+		}
+	}
+}
+
+// batch returns state of one insert request. Nil thinner returns nil batch which allows everything
+func (t *thinner) batch(tenant string) *thinningBatch {
+	if t == nil {
+		return nil
+	}
+	return &thinningBatch{
+		thinner: t,
+		tenant:  tenant,
+		pending: make(map[string]int64),
+	}
+}
+
+// thinningBatch filters samples of a request. The last timestamps are saved by commit
+// only after successful write, so retried requests are not dropped as duplicates
+type thinningBatch struct {
+	thinner *thinner
+	tenant  string
+	pending map[string]int64
+	key     []byte
+
+	// current series
+	resolution int64
+	last       int64
+	exists     bool
+	changed    bool
+
+	duplicate   int
+	tooFrequent int
+}
+
+func (b *thinningBatch) begin(id []byte, lbs []labels.Bytes) {
+	if b == nil {
+		return
+	}
+	b.key = append(append(append(b.key[:0], b.tenant...), 0xff), id...)
+	b.resolution = b.thinner.seriesResolution(lbs)
+	b.changed = false
+	b.last, b.exists = b.pending[string(b.key)]
+	if !b.exists {
+		b.last, b.exists = b.thinner.last(string(b.key))
+	}
+}
+
+// allow reports if the sample should be written. Staleness markers are always written
+func (b *thinningBatch) allow(ts int64, v float64) bool {
+	if b == nil || math.Float64bits(v) == value.StaleNaN {
+		return true
+	}
+	if b.exists {
+		if ts == b.last {
+			b.duplicate++
+			return false
+		}
+		// out of order samples are checked against the last one too
+		if ts > b.last-b.resolution && ts < b.last+b.resolution {
+			b.tooFrequent++
+			return false
+		}
+	}
+	if !b.exists || ts > b.last {
+		b.last, b.exists, b.changed = ts, true, true
+	}
+	return true
+}
+
+func (b *thinningBatch) end() {
+	if b != nil && b.changed {
+		b.pending[string(b.key)] = b.last
+	}
+}
+
+// commit saves timestamps of written samples and reports dropped ones
+func (b *thinningBatch) commit() {
+	if b == nil {
+		return
+	}
+	b.thinner.update(b.pending)
+	discardedSamples.WithLabelValues(reasonDuplicate).Add(float64(b.duplicate))
+	discardedSamples.WithLabelValues(reasonTooFrequent).Add(float64(b.tooFrequent))
+}
@@ -0,0 +1,98 @@
+package insert
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/pluto-metrics/pluto/pkg/config"
+	"github.com/pluto-metrics/pluto/pkg/insert/labels"
+	"github.com/prometheus/prometheus/model/value"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testThinner(t *testing.T) *thinner {
+	cfg := &config.Config{}
+	cfg.Insert.Thinning.Enabled = true
+	cfg.Insert.Thinning.Resolution = 15 * time.Second
+	cfg.Insert.Thinning.TTL = time.Hour
+	cfg.Insert.Thinning.Rules = []config.ThinningRule{{Match: `{__name__="fast"}`, Resolution: 0}}
+	th, err := newThinner(cfg)
+	require.NoError(t, err)
+	return th
+}
+
+func allowed(b *thinningBatch, id string, name string, timestamps ...int64) []int64 {
+	var ret []int64
+	b.begin([]byte(id), []labels.Bytes{{Name: []byte("__name__"), Value: []byte(name)}})
+	for _, ts := range timestamps {
+		if b.allow(ts, 1) {
+			ret = append(ret, ts)
+		}
+	}
+	b.end()
+	return ret
+}
+
+func TestThinning(t *testing.T) {
+	assert := assert.New(t)
+	th := testThinner(t)
+
+	b := th.batch("")
+	assert.Equal([]int64{0, 15000, 30000}, allowed(b, "a", "slow", 0, 1000, 15000, 15000, 20000, 30000))
+	// the rule disables resolution, only duplicates are dropped
+	assert.Equal([]int64{0, 1000, 2000}, allowed(b, "b", "fast", 0, 1000, 1000, 2000))
+	assert.Equal(2, b.duplicate)
+	assert.Equal(2, b.tooFrequent)
+
+	// nothing is saved before commit, e.g. if write failed
+	b = th.batch("")
+	assert.Equal([]int64{0}, allowed(b, "a", "slow", 0))
+	b.commit()
+
+	b = th.batch("")
+	assert.Equal([]int64{15000}, allowed(b, "a", "slow", 0, 5000, 15000))
+	// other tenant is independent
+	b = th.batch("t1")
+	assert.Equal([]int64{0}, allowed(b, "a", "slow", 0))
+}
+
+func TestThinningStaleMarker(t *testing.T) {
+	b := testThinner(t).batch("")
+	b.begin([]byte("a"), nil)
+	assert.True(t, b.allow(0, 1))
+	assert.True(t, b.allow(0, math.Float64frombits(value.StaleNaN)))
+	assert.False(t, b.allow(0, 1))
+}
+
+func TestThinningTTL(t *testing.T) {
+	assert := assert.New(t)
+	th := testThinner(t)
+
+	th.update(map[string]int64{"a": 1})
+	th.rotated = time.Now().Add(-2 * time.Hour)
+	th.update(map[string]int64{"b": 1})
+
+	// "a" is still available from the previous generation
+	_, ok := th.last("a")
+	assert.True(ok)
+
+	th.rotated = time.Now().Add(-2 * time.Hour)
+	th.update(nil)
+	_, ok = th.last("a")
+	assert.False(ok)
+	_, ok = th.last("b")
+	assert.True(ok)
+}
+
+func TestThinningDisabled(t *testing.T) {
+	th, err := newThinner(&config.Config{})
+	require.NoError(t, err)
+	b := th.batch("")
+	b.begin([]byte("a"), nil)
+	assert.True(t, b.allow(0, 1))
+	assert.True(t, b.allow(0, 1))
+	b.end()
+	b.commit()
+}
@@ -0,0 +1,36 @@
+package insert
+
+import (
+	"time"
+
+	"github.com/pluto-metrics/pluto/pkg/watermark"
+)
+
+// writtenTimestamps keeps the oldest timestamp written to the request bodies
+type writtenTimestamps struct {
+	min   int64
+	count int
+}
+
+func (w *writtenTimestamps) add(ts int64) {
+	if w == nil {
+		return
+	}
+	if w.count == 0 || ts < w.min {
+		w.min = ts
+	}
+	w.count++
+}
+
+// beginWatermark holds the watermark of the tenant until the request is written.
+// The watermark is not moved before now-maxLag, otherwise a backfill request would hide all recent samples of the tenant
+func beginWatermark(tracker *watermark.Tracker, tenant string, written *writtenTimestamps, now time.Time, maxLag time.Duration) func() {
+	if written == nil || written.count == 0 {
+		return func() {}
+	}
+	minTimestamp := written.min
+	if maxLag > 0 {
+		minTimestamp = max(minTimestamp, now.Add(-maxLag).UnixMilli())
+	}
+	return tracker.Begin(tenant, minTimestamp)
+}
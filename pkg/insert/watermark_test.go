@@ -0,0 +1,50 @@
+package insert
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pluto-metrics/pluto/pkg/watermark"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBeginWatermark(t *testing.T) {
+	assert := assert.New(t)
+	tracker := watermark.New()
+
+	// nothing written
+	now := time.UnixMilli(10000)
+	beginWatermark(tracker, "t1", &writtenTimestamps{}, now, 0)()
+	_, ok := tracker.Tenant("t1")
+	assert.False(ok)
+
+	written := &writtenTimestamps{}
+	written.add(3000)
+	written.add(1000)
+	written.add(2000)
+
+	done := beginWatermark(tracker, "t1", written, now, 0)
+	w, ok := tracker.Tenant("t1")
+	assert.True(ok)
+	assert.Equal(int64(999), w)
+
+	_, ok = tracker.Tenant("t2")
+	assert.False(ok)
+
+	done()
+	_, ok = tracker.Tenant("t1")
+	assert.False(ok)
+
+	// backfill holds the watermark at now-maxLag only
+	done = beginWatermark(tracker, "t1", written, now, 5*time.Second)
+	w, ok = tracker.Tenant("t1")
+	assert.True(ok)
+	assert.Equal(int64(4999), w)
+	done()
+
+	done = beginWatermark(tracker, "t1", written, now, time.Minute)
+	w, ok = tracker.Tenant("t1")
+	assert.True(ok)
+	assert.Equal(int64(999), w)
+	done()
+}
@@ -0,0 +1,99 @@
+package listen
+
+import (
+	"crypto/tls"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/pluto-metrics/pluto/pkg/lg"
+)
+
+const defaultReloadInterval = 5 * time.Second
+
+// certReloader reloads certificate when cert or key file is changed
+type certReloader struct {
+	sync.Mutex
+	certFile  string
+	keyFile   string
+	interval  time.Duration
+	cert      *tls.Certificate
+	modTime   time.Time
+	lastCheck time.Time
+}
+
+func newCertReloader(certFile, keyFile string, interval time.Duration) (*certReloader, error) {
+	if interval <= 0 {
+		interval = defaultReloadInterval
+	}
+	r := &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		interval: interval,
+	}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *certReloader) filesModTime() (time.Time, error) {
+	var ret time.Time
+	for _, f := range []string{r.certFile, r.keyFile} {
+		st, err := os.Stat(f)
+		if err != nil {
+			return ret, errors.WithStack(err)
+		}
+		if st.ModTime().After(ret) {
+			ret = st.ModTime()
+		}
+	}
+	return ret, nil
+}
+
+// reload must be called with lock held or before first use
+func (r *certReloader) reload() error {
+	modTime, err := r.filesModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	r.cert = &cert
+	r.modTime = modTime
+	r.lastCheck = time.Now()
+	return nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	if time.Since(r.lastCheck) < r.interval {
+		return r.cert, nil
+	}
+	r.lastCheck = time.Now()
+
+	modTime, err := r.filesModTime()
+	if err != nil {
+		slog.Error("can't check certificate files", lg.Error(err))
+		return r.cert, nil
+	}
+	if !modTime.After(r.modTime) {
+		return r.cert, nil
+	}
+
+	// keep serving the old certificate if the new one is broken (e.g. cert updated, key not yet)
+	if err := r.reload(); err != nil {
+		slog.Error("can't reload certificate", slog.String("cert_file", r.certFile), lg.Error(err))
+		return r.cert, nil
+	}
+	slog.Info("certificate reloaded", slog.String("cert_file", r.certFile))
+
+	return r.cert, nil
+}
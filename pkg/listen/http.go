@@ -2,22 +2,30 @@ package listen
 
 import (
 	"context"
+	"maps"
 	"net/http"
+	"slices"
 	"sync"
-	"time"
 
 	"github.com/pkg/errors"
+	"github.com/pluto-metrics/pluto/pkg/config"
 )
 
 type HTTP struct {
 	sync.Mutex
-	mp map[string]*http.ServeMux
+	mp      map[string]*http.ServeMux
+	servers map[string]config.Server
 }
 
-func NewHTTP() *HTTP {
-	return &HTTP{
-		mp: make(map[string]*http.ServeMux),
+func NewHTTP(servers ...config.Server) *HTTP {
+	h := &HTTP{
+		mp:      make(map[string]*http.ServeMux),
+		servers: make(map[string]config.Server),
 	}
+	for _, s := range servers {
+		h.servers[s.Listen] = s
+	}
+	return h
 }
 
 func (h *HTTP) Mux(addr string) *http.ServeMux {
@@ -41,23 +49,29 @@ func (h *HTTP) Run(ctx context.Context) error {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	errChan := make(chan error, 1)
+	errChan := make(chan error, len(h.mp))
 
-	for addr, mux := range h.mp {
-		httpSrv := &http.Server{
-			Addr:        addr,
-			Handler:     mux,
-			ReadTimeout: 10 * time.Second,
+	servers := make([]*server, 0, len(h.mp))
+	for _, addr := range slices.Sorted(maps.Keys(h.mp)) {
+		srv, err := newServer(addr, h.mp[addr], h.servers[addr])
+		if err != nil {
+			// listeners opened before are not served yet
+			for _, s := range servers {
+				s.listener.Close()
+			}
+			return err
 		}
+		servers = append(servers, srv)
+	}
 
+	for _, srv := range servers {
 		go func() {
-			err := httpSrv.ListenAndServe()
-			errChan <- err
+			errChan <- srv.serve()
 		}()
 
 		go func() {
 			<-ctx.Done()
-			httpSrv.Close()
+			srv.close()
 		}()
 	}
 
@@ -0,0 +1,119 @@
+package listen
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/pluto-metrics/pluto/pkg/config"
+	"golang.org/x/net/netutil"
+)
+
+const (
+	unixPrefix         = "unix:"
+	defaultReadTimeout = 10 * time.Second
+)
+
+type server struct {
+	httpSrv  *http.Server
+	listener net.Listener
+	tls      bool
+}
+
+// listen opens tcp or unix socket. Stale unix socket file is removed
+func listen(addr string) (net.Listener, error) {
+	if path, ok := strings.CutPrefix(addr, unixPrefix); ok {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return nil, errors.WithStack(err)
+		}
+		ln, err := net.Listen("unix", path)
+		return ln, errors.WithStack(err)
+	}
+	ln, err := net.Listen("tcp", addr)
+	return ln, errors.WithStack(err)
+}
+
+func newTLSConfig(cfg config.ServerTLS) (*tls.Config, error) {
+	reloader, err := newCertReloader(cfg.CertFile, cfg.KeyFile, cfg.ReloadInterval)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}
+
+	if cfg.ClientCAFile != "" {
+		// #nosec G304
+		pem, err := os.ReadFile(cfg.ClientCAFile)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("no certificates found in %s", cfg.ClientCAFile)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tlsConfig, nil
+}
+
+func newServer(addr string, handler http.Handler, cfg config.Server) (*server, error) {
+	readTimeout := cfg.ReadTimeout
+	if readTimeout == 0 {
+		readTimeout = defaultReadTimeout
+	}
+
+	s := &server{
+		httpSrv: &http.Server{
+			Addr:              addr,
+			Handler:           handler,
+			ReadTimeout:       readTimeout,
+			ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+			WriteTimeout:      cfg.WriteTimeout,
+			IdleTimeout:       cfg.IdleTimeout,
+			MaxHeaderBytes:    cfg.MaxHeaderBytes,
+		},
+	}
+
+	if cfg.TLS.CertFile != "" || cfg.TLS.KeyFile != "" {
+		tlsConfig, err := newTLSConfig(cfg.TLS)
+		if err != nil {
+			return nil, err
+		}
+		s.httpSrv.TLSConfig = tlsConfig
+		s.tls = true
+	}
+
+	ln, err := listen(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.MaxConnections > 0 {
+		ln = netutil.LimitListener(ln, cfg.MaxConnections)
+	}
+	s.listener = ln
+
+	return s, nil
+}
+
+func (s *server) serve() error {
+	if s.tls {
+		// certificate is provided by TLSConfig.GetCertificate
+		return s.httpSrv.ServeTLS(s.listener, "", "")
+	}
+	return s.httpSrv.Serve(s.listener)
+}
+
+func (s *server) close() error {
+	return s.httpSrv.Close()
+}
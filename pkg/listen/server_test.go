@@ -0,0 +1,145 @@
+package listen
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pluto-metrics/pluto/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeCert(t *testing.T, dir string, cn string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	return certFile, keyFile
+}
+
+func TestUnixSocket(t *testing.T) {
+	assert := assert.New(t)
+
+	socket := filepath.Join(t.TempDir(), "pluto.sock")
+	addr := "unix:" + socket
+
+	h := NewHTTP()
+	h.Mux(addr).HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go h.Run(ctx)
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		},
+	}}
+
+	require.Eventually(t, func() bool {
+		resp, err := client.Get("http://pluto/")
+		if err != nil {
+			return false
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return assert.Equal("ok", string(body))
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestRunClosesListenersOnError(t *testing.T) {
+	dir := t.TempDir()
+	socket := filepath.Join(dir, "a.sock")
+
+	h := NewHTTP()
+	h.Mux("unix:" + socket)
+	h.Mux("unix:" + filepath.Join(dir, "missing", "b.sock"))
+
+	require.Error(t, h.Run(context.Background()))
+
+	_, err := net.Dial("unix", socket)
+	assert.Error(t, err)
+}
+
+func TestCertReload(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := t.TempDir()
+	certFile, keyFile := writeCert(t, dir, "first")
+
+	r, err := newCertReloader(certFile, keyFile, time.Nanosecond)
+	require.NoError(t, err)
+
+	commonName := func() string {
+		cert, err := r.GetCertificate(&tls.ClientHelloInfo{})
+		require.NoError(t, err)
+		parsed, err := x509.ParseCertificate(cert.Certificate[0])
+		require.NoError(t, err)
+		return parsed.Subject.CommonName
+	}
+
+	assert.Equal("first", commonName())
+
+	writeCert(t, dir, "second")
+	future := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(certFile, future, future))
+	assert.Equal("second", commonName())
+
+	// broken files keep the previous certificate
+	require.NoError(t, os.WriteFile(keyFile, []byte("broken"), 0600))
+	future = future.Add(time.Minute)
+	require.NoError(t, os.Chtimes(keyFile, future, future))
+	assert.Equal("second", commonName())
+}
+
+func TestNewServerTimeouts(t *testing.T) {
+	assert := assert.New(t)
+
+	s, err := newServer("127.0.0.1:0", http.NotFoundHandler(), config.Server{})
+	require.NoError(t, err)
+	defer s.listener.Close()
+	assert.Equal(defaultReadTimeout, s.httpSrv.ReadTimeout)
+
+	s, err = newServer("127.0.0.1:0", http.NotFoundHandler(), config.Server{
+		ReadTimeout:  time.Minute,
+		WriteTimeout: 5 * time.Minute,
+	})
+	require.NoError(t, err)
+	defer s.listener.Close()
+	assert.Equal(time.Minute, s.httpSrv.ReadTimeout)
+	assert.Equal(5*time.Minute, s.httpSrv.WriteTimeout)
+}
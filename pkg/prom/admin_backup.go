@@ -0,0 +1,318 @@
+package prom
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/pluto-metrics/pluto/pkg/auth"
+	"github.com/pluto-metrics/pluto/pkg/config"
+	"github.com/pluto-metrics/pluto/pkg/errs"
+	"github.com/pluto-metrics/pluto/pkg/lg"
+	"github.com/pluto-metrics/pluto/pkg/sql"
+	"github.com/pluto-metrics/rowbinary"
+	"github.com/pluto-metrics/rowbinary/schema"
+)
+
+var (
+	backupNameRegexp = regexp.MustCompile(`^[0-9A-Za-z_.+-]+$`)
+	databaseRegexp   = regexp.MustCompile(`^[A-Za-z_][0-9A-Za-z_]*$`)
+)
+
+// backup is a row of system.backups, restores are listed too
+type backup struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Destination string `json:"destination"`
+	Host        string `json:"host"`
+	Status      string `json:"status"`
+	Error       string `json:"error,omitempty"`
+	StartTime   int64  `json:"startTime"`
+	EndTime     int64  `json:"endTime"`
+	TotalSize   uint64 `json:"totalSize"`
+	// the backup is missing or failed on other ClickHouse of the storage
+	Partial bool `json:"partial,omitempty"`
+}
+
+// storageGroup is storage tables of the same ClickHouse
+type storageGroup struct {
+	clickhouse *config.ClickHouse
+	host       string
+	tables     []string
+}
+
+func storageGroups(cfg *config.Config) []storageGroup {
+	var ret []storageGroup
+	index := make(map[string]int)
+	for _, t := range cfg.StorageTables() {
+		i, ok := index[t.ClickHouse.DSN]
+		if !ok {
+			i = len(ret)
+			index[t.ClickHouse.DSN] = i
+			g := storageGroup{clickhouse: t.ClickHouse}
+			// the DSN may contain credentials
+			if u, err := url.Parse(t.ClickHouse.DSN); err == nil {
+				g.host = u.Host
+			}
+			ret = append(ret, g)
+		}
+		ret[i].tables = append(ret[i].tables, t.Table)
+	}
+	return ret
+}
+
+// groupStatus is the result of the statement on one storage group
+type groupStatus struct {
+	Host   string   `json:"host"`
+	Tables []string `json:"tables"`
+	Error  string   `json:"error,omitempty"`
+}
+
+// execGroups runs the statement on every storage group. A failed group doesn't stop the others,
+// so the result doesn't depend on the order of groups. Returns an error listing failed groups
+func (q *Querier) execGroups(ctx context.Context, action string, statement func(g storageGroup) (string, error)) ([]groupStatus, error) {
+	groups := storageGroups(q.config)
+	ret := make([]groupStatus, len(groups))
+	var failed []string
+	for i, g := range groups {
+		ret[i] = groupStatus{Host: g.host, Tables: g.tables}
+		qq, err := statement(g)
+		if err == nil {
+			err = q.exec(ctx, g.clickhouse, qq)
+		}
+		if err != nil {
+			slog.ErrorContext(ctx, "can't "+action, slog.String("host", g.host), slog.String("tables", strings.Join(g.tables, ",")), lg.Error(err))
+			ret[i].Error = err.Error()
+			failed = append(failed, fmt.Sprintf("%s (%s): %s", g.host, strings.Join(g.tables, ", "), err))
+			continue
+		}
+		slog.InfoContext(ctx, action+" started", slog.String("host", g.host), slog.String("tables", strings.Join(g.tables, ",")))
+	}
+	if len(failed) > 0 {
+		return ret, errs.NewErrorfWithCode(http.StatusInternalServerError, "%s failed on %d of %d clickhouse: %s", action, len(failed), len(groups), strings.Join(failed, "; "))
+	}
+	return ret, nil
+}
+
+// backupDestination returns Disk(backup_disk, name) or File(name) if the disk is not set
+func backupDestination(cfg *config.Config, name string) string {
+	if cfg.Prometheus.Admin.BackupDisk == "" {
+		return "File(" + sql.Quote(name) + ")"
+	}
+	return "Disk(" + sql.Quote(cfg.Prometheus.Admin.BackupDisk) + ", " + sql.Quote(name) + ")"
+}
+
+// requireUnbound refuses identities bound to a tenant, the handler affects or shows data of all tenants
+func requireUnbound(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id := auth.FromContext(r.Context()); id != nil && id.Tenant != "" {
+			writeAPIError(w, errs.NewErrorWithCode("not allowed for identity bound to a tenant", http.StatusForbidden))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// backupName returns the last argument of the destination: Disk('backups', 'name') is "name"
+func backupName(destination string) string {
+	s := strings.TrimSuffix(destination, ")")
+	if !strings.HasSuffix(s, "'") {
+		return destination
+	}
+	s = strings.TrimSuffix(s, "'")
+	return s[strings.LastIndex(s, "'")+1:]
+}
+
+// backupTables backs up all storage tables of every ClickHouse by a single asynchronous BACKUP statement.
+// Progress is available in system.backups. If some ClickHouse fails, the backup is partial and listed so
+func (q *Querier) backupTables(ctx context.Context, name string) ([]groupStatus, error) {
+	if !backupNameRegexp.MatchString(name) {
+		return nil, errs.NewErrorfWithCode(http.StatusBadRequest, "invalid backup name %q", name)
+	}
+	return q.execGroups(ctx, "backup "+name, func(g storageGroup) (string, error) {
+		tables := make([]string, len(g.tables))
+		for i, t := range g.tables {
+			tables[i] = "TABLE " + t
+		}
+		return sql.Template(`
+			BACKUP {{.tables}}{{.on_cluster}} TO {{.destination}} ASYNC
+		`, map[string]interface{}{
+			"tables":      strings.Join(tables, ", "),
+			"on_cluster":  onCluster(q.config.Prometheus.Admin.Cluster),
+			"destination": backupDestination(q.config, name),
+		})
+	})
+}
+
+// restoreTables restores storage tables of the backup into the database, existing tables are not replaced.
+// The database is created on every ClickHouse before any restore starts. If a restore fails to start,
+// others are running and the database must be dropped on every ClickHouse before the next attempt
+func (q *Querier) restoreTables(ctx context.Context, name string, database string) ([]groupStatus, error) {
+	if !backupNameRegexp.MatchString(name) {
+		return nil, errs.NewErrorfWithCode(http.StatusBadRequest, "invalid backup name %q", name)
+	}
+	if !databaseRegexp.MatchString(database) {
+		return nil, errs.NewErrorfWithCode(http.StatusBadRequest, "invalid database name %q", database)
+	}
+	cluster := onCluster(q.config.Prometheus.Admin.Cluster)
+
+	if status, err := q.execGroups(ctx, "create database "+database, func(g storageGroup) (string, error) {
+		return "CREATE DATABASE IF NOT EXISTS " + sql.Column(database) + cluster, nil
+	}); err != nil {
+		return status, err
+	}
+
+	return q.execGroups(ctx, "restore "+name, func(g storageGroup) (string, error) {
+		tables := make([]string, len(g.tables))
+		for i, t := range g.tables {
+			// db.table is restored to database.table
+			tables[i] = "TABLE " + t + " AS " + sql.Column(database) + "." + sql.Column(t[strings.LastIndex(t, ".")+1:])
+		}
+		return sql.Template(`
+			RESTORE {{.tables}}{{.on_cluster}} FROM {{.destination}} ASYNC
+		`, map[string]interface{}{
+			"tables":      strings.Join(tables, ", "),
+			"on_cluster":  cluster,
+			"destination": backupDestination(q.config, name),
+		})
+	})
+}
+
+// backups lists backups and restores of the configured destination known by every ClickHouse. The list is kept
+// in memory of ClickHouse and is empty after restart, system.backup_log keeps the history if enabled
+func (api *plutoAPI) backups(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	q := api.querier()
+
+	// Disk('backups', 'name') is listed as Disk('backups', '
+	prefix := strings.TrimSuffix(backupDestination(api.config, ""), "')")
+	qq, err := sql.Template(`
+		SELECT id, name, toString(status), error,
+			toInt64(toUnixTimestamp(start_time)), toInt64(toUnixTimestamp(end_time)), toUInt64(total_size)
+		FROM system.backups
+		WHERE startsWith(name, {{.prefix|quote}})
+		ORDER BY start_time DESC
+		FORMAT RowBinary
+	`, map[string]interface{}{
+		"prefix": prefix,
+	})
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	ret := []backup{}
+	groups := storageGroups(api.config)
+	// backup names created or being created by every group
+	created := make(map[string]int)
+	for _, g := range groups {
+		b, err := q.readBackups(ctx, g.clickhouse, qq)
+		if err != nil {
+			writeAPIError(w, err)
+			return
+		}
+		names := make(map[string]bool)
+		for i := range b {
+			b[i].Host = g.host
+			if b[i].Status == "CREATING_BACKUP" || b[i].Status == "BACKUP_CREATED" {
+				names[b[i].Name] = true
+			}
+		}
+		for n := range names {
+			created[n]++
+		}
+		ret = append(ret, b...)
+	}
+	for i := range ret {
+		if strings.Contains(ret[i].Status, "BACKUP") && created[ret[i].Name] < len(groups) {
+			ret[i].Partial = true
+		}
+	}
+	writeAPIResponse(w, ret)
+}
+
+func (q *Querier) readBackups(ctx context.Context, ch *config.ClickHouse, qq string) ([]backup, error) {
+	chRequest, err := q.request(ctx, ch, qq)
+	if err != nil {
+		return nil, err
+	}
+	defer chRequest.Close()
+
+	chResponse, err := chRequest.Finish()
+	if err != nil {
+		slog.ErrorContext(ctx, "can't finish request to clickhouse", lg.Error(err))
+		return nil, err
+	}
+	defer chResponse.Close()
+
+	r := schema.NewReader(bufio.NewReader(chResponse)).
+		Format(schema.RowBinary).
+		Column(rowbinary.String).
+		Column(rowbinary.String).
+		Column(rowbinary.String).
+		Column(rowbinary.String).
+		Column(rowbinary.Int64).
+		Column(rowbinary.Int64).
+		Column(rowbinary.UInt64)
+
+	var ret []backup
+	for r.Next() {
+		var b backup
+		b.ID, _ = schema.Read(r, rowbinary.String)
+		b.Destination, _ = schema.Read(r, rowbinary.String)
+		b.Status, _ = schema.Read(r, rowbinary.String)
+		b.Error, _ = schema.Read(r, rowbinary.String)
+		b.StartTime, _ = schema.Read(r, rowbinary.Int64)
+		b.EndTime, _ = schema.Read(r, rowbinary.Int64)
+		b.TotalSize, _ = schema.Read(r, rowbinary.UInt64)
+		if r.Err() != nil {
+			break
+		}
+		b.Name = backupName(b.Destination)
+		ret = append(ret, b)
+	}
+	return ret, r.Err()
+}
+
+// restore restores the backup "name" into the new "database"
+func (api *plutoAPI) restore(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodPut {
+		writeAPIError(w, errs.NewErrorWithCode("restore requires POST or PUT", http.StatusMethodNotAllowed))
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		writeAPIError(w, badData(err))
+		return
+	}
+
+	name, database := r.FormValue("name"), r.FormValue("database")
+	groups, err := api.querier().restoreTables(r.Context(), name, database)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	writeAPIResponse(w, map[string]interface{}{"name": name, "database": database, "groups": groups})
+}
+
+// snapshot starts backup of storage tables named after the snapshot directory created by /api/v1/admin/tsdb/snapshot.
+// The directory and empty snapshots/ parent are removed, data is written by ClickHouse to the backup destination
+func (s *storageImpl) snapshot(ctx context.Context, dir string) error {
+	name := filepath.Base(dir)
+	if err := os.Remove(dir); err != nil && !os.IsNotExist(err) {
+		slog.WarnContext(ctx, "can't remove snapshot directory", slog.String("dir", dir), lg.Error(err))
+	}
+	if parent := filepath.Dir(dir); filepath.Base(parent) == "snapshots" {
+		// fails if other snapshots are there
+		os.Remove(parent)
+	}
+	q := &Querier{config: s.config}
+	_, err := q.backupTables(ctx, name)
+	return err
+}
@@ -0,0 +1,178 @@
+package prom
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pluto-metrics/pluto/pkg/auth"
+	"github.com/pluto-metrics/pluto/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackupName(t *testing.T) {
+	assert.Equal(t, "snap", backupName("Disk('backups', 'snap')"))
+	assert.Equal(t, "snap", backupName("File('snap')"))
+	assert.Equal(t, "S3(url)", backupName("S3(url)"))
+}
+
+func TestSnapshot(t *testing.T) {
+	cfg, ch := newTestAdminConfig(t)
+	cfg.Prometheus.Admin.BackupDisk = "backups"
+	storage := newStorage(cfg)
+
+	dir := filepath.Join(t.TempDir(), "snapshots", "20261019T120000Z-00000000000000ff")
+	require.NoError(t, os.MkdirAll(dir, 0o777))
+	require.NoError(t, storage.Snapshot(dir, true))
+
+	queries := ch.received()
+	require.Len(t, queries, 1)
+	assert.Contains(t, queries[0], "BACKUP TABLE series, TABLE samples, TABLE samples_1h TO Disk('backups', '20261019T120000Z-00000000000000ff') ASYNC")
+	assert.NoDirExists(t, filepath.Dir(dir))
+
+	ch.reset()
+	cfg.Prometheus.Admin.BackupDisk = ""
+	cfg.Prometheus.Admin.Cluster = "main"
+	require.NoError(t, storage.Snapshot("snapshots/snap", true))
+	queries = ch.received()
+	require.Len(t, queries, 1)
+	assert.Contains(t, queries[0], "ON CLUSTER `main` TO File('snap') ASYNC")
+
+	assert.Error(t, storage.Snapshot("snapshots/bad'name", true))
+}
+
+// newFailingClickHouse moves samples_1h to a ClickHouse failing every statement but the listing of backups
+func newFailingClickHouse(t *testing.T, cfg *config.Config) *fakeClickHouse {
+	failing := newFakeClickHouse(t, func(w io.Writer, qq string) {
+		if strings.Contains(qq, "system.backups") {
+			return
+		}
+		w.(http.ResponseWriter).WriteHeader(http.StatusInternalServerError)
+	})
+	cfg.OverrideSamples[0].ClickHouse = &config.ClickHouse{DSN: failing.srv.URL}
+	return failing
+}
+
+func TestSnapshotPartial(t *testing.T) {
+	cfg, ch := newTestAdminConfig(t)
+	failing := newFailingClickHouse(t, cfg)
+	storage := newStorage(cfg)
+
+	// the failed ClickHouse doesn't stop the backup of others
+	err := storage.Snapshot("snapshots/snap", true)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "failed on 1 of 2 clickhouse")
+	assert.Contains(t, err.Error(), "(samples_1h)")
+	assert.NotContains(t, err.Error(), "(series, samples)")
+
+	require.Len(t, ch.received(), 1)
+	assert.Contains(t, ch.received()[0], "BACKUP TABLE series, TABLE samples TO File('snap') ASYNC")
+	require.Len(t, failing.received(), 1)
+	assert.Contains(t, failing.received()[0], "BACKUP TABLE samples_1h TO File('snap') ASYNC")
+
+	// the backup is missing on the failed ClickHouse
+	api := newPlutoAPI(cfg)
+	rec := httptest.NewRecorder()
+	api.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin/backups", nil))
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var resp struct {
+		Data []backup `json:"data"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	require.Len(t, resp.Data, 1)
+	assert.True(t, resp.Data[0].Partial)
+}
+
+func TestRestore(t *testing.T) {
+	cfg, ch := newTestAdminConfig(t)
+	cfg.Prometheus.Admin.BackupDisk = "backups"
+	api := newPlutoAPI(cfg)
+
+	rec := httptest.NewRecorder()
+	api.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/admin/restore?name=snap&database=bad-db", nil))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = httptest.NewRecorder()
+	api.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin/restore?name=snap&database=restored", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+	assert.Empty(t, ch.received())
+
+	rec = httptest.NewRecorder()
+	api.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/admin/restore?name=snap&database=restored", nil))
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	queries := ch.received()
+	require.Len(t, queries, 2)
+	assert.Equal(t, "CREATE DATABASE IF NOT EXISTS `restored`", queries[0])
+	assert.Contains(t, queries[1], "RESTORE TABLE series AS `restored`.`series`, TABLE samples AS `restored`.`samples`, TABLE samples_1h AS `restored`.`samples_1h` FROM Disk('backups', 'snap') ASYNC")
+}
+
+func TestRestorePartial(t *testing.T) {
+	cfg, ch := newTestAdminConfig(t)
+	failing := newFailingClickHouse(t, cfg)
+	api := newPlutoAPI(cfg)
+
+	// nothing is restored unless the database is created on every ClickHouse
+	rec := httptest.NewRecorder()
+	api.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/admin/restore?name=snap&database=restored", nil))
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+	assert.Contains(t, rec.Body.String(), "create database restored failed on 1 of 2 clickhouse")
+
+	require.Len(t, ch.received(), 1)
+	assert.Equal(t, "CREATE DATABASE IF NOT EXISTS `restored`", ch.received()[0])
+	require.Len(t, failing.received(), 1)
+	assert.Equal(t, "CREATE DATABASE IF NOT EXISTS `restored`", failing.received()[0])
+}
+
+func TestBackups(t *testing.T) {
+	cfg, ch := newTestAdminConfig(t)
+	cfg.Prometheus.Admin.BackupDisk = "backups"
+	api := newPlutoAPI(cfg)
+
+	rec := httptest.NewRecorder()
+	api.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin/backups", nil))
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	var resp struct {
+		Data []backup `json:"data"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	u, err := url.Parse(ch.srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, []backup{{
+		ID:          "b1",
+		Name:        "snap",
+		Destination: "Disk('backups', 'snap')",
+		Host:        u.Host,
+		Status:      "BACKUP_CREATED",
+		StartTime:   100,
+		EndTime:     200,
+		TotalSize:   1024,
+	}}, resp.Data)
+
+	// backups of other destinations are not listed
+	queries := ch.received()
+	require.Len(t, queries, 1)
+	assert.Contains(t, queries[0], "startsWith(name, ")
+	assert.Contains(t, queries[0], "backups")
+}
+
+func TestRequireUnbound(t *testing.T) {
+	cfg, ch := newTestAdminConfig(t)
+	api := newPlutoAPI(cfg)
+
+	for _, path := range []string{"/admin/backups", "/admin/mutations", "/admin/restore?name=snap&database=restored"} {
+		rec := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, path, nil)
+		api.ServeHTTP(rec, r.WithContext(auth.With(r.Context(), &auth.Identity{Name: "team1", Tenant: "t1", Permission: auth.PermissionAdmin})))
+		assert.Equal(t, http.StatusForbidden, rec.Code, path)
+	}
+	assert.Empty(t, ch.received())
+}
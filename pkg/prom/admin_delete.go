@@ -0,0 +1,459 @@
+package prom
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"log/slog"
+	"maps"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/pluto-metrics/pluto/pkg/config"
+	"github.com/pluto-metrics/pluto/pkg/errs"
+	"github.com/pluto-metrics/pluto/pkg/lg"
+	"github.com/pluto-metrics/pluto/pkg/sql"
+	"github.com/pluto-metrics/pluto/pkg/tenant"
+	"github.com/pluto-metrics/rowbinary"
+	"github.com/pluto-metrics/rowbinary/schema"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// deletedRows is a count of rows to be deleted from the table
+type deletedRows struct {
+	Table string `json:"table"`
+	Rows  uint64 `json:"rows"`
+}
+
+type deleteResult struct {
+	Series uint64        `json:"series"`
+	Tables []deletedRows `json:"tables"`
+	DryRun bool          `json:"dryRun"`
+}
+
+// deleteCondition selects rows of the series within [mint, maxt]. Rows of the series table are deleted only if
+// the series is not seen outside of the range in the partition
+func deleteCondition(t config.StorageTable, mint, maxt int64) string {
+	if t.Series {
+		return sql.Gte(sql.Column("timestamp_min"), sql.Quote(mint)) + " AND " + sql.Lte(sql.Column("timestamp_max"), sql.Quote(maxt))
+	}
+	div := int64(1)
+	if t.SamplesTimestampUInt32 {
+		div = 1000
+	}
+	return sql.Gte(sql.Column("timestamp"), sql.Quote(mint/div)) + " AND " + sql.Lte(sql.Column("timestamp"), sql.Quote(maxt/div))
+}
+
+// seriesSelect returns the series config and the query of ids of series matching the selector within [mint, maxt].
+// Query limits are not applied
+func (q *Querier) seriesSelect(ctx context.Context, mint, maxt int64, matchers []*labels.Matcher) (config.ConfigSeries, string, error) {
+	// ids of the same labels are equal in all tenants, tables separated by overrides can't be cleaned for one tenant
+	if q.config.Tenant.Enabled && q.config.Tenant.Label == "" {
+		return config.ConfigSeries{}, "", errs.NewErrorWithCode("deletion requires tenant.label", http.StatusNotImplemented)
+	}
+
+	matchers, err := q.tenantMatchers(ctx, matchers)
+	if err != nil {
+		return config.ConfigSeries{}, "", err
+	}
+
+	seriesCfg, err := q.config.GetSeries(&config.EnvSeries{Start: mint, End: maxt, Tenant: tenant.FromContext(ctx)})
+	if err != nil {
+		return config.ConfigSeries{}, "", err
+	}
+
+	where := sql.NewWhere()
+	q.whereSeriesTimeRange(ctx, where, mint, maxt)
+	q.whereMatchLabels(ctx, seriesCfg, where, matchers)
+
+	qq, err := sql.Template(`SELECT DISTINCT id FROM {{.table}} {{.where.SQL}}`, map[string]interface{}{
+		"table": seriesCfg.Table,
+		"where": where,
+	})
+	return seriesCfg, qq, err
+}
+
+// seriesIDs returns ids of series matching the selector within [mint, maxt]
+func (q *Querier) seriesIDs(ctx context.Context, mint, maxt int64, matchers []*labels.Matcher) ([]string, error) {
+	seriesCfg, qq, err := q.seriesSelect(ctx, mint, maxt, matchers)
+	if err != nil {
+		return nil, err
+	}
+	qq += " FORMAT RowBinary"
+
+	chRequest, err := q.request(ctx, seriesCfg.ClickHouse, qq)
+	if err != nil {
+		return nil, err
+	}
+	defer chRequest.Close()
+
+	chResponse, err := chRequest.Finish()
+	if err != nil {
+		slog.ErrorContext(ctx, "can't finish request to clickhouse", lg.Error(err))
+		return nil, err
+	}
+	defer chResponse.Close()
+
+	r := schema.NewReader(bufio.NewReader(chResponse)).
+		Format(schema.RowBinary).
+		Column(rowbinary.String)
+
+	var ids []string
+	for r.Next() {
+		id, err := schema.Read(r, rowbinary.String)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	if r.Err() != nil {
+		return nil, r.Err()
+	}
+	slices.Sort(ids)
+	return ids, nil
+}
+
+// countDeleted returns rows of every storage table which would be deleted
+func (q *Querier) countDeleted(ctx context.Context, ids []string, mint, maxt int64) ([]deletedRows, error) {
+	writeIDs := func(w io.Writer) error {
+		schemaWriter := schema.NewWriter(w).
+			Format(schema.RowBinary).
+			Column("id", rowbinary.String)
+		for _, id := range ids {
+			if err := schemaWriter.WriteValues(id); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	ret := []deletedRows{}
+	for _, t := range q.config.StorageTables() {
+		qq, err := sql.Template(`
+			SELECT count()
+			FROM {{.table}}
+			WHERE id IN (SELECT id FROM ids) AND {{.condition}}
+			FORMAT RowBinary
+		`, map[string]interface{}{
+			"table":     t.Table,
+			"condition": deleteCondition(t, mint, maxt),
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		count, err := q.queryCount(ctx, t.ClickHouse, qq, writeIDs)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, deletedRows{Table: t.Table, Rows: count})
+	}
+	return ret, nil
+}
+
+func (q *Querier) queryCount(ctx context.Context, ch *config.ClickHouse, qq string, writeIDs func(w io.Writer) error) (uint64, error) {
+	chRequest, err := q.requestWithIDs(ctx, ch, qq, "id String", writeIDs)
+	if err != nil {
+		return 0, err
+	}
+	defer chRequest.Close()
+
+	chResponse, err := chRequest.Finish()
+	if err != nil {
+		slog.ErrorContext(ctx, "can't finish request to clickhouse", lg.Error(err))
+		return 0, err
+	}
+	defer chResponse.Close()
+
+	r := schema.NewReader(bufio.NewReader(chResponse)).
+		Format(schema.RowBinary).
+		Column(rowbinary.UInt64)
+
+	var count uint64
+	if r.Next() {
+		count, _ = schema.Read(r, rowbinary.UInt64)
+	}
+	return count, r.Err()
+}
+
+// deleteWhere deletes rows of series selected by the ids query from all storage tables, one statement per table.
+// The query reads the series table, so all storage tables must be available on its ClickHouse. Samples are deleted
+// before series and the series table of the query is the last one, so interrupted deletion can be repeated with
+// the same selector. Mutations are waited for the same reason
+func (q *Querier) deleteWhere(ctx context.Context, seriesCfg config.ConfigSeries, ids string, mint, maxt int64) error {
+	admin := q.config.Prometheus.Admin
+	tables := q.config.StorageTables()
+	order := func(t config.StorageTable) int {
+		switch {
+		case !t.Series:
+			return 0
+		case t.Table != seriesCfg.Table || t.ClickHouse.DSN != seriesCfg.ClickHouse.DSN:
+			return 1
+		}
+		return 2
+	}
+	// the latest samples tables are the first ones
+	slices.Reverse(tables)
+	slices.SortStableFunc(tables, func(a, b config.StorageTable) int { return order(a) - order(b) })
+
+	for _, t := range tables {
+		qq, err := sql.Template(`
+			{{if .lightweight}}DELETE FROM {{.table}}{{.on_cluster}} WHERE{{else}}ALTER TABLE {{.table}}{{.on_cluster}} DELETE WHERE{{end}}
+				id IN ({{.ids}}) AND {{.condition}}
+		`, map[string]interface{}{
+			"lightweight": admin.DeleteMode != "mutation",
+			"table":       t.Table,
+			"on_cluster":  onCluster(admin.Cluster),
+			"ids":         ids,
+			"condition":   deleteCondition(t, mint, maxt),
+		})
+		if err != nil {
+			return err
+		}
+
+		// the subquery makes the mutation nondeterministic for replicated tables
+		params := map[string]string{"allow_nondeterministic_mutations": "1"}
+		if order(t) < 2 {
+			params["mutations_sync"] = "2"
+		}
+		if err := q.exec(ctx, withParams(t.ClickHouse, params), qq); err != nil {
+			return err
+		}
+		slog.InfoContext(ctx, "series deleted", slog.String("table", t.Table), slog.Int64("mint", mint), slog.Int64("maxt", maxt))
+	}
+	return nil
+}
+
+// withParams returns copy of the config with extra settings of the request
+func withParams(ch *config.ClickHouse, params map[string]string) *config.ClickHouse {
+	ret := *ch
+	ret.Params = maps.Clone(ch.Params)
+	if ret.Params == nil {
+		ret.Params = make(map[string]string)
+	}
+	maps.Copy(ret.Params, params)
+	return &ret
+}
+
+// exec runs the statement without result
+func (q *Querier) exec(ctx context.Context, ch *config.ClickHouse, qq string) error {
+	chRequest, err := q.request(ctx, ch, qq)
+	if err != nil {
+		return err
+	}
+	defer chRequest.Close()
+
+	chResponse, err := chRequest.Finish()
+	if err != nil {
+		slog.ErrorContext(ctx, "can't finish request to clickhouse", lg.Error(err))
+		return err
+	}
+	return chResponse.Close()
+}
+
+func onCluster(cluster string) string {
+	if cluster == "" {
+		return ""
+	}
+	return " ON CLUSTER " + sql.Column(cluster)
+}
+
+// deleteSeries deletes the series within [mint, maxt] or only counts rows if dryRun is set
+func (q *Querier) deleteSeries(ctx context.Context, mint, maxt int64, matchers []*labels.Matcher, dryRun bool) (*deleteResult, error) {
+	ids, err := q.seriesIDs(ctx, mint, maxt, matchers)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := &deleteResult{Series: uint64(len(ids)), Tables: []deletedRows{}, DryRun: dryRun}
+	if len(ids) == 0 {
+		return ret, nil
+	}
+	if dryRun {
+		ret.Tables, err = q.countDeleted(ctx, ids, mint, maxt)
+		return ret, err
+	}
+
+	// ids are selected again by the statements, the query size doesn't depend on the number of series
+	seriesCfg, qq, err := q.seriesSelect(ctx, mint, maxt, matchers)
+	if err != nil {
+		return nil, err
+	}
+	return ret, q.deleteWhere(ctx, seriesCfg, qq, mint, maxt)
+}
+
+// deleteSeriesHandler is /api/v1/admin/tsdb/delete_series with dry_run parameter and counts in the response
+func (api *plutoAPI) deleteSeriesHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeAPIError(w, badData(err))
+		return
+	}
+
+	dryRun := false
+	if s := r.FormValue("dry_run"); s != "" {
+		var err error
+		if dryRun, err = strconv.ParseBool(s); err != nil {
+			writeAPIError(w, badData(err))
+			return
+		}
+	}
+	if !dryRun && r.Method != http.MethodPost && r.Method != http.MethodPut {
+		writeAPIError(w, errs.NewErrorWithCode("deletion requires POST or PUT", http.StatusMethodNotAllowed))
+		return
+	}
+
+	selectors, err := parseMatchers(r)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	if len(selectors) == 0 {
+		writeAPIError(w, errs.NewErrorWithCode("no match[] parameter provided", http.StatusBadRequest))
+		return
+	}
+
+	// whole history by default as in prometheus
+	start, end := int64(0), int64(math.MaxInt64)
+	if s := r.FormValue("start"); s != "" {
+		if start, err = parseTimestamp(s); err != nil {
+			writeAPIError(w, badData(err))
+			return
+		}
+	}
+	if s := r.FormValue("end"); s != "" {
+		if end, err = parseTimestamp(s); err != nil {
+			writeAPIError(w, badData(err))
+			return
+		}
+	}
+
+	ret := &deleteResult{Tables: []deletedRows{}, DryRun: dryRun}
+	for _, matchers := range selectors {
+		res, err := api.querier().deleteSeries(r.Context(), start, end, matchers, dryRun)
+		if err != nil {
+			writeAPIError(w, err)
+			return
+		}
+		ret.Series += res.Series
+		for _, t := range res.Tables {
+			i := slices.IndexFunc(ret.Tables, func(d deletedRows) bool { return d.Table == t.Table })
+			if i < 0 {
+				ret.Tables = append(ret.Tables, t)
+				continue
+			}
+			ret.Tables[i].Rows += t.Rows
+		}
+	}
+	writeAPIResponse(w, ret)
+}
+
+// mutation is a row of system.mutations
+type mutation struct {
+	Table      string `json:"table"`
+	ID         string `json:"id"`
+	Command    string `json:"command"`
+	CreateTime int64  `json:"createTime"`
+	PartsToDo  int64  `json:"partsToDo"`
+	IsDone     bool   `json:"isDone"`
+	FailReason string `json:"failReason,omitempty"`
+}
+
+// mutations returns the latest mutations of storage tables. Lightweight deletes are mutations too
+func (api *plutoAPI) mutations(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeAPIError(w, badData(err))
+		return
+	}
+	limit, err := parseLimit(r, 100)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	ctx := r.Context()
+	q := api.querier()
+
+	// tables by clickhouse
+	var clickhouses []*config.ClickHouse
+	tables := make(map[string][]string)
+	for _, t := range api.config.StorageTables() {
+		if _, ok := tables[t.ClickHouse.DSN]; !ok {
+			clickhouses = append(clickhouses, t.ClickHouse)
+		}
+		tables[t.ClickHouse.DSN] = append(tables[t.ClickHouse.DSN], sql.Quote(t.Table))
+	}
+
+	ret := []mutation{}
+	for _, ch := range clickhouses {
+		qq, err := sql.Template(`
+			SELECT table, mutation_id, command, toInt64(toUnixTimestamp(create_time)), toInt64(parts_to_do), toUInt8(is_done), latest_fail_reason
+			FROM system.mutations
+			WHERE (database = currentDatabase() AND table IN ({{.tables}})) OR concat(database, '.', table) IN ({{.tables}})
+			ORDER BY create_time DESC
+			LIMIT {{.limit}}
+			FORMAT RowBinary
+		`, map[string]interface{}{
+			"tables": strings.Join(tables[ch.DSN], ", "),
+			"limit":  limit,
+		})
+		if err != nil {
+			writeAPIError(w, err)
+			return
+		}
+
+		m, err := q.readMutations(ctx, ch, qq)
+		if err != nil {
+			writeAPIError(w, err)
+			return
+		}
+		ret = append(ret, m...)
+	}
+
+	writeAPIResponse(w, ret)
+}
+
+func (q *Querier) readMutations(ctx context.Context, ch *config.ClickHouse, qq string) ([]mutation, error) {
+	chRequest, err := q.request(ctx, ch, qq)
+	if err != nil {
+		return nil, err
+	}
+	defer chRequest.Close()
+
+	chResponse, err := chRequest.Finish()
+	if err != nil {
+		slog.ErrorContext(ctx, "can't finish request to clickhouse", lg.Error(err))
+		return nil, err
+	}
+	defer chResponse.Close()
+
+	r := schema.NewReader(bufio.NewReader(chResponse)).
+		Format(schema.RowBinary).
+		Column(rowbinary.String).
+		Column(rowbinary.String).
+		Column(rowbinary.String).
+		Column(rowbinary.Int64).
+		Column(rowbinary.Int64).
+		Column(rowbinary.UInt8).
+		Column(rowbinary.String)
+
+	var ret []mutation
+	for r.Next() {
+		var m mutation
+		m.Table, _ = schema.Read(r, rowbinary.String)
+		m.ID, _ = schema.Read(r, rowbinary.String)
+		m.Command, _ = schema.Read(r, rowbinary.String)
+		m.CreateTime, _ = schema.Read(r, rowbinary.Int64)
+		m.PartsToDo, _ = schema.Read(r, rowbinary.Int64)
+		isDone, _ := schema.Read(r, rowbinary.UInt8)
+		m.IsDone = isDone != 0
+		m.FailReason, _ = schema.Read(r, rowbinary.String)
+		if r.Err() != nil {
+			break
+		}
+		ret = append(ret, m)
+	}
+	return ret, r.Err()
+}
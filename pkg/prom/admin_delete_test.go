@@ -0,0 +1,136 @@
+package prom
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pluto-metrics/pluto/pkg/config"
+	"github.com/pluto-metrics/pluto/pkg/tenant"
+	"github.com/pluto-metrics/rowbinary"
+	"github.com/pluto-metrics/rowbinary/schema"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestAdminConfig(t *testing.T) (*config.Config, *fakeClickHouse) {
+	ch := newFakeClickHouse(t, func(w io.Writer, qq string) {
+		switch {
+		case strings.Contains(qq, "SELECT DISTINCT id"):
+			wr := schema.NewWriter(w).Format(schema.RowBinary).Column("id", rowbinary.String)
+			assert.NoError(t, wr.WriteValues("b"))
+			assert.NoError(t, wr.WriteValues("a"))
+		case strings.Contains(qq, "system.backups"):
+			wr := schema.NewWriter(w).Format(schema.RowBinary).
+				Column("id", rowbinary.String).Column("name", rowbinary.String).Column("status", rowbinary.String).Column("error", rowbinary.String).
+				Column("start", rowbinary.Int64).Column("end", rowbinary.Int64).Column("size", rowbinary.UInt64)
+			assert.NoError(t, wr.WriteValues("b1", "Disk('backups', 'snap')", "BACKUP_CREATED", "", int64(100), int64(200), uint64(1024)))
+		case strings.Contains(qq, "count()"):
+			wr := schema.NewWriter(w).Format(schema.RowBinary).Column("c", rowbinary.UInt64)
+			assert.NoError(t, wr.WriteValues(uint64(5)))
+		}
+	})
+
+	cfg := ch.config()
+	cfg.Select.TableSeries = "series"
+	cfg.Select.TableSamples = "samples"
+	cfg.Select.SeriesPartitionMs = dayMs
+	cfg.Select.AutocompleteLookback = 24 * time.Hour
+	cfg.Prometheus.Admin.Enabled = true
+	cfg.Prometheus.Admin.DeleteMode = "lightweight"
+	cfg.OverrideSamples = slices.Grow(cfg.OverrideSamples, 1)[:1]
+	cfg.OverrideSamples[0].Table = "samples_1h"
+	return cfg, ch
+}
+
+func TestDeleteSeriesDryRun(t *testing.T) {
+	cfg, ch := newTestAdminConfig(t)
+	api := newPlutoAPI(cfg)
+
+	rec := httptest.NewRecorder()
+	api.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin/delete_series?dry_run=1&match[]=up&start=1&end=2", nil))
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	var resp struct {
+		Data deleteResult `json:"data"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Equal(t, deleteResult{
+		Series: 2,
+		Tables: []deletedRows{{Table: "series", Rows: 5}, {Table: "samples", Rows: 5}, {Table: "samples_1h", Rows: 5}},
+		DryRun: true,
+	}, resp.Data)
+
+	queries := ch.received()
+	require.Len(t, queries, 4)
+	assert.Contains(t, queries[2], "`timestamp` >= 1000 AND `timestamp` <= 2000")
+	for _, qq := range queries {
+		assert.NotContains(t, qq, "DELETE")
+	}
+}
+
+func TestDeleteSeries(t *testing.T) {
+	cfg, ch := newTestAdminConfig(t)
+	api := newPlutoAPI(cfg)
+
+	rec := httptest.NewRecorder()
+	api.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin/delete_series?match[]=up", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+
+	rec = httptest.NewRecorder()
+	api.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/admin/delete_series", nil))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Empty(t, ch.received())
+
+	rec = httptest.NewRecorder()
+	api.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/admin/delete_series?match[]=up&start=1&end=2", nil))
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	// samples are deleted before series
+	queries := ch.received()
+	require.Len(t, queries, 4)
+	assert.Contains(t, queries[1], "DELETE FROM samples_1h WHERE")
+	assert.Contains(t, queries[2], "DELETE FROM samples WHERE")
+	assert.Contains(t, queries[3], "DELETE FROM series WHERE")
+	assert.Contains(t, queries[2], "id IN (SELECT DISTINCT id FROM series WHERE")
+	assert.Contains(t, queries[2], "(`name` = 'up')) AND `timestamp` >= 1000 AND `timestamp` <= 2000")
+	assert.Contains(t, queries[3], "`timestamp_min` >= 1000 AND `timestamp_max` <= 2000")
+
+	ch.reset()
+	cfg.Prometheus.Admin.DeleteMode = "mutation"
+	cfg.Prometheus.Admin.Cluster = "main"
+	storage := newStorage(cfg)
+	require.NoError(t, storage.Delete(t.Context(), 1000, 2000))
+	queries = ch.received()
+	require.Len(t, queries, 4)
+	assert.Contains(t, queries[3], "ALTER TABLE series ON CLUSTER `main` DELETE WHERE")
+
+	// tenants can't be separated without the label
+	ch.reset()
+	cfg.Tenant.Enabled = true
+	rec = httptest.NewRecorder()
+	api.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/admin/delete_series?match[]=up", nil).WithContext(tenant.With(t.Context(), "t1")))
+	assert.Equal(t, http.StatusNotImplemented, rec.Code)
+	assert.Empty(t, ch.received())
+}
+
+func TestMutations(t *testing.T) {
+	cfg, ch := newTestAdminConfig(t)
+	api := newPlutoAPI(cfg)
+
+	rec := httptest.NewRecorder()
+	api.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin/mutations?limit=10", nil))
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.JSONEq(t, `{"status":"success","data":[]}`, rec.Body.String())
+
+	// all tables are on the same clickhouse
+	queries := ch.received()
+	require.Len(t, queries, 1)
+	assert.Contains(t, queries[0], "table IN ('series', 'samples', 'samples_1h')")
+	assert.Contains(t, queries[0], "LIMIT 10")
+}
@@ -0,0 +1,317 @@
+package prom
+
+import (
+	"bufio"
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/pluto-metrics/pluto/pkg/config"
+	"github.com/pluto-metrics/pluto/pkg/lg"
+	"github.com/pluto-metrics/pluto/pkg/sql"
+	"github.com/pluto-metrics/pluto/pkg/tenant"
+	"github.com/pluto-metrics/rowbinary"
+	"github.com/pluto-metrics/rowbinary/schema"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+const cardinalityDefaultLimit = 20
+
+type cardinalityStat struct {
+	Name   string `json:"name"`
+	Series uint64 `json:"series"`
+}
+
+type labelCardinality struct {
+	Name   string `json:"name"`
+	Values uint64 `json:"values"`
+	Series uint64 `json:"series"`
+}
+
+type cardinalityData struct {
+	Series  uint64             `json:"series"`
+	Metrics []cardinalityStat  `json:"metrics"`
+	Labels  []labelCardinality `json:"labels"`
+	// values of the label from request
+	Values []cardinalityStat `json:"values,omitempty"`
+}
+
+type churnDay struct {
+	Date      string `json:"date"`
+	Timestamp int64  `json:"timestamp"`
+	New       uint64 `json:"new"`
+	Gone      uint64 `json:"gone"`
+}
+
+// seriesWhere returns series config and condition on series matching match[] of the request
+func (api *plutoAPI) seriesWhere(r *http.Request, start, end int64) (config.ConfigSeries, *sql.Where, error) {
+	ctx := r.Context()
+	q := api.querier()
+
+	seriesCfg, err := api.config.GetSeries(&config.EnvSeries{Start: start, End: end, Tenant: tenant.FromContext(ctx)})
+	if err != nil {
+		return seriesCfg, nil, err
+	}
+
+	selectors, err := parseMatchers(r)
+	if err != nil {
+		return seriesCfg, nil, err
+	}
+	if len(selectors) == 0 {
+		selectors = [][]*labels.Matcher{nil}
+	}
+
+	where := sql.NewWhere()
+	q.whereSeriesTimeRange(ctx, where, start, end)
+
+	match := sql.NewWhere()
+	for _, matchers := range selectors {
+		matchers, err := q.tenantMatchers(ctx, matchers)
+		if err != nil {
+			return seriesCfg, nil, err
+		}
+		w := sql.NewWhere()
+		q.whereMatchLabels(ctx, seriesCfg, w, matchers)
+		if w.String() == "" {
+			// any series
+			match = sql.NewWhere()
+			break
+		}
+		match.Or(w.String())
+	}
+	where.And(match.String())
+
+	return seriesCfg, where, nil
+}
+
+// cardinality returns series count per metric name, per label name and per value of the label parameter
+func (api *plutoAPI) cardinality(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeAPIError(w, badData(err))
+		return
+	}
+	ctx := r.Context()
+	q := api.querier()
+
+	start, end, err := parseTimeRange(r, api.config.Select.AutocompleteLookback.Milliseconds())
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	limit, err := parseLimit(r, cardinalityDefaultLimit)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	seriesCfg, where, err := api.seriesWhere(r, start, end)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	params := map[string]interface{}{
+		"table": seriesCfg.Table,
+		"where": where,
+		"limit": limit,
+	}
+
+	data := cardinalityData{Metrics: []cardinalityStat{}, Labels: []labelCardinality{}}
+
+	total, err := q.statsQuery(ctx, seriesCfg, `
+		SELECT 'series', uniqExact(id) FROM {{.table}} {{.where.SQL}}
+		FORMAT RowBinary
+	`, params)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	if len(total) > 0 {
+		data.Series = total[0].Count
+	}
+
+	metrics, err := q.statsQuery(ctx, seriesCfg, `
+		SELECT name, uniqExact(id) AS c
+		FROM {{.table}}
+		{{.where.SQL}}
+		GROUP BY name ORDER BY c DESC, name LIMIT {{.limit}}
+		FORMAT RowBinary
+	`, params)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	for _, s := range metrics {
+		data.Metrics = append(data.Metrics, cardinalityStat{Name: s.Name, Series: s.Count})
+	}
+
+	data.Labels, err = q.labelCardinality(ctx, seriesCfg, params)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	if label := r.FormValue("label"); label != "" {
+		column := labelColumn(materializedLabels(seriesCfg), label)
+		where.And(sql.Ne(column, sql.Quote("")))
+		params["column"] = column
+		values, err := q.statsQuery(ctx, seriesCfg, `
+			SELECT {{.column}} AS v, uniqExact(id) AS c
+			FROM {{.table}}
+			{{.where.SQL}}
+			GROUP BY v ORDER BY c DESC, v LIMIT {{.limit}}
+			FORMAT RowBinary
+		`, params)
+		if err != nil {
+			writeAPIError(w, err)
+			return
+		}
+		data.Values = []cardinalityStat{}
+		for _, s := range values {
+			data.Values = append(data.Values, cardinalityStat{Name: s.Name, Series: s.Count})
+		}
+	}
+
+	writeAPIResponse(w, data)
+}
+
+// labelCardinality returns value and series count by label name
+func (q *Querier) labelCardinality(ctx context.Context, seriesCfg config.ConfigSeries, params map[string]interface{}) ([]labelCardinality, error) {
+	qq, err := sql.Template(`
+		SELECT k, uniqExact(v), uniqExact(id) AS c
+		FROM {{.table}}
+		ARRAY JOIN mapKeys(labels) AS k, mapValues(labels) AS v
+		{{.where.SQL}}
+		GROUP BY k ORDER BY c DESC, k LIMIT {{.limit}}
+		FORMAT RowBinary
+	`, params)
+	if err != nil {
+		return nil, err
+	}
+
+	chRequest, err := q.request(ctx, seriesCfg.ClickHouse, qq)
+	if err != nil {
+		return nil, err
+	}
+	defer chRequest.Close()
+
+	chResponse, err := chRequest.Finish()
+	if err != nil {
+		slog.ErrorContext(ctx, "can't finish request to clickhouse", lg.Error(err))
+		return nil, err
+	}
+	defer chResponse.Close()
+
+	r := schema.NewReader(bufio.NewReader(chResponse)).
+		Format(schema.RowBinary).
+		Column(rowbinary.String).
+		Column(rowbinary.UInt64).
+		Column(rowbinary.UInt64)
+
+	ret := []labelCardinality{}
+	for r.Next() {
+		var l labelCardinality
+		l.Name, _ = schema.Read(r, rowbinary.String)
+		l.Values, _ = schema.Read(r, rowbinary.UInt64)
+		l.Series, _ = schema.Read(r, rowbinary.UInt64)
+		if r.Err() != nil {
+			break
+		}
+		ret = append(ret, l)
+	}
+	if r.Err() != nil {
+		return nil, r.Err()
+	}
+	return ret, nil
+}
+
+// churn returns new and disappeared series by UTC days. A series is new on the first day it is seen after at least a day
+// of absence and gone on the last day it is seen. The last day of the range is not finished and has no gone series
+func (api *plutoAPI) churn(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeAPIError(w, badData(err))
+		return
+	}
+	ctx := r.Context()
+	q := api.querier()
+
+	start, end, err := parseTimeRange(r, api.config.Select.AutocompleteLookback.Milliseconds())
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	// the day before the range tells if the series is new
+	seriesCfg, where, err := api.seriesWhere(r, start-dayMs, end)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	qq, err := sql.Template(`
+		SELECT d, countIf(kind = 0), countIf(kind = 1 AND d < {{.end_day}})
+		FROM (
+			SELECT id, min(timestamp_min) AS first, max(timestamp_max) AS last
+			FROM {{.table}}
+			{{.where.SQL}}
+			GROUP BY id
+		)
+		ARRAY JOIN [intDiv(first, {{.day}}), intDiv(last, {{.day}})] AS d, [0, 1] AS kind
+		WHERE d >= {{.start_day}} AND d <= {{.end_day}}
+		GROUP BY d
+		ORDER BY d
+		FORMAT RowBinary
+	`, map[string]interface{}{
+		"table":     seriesCfg.Table,
+		"where":     where,
+		"day":       dayMs,
+		"start_day": start / dayMs,
+		"end_day":   end / dayMs,
+	})
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	chRequest, err := q.request(ctx, seriesCfg.ClickHouse, qq)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	defer chRequest.Close()
+
+	chResponse, err := chRequest.Finish()
+	if err != nil {
+		slog.ErrorContext(ctx, "can't finish request to clickhouse", lg.Error(err))
+		writeAPIError(w, err)
+		return
+	}
+	defer chResponse.Close()
+
+	rd := schema.NewReader(bufio.NewReader(chResponse)).
+		Format(schema.RowBinary).
+		Column(rowbinary.Int64).
+		Column(rowbinary.UInt64).
+		Column(rowbinary.UInt64)
+
+	days := []churnDay{}
+	for rd.Next() {
+		var d churnDay
+		day, _ := schema.Read(rd, rowbinary.Int64)
+		d.New, _ = schema.Read(rd, rowbinary.UInt64)
+		d.Gone, _ = schema.Read(rd, rowbinary.UInt64)
+		if rd.Err() != nil {
+			break
+		}
+		d.Timestamp = day * dayMs / 1000
+		d.Date = time.UnixMilli(day * dayMs).UTC().Format(time.DateOnly)
+		days = append(days, d)
+	}
+	if rd.Err() != nil {
+		writeAPIError(w, rd.Err())
+		return
+	}
+
+	writeAPIResponse(w, days)
+}
@@ -0,0 +1,109 @@
+package prom
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pluto-metrics/rowbinary"
+	"github.com/pluto-metrics/rowbinary/schema"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestPlutoAPI(t *testing.T) (http.Handler, *fakeClickHouse) {
+	ch := newFakeClickHouse(t, func(w io.Writer, qq string) {
+		switch {
+		case strings.Contains(qq, "ARRAY JOIN [intDiv"):
+			wr := schema.NewWriter(w).Format(schema.RowBinary).
+				Column("d", rowbinary.Int64).Column("n", rowbinary.UInt64).Column("g", rowbinary.UInt64)
+			assert.NoError(t, wr.WriteValues(int64(20000), uint64(3), uint64(1)))
+			assert.NoError(t, wr.WriteValues(int64(20001), uint64(5), uint64(0)))
+		case strings.Contains(qq, "mapKeys"):
+			wr := schema.NewWriter(w).Format(schema.RowBinary).
+				Column("k", rowbinary.String).Column("v", rowbinary.UInt64).Column("c", rowbinary.UInt64)
+			assert.NoError(t, wr.WriteValues("instance", uint64(4), uint64(8)))
+		default:
+			wr := schema.NewWriter(w).Format(schema.RowBinary).
+				Column("k", rowbinary.String).Column("c", rowbinary.UInt64)
+			switch {
+			case strings.Contains(qq, "'series'"):
+				assert.NoError(t, wr.WriteValues("series", uint64(8)))
+			case strings.Contains(qq, "GROUP BY name"):
+				assert.NoError(t, wr.WriteValues("up", uint64(8)))
+			case strings.Contains(qq, "GROUP BY v"):
+				assert.NoError(t, wr.WriteValues("node", uint64(6)))
+			}
+		}
+	})
+
+	cfg := ch.config()
+	cfg.Select.TableSeries = "series"
+	cfg.Select.AutocompleteLookback = 24 * time.Hour
+	return newPlutoAPI(cfg), ch
+}
+
+func TestCardinalityAPI(t *testing.T) {
+	api, ch := newTestPlutoAPI(t)
+
+	rec := httptest.NewRecorder()
+	api.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/cardinality?match[]=up{job=\"node\"}&label=job&limit=5", nil))
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	var resp struct {
+		Status string          `json:"status"`
+		Data   cardinalityData `json:"data"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Equal(t, "success", resp.Status)
+	assert.Equal(t, cardinalityData{
+		Series:  8,
+		Metrics: []cardinalityStat{{Name: "up", Series: 8}},
+		Labels:  []labelCardinality{{Name: "instance", Values: 4, Series: 8}},
+		Values:  []cardinalityStat{{Name: "node", Series: 6}},
+	}, resp.Data)
+
+	queries := ch.received()
+	require.Len(t, queries, 4)
+	for _, qq := range queries {
+		assert.Contains(t, qq, "'node'")
+	}
+	assert.Contains(t, queries[1], "LIMIT 5")
+}
+
+func TestCardinalityAPIBadRequest(t *testing.T) {
+	api, ch := newTestPlutoAPI(t)
+
+	for _, u := range []string{"/cardinality?match[]=up{", "/cardinality?limit=0", "/churn?start=2&end=1"} {
+		rec := httptest.NewRecorder()
+		api.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, u, nil))
+		assert.Equal(t, http.StatusBadRequest, rec.Code, u)
+		assert.Contains(t, rec.Body.String(), "bad_data", u)
+	}
+	assert.Empty(t, ch.received())
+}
+
+func TestChurnAPI(t *testing.T) {
+	api, ch := newTestPlutoAPI(t)
+
+	rec := httptest.NewRecorder()
+	api.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/churn?start=1728000000&end=1728086400", nil))
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	var resp struct {
+		Data []churnDay `json:"data"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Equal(t, []churnDay{
+		{Date: "2024-10-04", Timestamp: 1728000000, New: 3, Gone: 1},
+		{Date: "2024-10-05", Timestamp: 1728086400, New: 5, Gone: 0},
+	}, resp.Data)
+
+	queries := ch.received()
+	require.Len(t, queries, 1)
+	assert.Contains(t, queries[0], "d >= 20000 AND d <= 20001")
+}
@@ -0,0 +1,52 @@
+package prom
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/pluto-metrics/pluto/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeClickHouse records queries and answers them with respond. respond runs in the server goroutine,
+// so it must report failures with assert instead of require
+type fakeClickHouse struct {
+	sync.Mutex
+	srv     *httptest.Server
+	queries []string
+}
+
+func newFakeClickHouse(t *testing.T, respond func(w io.Writer, qq string)) *fakeClickHouse {
+	ch := &fakeClickHouse{}
+	ch.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		assert.NoError(t, err)
+		ch.Lock()
+		ch.queries = append(ch.queries, string(body))
+		ch.Unlock()
+		respond(w, string(body))
+	}))
+	t.Cleanup(ch.srv.Close)
+	return ch
+}
+
+func (ch *fakeClickHouse) received() []string {
+	ch.Lock()
+	defer ch.Unlock()
+	return append([]string{}, ch.queries...)
+}
+
+func (ch *fakeClickHouse) config() *config.Config {
+	cfg := &config.Config{}
+	cfg.ClickHouse.DSN = ch.srv.URL
+	return cfg
+}
+
+func (ch *fakeClickHouse) reset() {
+	ch.Lock()
+	defer ch.Unlock()
+	ch.queries = nil
+}
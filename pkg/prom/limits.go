@@ -0,0 +1,41 @@
+package prom
+
+import (
+	"io"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/pluto-metrics/pluto/pkg/errs"
+)
+
+// limitError is returned to the API client as execution error with the name of the limit
+func limitError(name string, limit interface{}) error {
+	return errs.NewErrorfWithCode(http.StatusUnprocessableEntity, "query limit exceeded: %s=%v", name, limit)
+}
+
+// limitedReader fails if more than max bytes are read by all readers sharing the counter. Zero max is no limit
+type limitedReader struct {
+	r    io.Reader
+	read *atomic.Int64
+	max  int64
+}
+
+func newLimitedReader(r io.Reader, max int64) io.Reader {
+	return newSharedLimitedReader(r, max, new(atomic.Int64))
+}
+
+// newSharedLimitedReader applies the limit to the sum of responses counted by read, e.g. all slices of the selector
+func newSharedLimitedReader(r io.Reader, max int64, read *atomic.Int64) io.Reader {
+	if max <= 0 {
+		return r
+	}
+	return &limitedReader{r: r, read: read, max: max}
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	if l.read.Add(int64(n)) > l.max {
+		return n, limitError("max_result_bytes", l.max)
+	}
+	return n, err
+}
@@ -0,0 +1,69 @@
+package prom
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/pluto-metrics/pluto/pkg/errs"
+	"github.com/pluto-metrics/rowbinary"
+	"github.com/pluto-metrics/rowbinary/schema"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLimitedReader(t *testing.T) {
+	body, err := io.ReadAll(newLimitedReader(strings.NewReader("0123456789"), 10))
+	require.NoError(t, err)
+	assert.Equal(t, "0123456789", string(body))
+
+	_, err = io.ReadAll(newLimitedReader(strings.NewReader("0123456789"), 9))
+	var codeErr errs.ErrorWithCode
+	require.ErrorAs(t, err, &codeErr)
+	assert.Equal(t, "query limit exceeded: max_result_bytes=9", codeErr.Error())
+}
+
+func TestSharedLimitedReader(t *testing.T) {
+	var read atomic.Int64
+	_, err := io.ReadAll(newSharedLimitedReader(strings.NewReader("01234"), 9, &read))
+	require.NoError(t, err)
+
+	// the second response exceeds the limit of both
+	_, err = io.ReadAll(newSharedLimitedReader(strings.NewReader("56789"), 9, &read))
+	assert.EqualError(t, err, "query limit exceeded: max_result_bytes=9")
+}
+
+func TestStreamSeriesSetMaxSamples(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := schema.NewWriter(buf).
+		Format(schema.RowBinary).
+		Column("s", rowbinary.UInt32).
+		Column("timestamp", rowbinary.Int64).
+		Column("value", rowbinary.Float64)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, w.WriteValues(uint32(i), int64(1000), float64(i)))
+	}
+
+	closer := &closeCounter{}
+	r, readRow := samplesReader(buf, true, false)
+	ss := &streamSeriesSet{
+		ctx:        context.Background(),
+		labels:     []labels.Labels{labels.FromStrings("job", "a"), labels.FromStrings("job", "b"), labels.FromStrings("job", "c")},
+		reader:     r,
+		readRow:    readRow,
+		closer:     closer,
+		maxSamples: 2,
+	}
+
+	n := 0
+	for ss.Next() {
+		n++
+	}
+	assert.Equal(t, 2, n)
+	assert.EqualError(t, ss.Err(), "query limit exceeded: max_samples=2")
+	assert.Equal(t, 1, closer.closed)
+}
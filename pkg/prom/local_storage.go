@@ -5,28 +5,31 @@ import (
 
 	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/tsdb"
-	"github.com/prometheus/prometheus/tsdb/index"
 	"github.com/prometheus/prometheus/web"
 )
 
 var _ web.LocalStorage = &storageImpl{}
 
+// CleanTombstones does nothing, rows deleted by ClickHouse are removed from disk by merges
 func (s *storageImpl) CleanTombstones() error {
 	return nil
 }
 
+// Delete deletes samples of matched series within [mint, maxt] from all series and samples tables, see deleteWhere
 func (s *storageImpl) Delete(ctx context.Context, mint, maxt int64, ms ...*labels.Matcher) error {
-	return nil
+	q := &Querier{config: s.config, mint: mint, maxt: maxt}
+	_, err := q.deleteSeries(ctx, mint, maxt, ms, false)
+	return err
 }
 
+// Snapshot starts ClickHouse BACKUP of all storage tables, see storageImpl.snapshot. There is no head block
 func (s *storageImpl) Snapshot(dir string, withHead bool) error {
-	return nil
+	return s.snapshot(context.Background(), dir)
 }
 
+// Stats returns cardinality statistics of the series table, see tsdbStats
 func (s *storageImpl) Stats(statsByLabelName string, limit int) (*tsdb.Stats, error) {
-	return &tsdb.Stats{
-		IndexPostingStats: &index.PostingsStats{},
-	}, nil
+	return s.stats.get(limit)
 }
 
 func (s *storageImpl) WALReplayStatus() (tsdb.WALReplayStatus, error) {
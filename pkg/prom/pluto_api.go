@@ -0,0 +1,132 @@
+package prom
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/pluto-metrics/pluto/pkg/config"
+	"github.com/pluto-metrics/pluto/pkg/errs"
+	"github.com/pluto-metrics/pluto/pkg/lg"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// plutoAPI serves pluto specific endpoints under /api/v1/pluto/ in the format of prometheus API
+type plutoAPI struct {
+	config *config.Config
+	mux    *http.ServeMux
+}
+
+func newPlutoAPI(cfg *config.Config) http.Handler {
+	api := &plutoAPI{config: cfg, mux: http.NewServeMux()}
+	api.mux.HandleFunc("/cardinality", api.cardinality)
+	api.mux.HandleFunc("/churn", api.churn)
+	if cfg.Prometheus.Admin.Enabled {
+		api.mux.HandleFunc("/admin/delete_series", api.deleteSeriesHandler)
+		// deletion is scoped by tenant, the rest is not
+		api.mux.Handle("/admin/mutations", requireUnbound(http.HandlerFunc(api.mutations)))
+		api.mux.Handle("/admin/backups", requireUnbound(http.HandlerFunc(api.backups)))
+		api.mux.Handle("/admin/restore", requireUnbound(http.HandlerFunc(api.restore)))
+	}
+	return api
+}
+
+func (api *plutoAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	api.mux.ServeHTTP(w, r)
+}
+
+func (api *plutoAPI) querier() *Querier {
+	return &Querier{config: api.config}
+}
+
+func writeAPIResponse(w http.ResponseWriter, data interface{}) {
+	body, err := json.Marshal(map[string]interface{}{
+		"status": "success",
+		"data":   data,
+	})
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// writeAPIError responds with code of errs.ErrorWithCode or 500
+func writeAPIError(w http.ResponseWriter, err error) {
+	code := http.StatusInternalServerError
+	errorType := "internal"
+	var errWithCode errs.ErrorWithCode
+	if errors.As(err, &errWithCode) {
+		code = errWithCode.Code
+		if code == http.StatusBadRequest {
+			errorType = "bad_data"
+		}
+	}
+	if code == http.StatusInternalServerError {
+		slog.Error("pluto api request failed", lg.Error(err))
+	}
+
+	body, _ := json.Marshal(map[string]string{
+		"status":    "error",
+		"errorType": errorType,
+		"error":     err.Error(),
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(body)
+}
+
+func badData(err error) error {
+	return errs.NewErrorWithCode(err.Error(), http.StatusBadRequest)
+}
+
+// parseMatchers parses match[] parameters
+func parseMatchers(r *http.Request) ([][]*labels.Matcher, error) {
+	var ret [][]*labels.Matcher
+	for _, s := range r.Form["match[]"] {
+		matchers, err := parser.ParseMetricSelector(s)
+		if err != nil {
+			return nil, badData(err)
+		}
+		ret = append(ret, matchers)
+	}
+	return ret, nil
+}
+
+// parseTimeRange returns start and end parameters in milliseconds, end defaults to now and start to end-lookback
+func parseTimeRange(r *http.Request, lookback int64) (int64, int64, error) {
+	end := timeNow().UnixMilli()
+	if s := r.FormValue("end"); s != "" {
+		var err error
+		if end, err = parseTimestamp(s); err != nil {
+			return 0, 0, badData(err)
+		}
+	}
+	start := end - lookback
+	if s := r.FormValue("start"); s != "" {
+		var err error
+		if start, err = parseTimestamp(s); err != nil {
+			return 0, 0, badData(err)
+		}
+	}
+	if start > end {
+		return 0, 0, errs.NewErrorWithCode("end timestamp must not be before start time", http.StatusBadRequest)
+	}
+	return start, end, nil
+}
+
+func parseLimit(r *http.Request, def int) (int, error) {
+	s := r.FormValue("limit")
+	if s == "" {
+		return def, nil
+	}
+	limit, err := strconv.Atoi(s)
+	if err != nil || limit < 1 {
+		return 0, errs.NewErrorWithCode("limit must be a positive number", http.StatusBadRequest)
+	}
+	return limit, nil
+}
@@ -32,7 +32,9 @@ import (
 	api_v1 "github.com/prometheus/prometheus/web/api/v1"
 	"github.com/prometheus/prometheus/web/ui"
 
+	"github.com/pluto-metrics/pluto/pkg/auth"
 	"github.com/pluto-metrics/pluto/pkg/config"
+	"github.com/pluto-metrics/pluto/pkg/tenant"
 	uiStatic "github.com/pluto-metrics/prometheus-ui-static"
 	"github.com/prometheus/common/assets"
 )
@@ -60,6 +62,7 @@ type Prom struct {
 	apiV1       *api_v1.API
 	router      *route.Router
 	routePrefix string
+	auth        *auth.Auth
 }
 
 // New init prometheus server
@@ -75,24 +78,32 @@ func New(ctx context.Context, config *config.Config) (*Prom, error) {
 		routePrefix: routePrefix,
 	}
 
+	var err error
+	p.auth, err = auth.New(config.Prometheus.Auth)
+	if err != nil {
+		return nil, err
+	}
+
 	// use precompiled static from github.com/lomik/prometheus-ui-static
 	ui.Assets = http.FS(assets.New(uiStatic.EmbedFS))
 
 	promLogger := slog.Default()
 
 	storage := newStorage(config)
+	go storage.stats.run(ctx)
 
 	corsOrigin, err := regexp.Compile("^$")
 	if err != nil {
 		return nil, err
 	}
 
-	queryEngine := promql.NewEngine(promql.EngineOpts{
+	// legs of sharded aggregations are pushed down too
+	queryEngine := newShardingEngine(newPushdownEngine(newRangeReduceEngine(promql.NewEngine(promql.EngineOpts{
 		Logger:        promLogger,
-		Timeout:       time.Minute,
-		MaxSamples:    50000000,
+		Timeout:       config.Prometheus.QueryTimeout,
+		MaxSamples:    config.Prometheus.QueryMaxSamples,
 		LookbackDelta: config.Prometheus.LookbackDelta,
-	})
+	}), config), config), config)
 
 	scrapeManager, err := scrape.NewManager(
 		&scrape.Options{},
@@ -138,18 +149,18 @@ func New(ctx context.Context, config *config.Config) (*Prom, error) {
 		func(hf http.HandlerFunc) http.HandlerFunc {
 			return hf
 		}, // h.testReady
-		storage,    // h.options.LocalStorage
-		"",         // h.options.TSDBDir
-		false,      // h.options.EnableAdminAPI
-		promLogger, // logger
+		storage,                         // h.options.LocalStorage
+		"",                              // h.options.TSDBDir
+		config.Prometheus.Admin.Enabled, // h.options.EnableAdminAPI
+		promLogger,                      // logger
 		func(_ context.Context) api_v1.RulesRetriever { return rulesManager }, // FactoryRr
-		0,                           // h.options.RemoteReadSampleLimit
-		0,                           // h.options.RemoteReadConcurrencyLimit
-		0,                           // h.options.RemoteReadBytesInFrame
-		false,                       // h.options.IsAgent
-		corsOrigin,                  // h.options.CORSOrigin
-		p.runtimeInfo,               // h.runtimeInfo
-		&api_v1.PrometheusVersion{}, // h.versionInfo
+		config.Prometheus.RemoteReadSampleLimit,                               // h.options.RemoteReadSampleLimit
+		config.Prometheus.RemoteReadConcurrencyLimit,                          // h.options.RemoteReadConcurrencyLimit
+		config.Prometheus.RemoteReadBytesInFrame,                              // h.options.RemoteReadBytesInFrame
+		false,                                                                 // h.options.IsAgent
+		corsOrigin,                                                            // h.options.CORSOrigin
+		p.runtimeInfo,                                                         // h.runtimeInfo
+		&api_v1.PrometheusVersion{},                                           // h.versionInfo
 		func() []notifications.Notification {
 			return nil
 		}, // h.options.NotificationsGetter
@@ -306,7 +317,7 @@ func (p *Prom) version(w http.ResponseWriter, _ *http.Request) {
 
 // Register ...
 func (p *Prom) Register(mux *http.ServeMux) {
-	mux.Handle("/", p.router)
+	mux.Handle("/", p.auth.Handler(auth.PermissionRead, p.router))
 
 	// register api
 	apiPath := p.withPrefix("/api")
@@ -315,7 +326,15 @@ func (p *Prom) Register(mux *http.ServeMux) {
 	av1 := route.New()
 	p.apiV1.Register(av1)
 
-	mux.Handle(joinPrefix(apiPath, "/v1/"), http.StripPrefix(joinPrefix(apiPath, "/v1"), av1))
+	plutoAPI := http.StripPrefix(joinPrefix(apiPath, "/v1/pluto"), newPlutoAPI(&p.config))
+
+	// admin endpoints require admin permission
+	mux.Handle(joinPrefix(apiPath, "/v1/admin/"), p.auth.Handler(auth.PermissionAdmin, tenant.NewHandler(&p.config, http.StripPrefix(joinPrefix(apiPath, "/v1"), av1))))
+	// backup of all tenants
+	mux.Handle(joinPrefix(apiPath, "/v1/admin/tsdb/snapshot"), p.auth.Handler(auth.PermissionAdmin, requireUnbound(tenant.NewHandler(&p.config, http.StripPrefix(joinPrefix(apiPath, "/v1"), av1)))))
+	mux.Handle(joinPrefix(apiPath, "/v1/pluto/admin/"), p.auth.Handler(auth.PermissionAdmin, tenant.NewHandler(&p.config, plutoAPI)))
+	mux.Handle(joinPrefix(apiPath, "/v1/pluto/"), p.auth.Handler(auth.PermissionRead, tenant.NewHandler(&p.config, plutoAPI)))
+	mux.Handle(joinPrefix(apiPath, "/v1/"), p.auth.Handler(auth.PermissionRead, tenant.NewHandler(&p.config, rawSamplesHandler(newResultsCache(&p.config, http.StripPrefix(joinPrefix(apiPath, "/v1"), av1))))))
 }
 
 func (p *Prom) withPrefix(path string) string {
@@ -0,0 +1,454 @@
+package prom
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pluto-metrics/pluto/pkg/config"
+	"github.com/pluto-metrics/pluto/pkg/errs"
+	"github.com/pluto-metrics/pluto/pkg/lg"
+	"github.com/pluto-metrics/pluto/pkg/sql"
+	"github.com/pluto-metrics/rowbinary"
+	"github.com/pluto-metrics/rowbinary/schema"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/value"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/prometheus/prometheus/storage"
+)
+
+// pushdownLabel is added to the selector of rewritten aggregation. The value is the original operation,
+// for functions of range selectors "operation:function:range in milliseconds"
+const pushdownLabel = "__pluto_pushdown__"
+
+// aggregations of evaluated instant vectors, v is the value of one series at the timestamp
+var pushdownAggregates = map[string]string{
+	"sum":   "sum(v)",
+	"count": "toFloat64(count())",
+	// NaN is returned only if all values are NaN as in promql
+	"min": "if(countIf(NOT isNaN(v)) = 0, nan, minIf(v, NOT isNaN(v)))",
+	"max": "if(countIf(NOT isNaN(v)) = 0, nan, maxIf(v, NOT isNaN(v)))",
+}
+
+// functions of range selectors, val is the value of one sample in the range.
+// rate, increase and other functions depending on the order of samples are evaluated by the engine
+var pushdownFunctions = map[string]string{
+	"sum_over_time":   "sum(val)",
+	"count_over_time": "toFloat64(count())",
+	"min_over_time":   "if(countIf(NOT isNaN(val)) = 0, nan, minIf(val, NOT isNaN(val)))",
+	"max_over_time":   "if(countIf(NOT isNaN(val)) = 0, nan, maxIf(val, NOT isNaN(val)))",
+}
+
+// pushdownMarker is the aggregation marked by pushdownEngine. fn and window are set for functions of range selectors
+type pushdownMarker struct {
+	op     string
+	fn     string
+	window int64
+}
+
+// pushdownEngine rewrites queries before passing them to the engine.
+// Selectors of eligible aggregations are marked and Select returns pre-aggregated series with grouping labels only.
+// The engine still evaluates the aggregation over them, count is replaced with sum of counts.
+// Functions of range selectors are replaced with the marked instant selector:
+//
+//	sum by (job) (sum_over_time(x[5m])) => sum by (job) (x{__pluto_pushdown__="sum:sum_over_time:300000"})
+type pushdownEngine struct {
+	promql.QueryEngine
+	lookbackDelta time.Duration
+}
+
+var _ promql.QueryEngine = &pushdownEngine{}
+
+func newPushdownEngine(engine promql.QueryEngine, cfg *config.Config) promql.QueryEngine {
+	if !cfg.Prometheus.AggregationPushdown {
+		return engine
+	}
+	return &pushdownEngine{QueryEngine: engine, lookbackDelta: lookbackDelta(cfg)}
+}
+
+// NewInstantQuery implements promql.QueryEngine.
+func (e *pushdownEngine) NewInstantQuery(ctx context.Context, q storage.Queryable, opts promql.QueryOpts, qs string, ts time.Time) (promql.Query, error) {
+	return e.QueryEngine.NewInstantQuery(ctx, q, opts, e.rewrite(qs, opts), ts)
+}
+
+// NewRangeQuery implements promql.QueryEngine.
+func (e *pushdownEngine) NewRangeQuery(ctx context.Context, q storage.Queryable, opts promql.QueryOpts, qs string, start, end time.Time, interval time.Duration) (promql.Query, error) {
+	return e.QueryEngine.NewRangeQuery(ctx, q, opts, e.rewrite(qs, opts), start, end, interval)
+}
+
+// rewrite returns the original query if nothing can be pushed down or the query is invalid
+func (e *pushdownEngine) rewrite(qs string, opts promql.QueryOpts) string {
+	// Select restores evaluation timestamps with the default lookback delta
+	if opts != nil && opts.LookbackDelta() != 0 && opts.LookbackDelta() != e.lookbackDelta {
+		return qs
+	}
+	expr, err := parser.ParseExpr(qs)
+	if err != nil {
+		return qs
+	}
+	if !pushdownRewrite(expr) {
+		return qs
+	}
+	return expr.String()
+}
+
+// pushdownRewrite marks selectors of eligible aggregations. Returns false if nothing is changed
+func pushdownRewrite(expr parser.Expr) bool {
+	changed := false
+	parser.Inspect(expr, func(node parser.Node, path []parser.Node) error {
+		n, ok := node.(*parser.AggregateExpr)
+		if !ok {
+			return nil
+		}
+		// evaluation timestamps of subqueries are aligned differently
+		for _, p := range path {
+			if _, ok := p.(*parser.SubqueryExpr); ok {
+				return nil
+			}
+		}
+		vs, call := pushdownSelector(n)
+		if vs == nil {
+			return nil
+		}
+		op := n.Op.String()
+		if call != nil {
+			ms := call.Args[0].(*parser.MatrixSelector)
+			op += ":" + call.Func.Name + ":" + strconv.FormatInt(ms.Range.Milliseconds(), 10)
+			n.Expr = vs
+		}
+		vs.LabelMatchers = append(vs.LabelMatchers, labels.MustNewMatcher(labels.MatchEqual, pushdownLabel, op))
+		if n.Op == parser.COUNT {
+			n.Op = parser.SUM
+		}
+		changed = true
+		return nil
+	})
+	return changed
+}
+
+// pushdownSelector returns the selector if the aggregation can be computed by ClickHouse.
+// call is not nil if the aggregation is over a function of the range selector
+func pushdownSelector(n *parser.AggregateExpr) (*parser.VectorSelector, *parser.Call) {
+	if n.Without || n.Param != nil {
+		return nil, nil
+	}
+	switch n.Op {
+	case parser.SUM, parser.MIN, parser.MAX, parser.COUNT:
+	default:
+		return nil, nil
+	}
+
+	e := n.Expr
+	for {
+		p, ok := e.(*parser.ParenExpr)
+		if !ok {
+			break
+		}
+		e = p.Expr
+	}
+
+	var call *parser.Call
+	if c, ok := e.(*parser.Call); ok {
+		if _, ok := pushdownFunctions[c.Func.Name]; !ok {
+			return nil, nil
+		}
+		ms, ok := c.Args[0].(*parser.MatrixSelector)
+		if !ok {
+			return nil, nil
+		}
+		call = c
+		e = ms.VectorSelector
+	}
+
+	vs, ok := e.(*parser.VectorSelector)
+	if !ok || vs.Timestamp != nil || vs.StartOrEnd != 0 {
+		return nil, nil
+	}
+	for _, m := range vs.LabelMatchers {
+		if m.Name == pushdownLabel {
+			return nil, nil
+		}
+	}
+	return vs, call
+}
+
+// pushdownOp extracts the operation marked by pushdownEngine and checks it against hints
+func pushdownOp(hints *storage.SelectHints, matchers []*labels.Matcher) (pushdownMarker, []*labels.Matcher, error) {
+	marker := ""
+	ret := make([]*labels.Matcher, 0, len(matchers))
+	for _, m := range matchers {
+		if m.Name == pushdownLabel {
+			marker = m.Value
+			continue
+		}
+		ret = append(ret, m)
+	}
+	if marker == "" {
+		return pushdownMarker{}, matchers, nil
+	}
+
+	invalid := errs.NewErrorWithCode("unexpected "+pushdownLabel+" matcher", http.StatusBadRequest)
+	p := pushdownMarker{op: marker}
+	if parts := strings.Split(marker, ":"); len(parts) == 3 {
+		window, err := strconv.ParseInt(parts[2], 10, 64)
+		if _, ok := pushdownFunctions[parts[1]]; !ok || err != nil || window <= 0 {
+			return pushdownMarker{}, nil, invalid
+		}
+		p = pushdownMarker{op: parts[0], fn: parts[1], window: window}
+	}
+
+	aggregation := p.op
+	if p.op == "count" {
+		aggregation = "sum"
+	}
+	if _, ok := pushdownAggregates[p.op]; !ok || hints == nil || hints.Func != aggregation || !hints.By || hints.Range != 0 {
+		return pushdownMarker{}, nil, invalid
+	}
+	return p, ret, nil
+}
+
+// pushdownHints moves the start of hints of the rewritten function from the lookback delta
+// to the range of the first evaluation timestamp, so series and samples of the whole range are selected
+func pushdownHints(hints *storage.SelectHints, p pushdownMarker, lookback int64) *storage.SelectHints {
+	if p.fn == "" {
+		return hints
+	}
+	ret := *hints
+	ret.Start = hints.Start + lookback - p.window
+	return &ret
+}
+
+func lookbackDelta(cfg *config.Config) time.Duration {
+	if cfg.Prometheus.LookbackDelta == 0 {
+		// default of promql engine
+		return 5 * time.Minute
+	}
+	return cfg.Prometheus.LookbackDelta
+}
+
+// selectPushdown returns series with grouping labels and aggregated values at evaluation timestamps
+func (q *Querier) selectPushdown(ctx context.Context, p pushdownMarker, hints *storage.SelectHints, seriesMap map[string]labels.Labels, samplesCfg *config.ConfigSamples, limits config.QueryLimits) storage.SeriesSet {
+	lookback := lookbackDelta(q.config).Milliseconds()
+	step := hints.Step
+	if step == 0 {
+		// instant query, the only evaluation timestamp is the end
+		step = lookback
+	}
+	// samples of evaluation timestamp t are in (t - window, t], see pushdownHints
+	window := lookback
+	if p.fn != "" {
+		window = p.window
+	}
+	// evaluation timestamps are first + k*step <= end
+	first := hints.Start + window - 1
+	// timestamp of the grid before all samples, intDiv rounds negative values towards zero
+	base := first - (window/step+1)*step
+
+	timestampDiv := int64(1)
+	timestamp := "timestamp"
+	if samplesCfg.SamplesTimestampUInt32 {
+		timestampDiv = 1000
+		timestamp = "toInt64(timestamp)*1000"
+	}
+
+	// series with the same labels are merged as in regular select
+	type idRow struct {
+		id     string
+		series uint32
+		group  uint32
+	}
+	rows := make([]idRow, 0, len(seriesMap))
+	uniq := make(map[string]uint32)
+	groups := make(map[string]uint32)
+	var data []series
+	for id, lb := range seriesMap {
+		s, ok := uniq[labelsMapKey(lb)]
+		if !ok {
+			s = uint32(len(uniq))
+			uniq[labelsMapKey(lb)] = s
+		}
+		gl := lb.MatchLabels(true, hints.Grouping...)
+		g, ok := groups[labelsMapKey(gl)]
+		if !ok {
+			g = uint32(len(data))
+			groups[labelsMapKey(gl)] = g
+			data = append(data, series{labels: gl})
+		}
+		rows = append(rows, idRow{id: id, series: s, group: g})
+	}
+
+	params := map[string]interface{}{
+		"stale_nan":   value.StaleNaN,
+		"timestamp":   timestamp,
+		"aggregate":   pushdownAggregates[p.op],
+		"function":    pushdownFunctions[p.fn],
+		"table":       samplesCfg.Table,
+		"base":        base,
+		"step":        step,
+		"window":      window,
+		"end":         hints.End,
+		"start_table": hints.Start / timestampDiv,
+		"end_table":   watermarkEnd(ctx, hints.End) / timestampDiv,
+	}
+
+	// every sample is the value of the series at evaluation timestamps [ts, ts+window).
+	// The latest sample wins, series with the staleness marker are skipped
+	tmpl := `
+		WITH reinterpretAsUInt64(value) = {{.stale_nan}} AS stale,
+			{{.timestamp}} AS ts
+		SELECT g, t, {{.aggregate}}
+		FROM (
+			SELECT s, g, t, argMax(value, ts) AS v, argMax(stale, ts) AS last_stale
+			FROM {{.table}}
+			ARRAY JOIN range(
+				toUInt64({{.base}} + intDiv(ts - {{.base}} + {{.step}} - 1, {{.step}}) * {{.step}}),
+				toUInt64(least(ts + {{.window}} - 1, {{.end}}) + 1),
+				toUInt64({{.step}})
+			) AS t
+			INNER JOIN ids USING id
+			WHERE id IN (SELECT id FROM ids)
+				AND timestamp >= {{.start_table|quote}}
+				AND timestamp <= {{.end_table|quote}}
+			GROUP BY s, g, t
+			HAVING NOT last_stale
+		)
+		GROUP BY g, t
+		FORMAT RowBinary
+	`
+	if p.fn != "" {
+		// every sample is in the range of evaluation timestamps [ts, ts+window), the value of the series is
+		// the function of its samples. Duplicates are merged as in regular select, staleness markers are skipped as by the engine
+		tmpl = `
+			SELECT g, t, {{.aggregate}}
+			FROM (
+				SELECT s, g, t, {{.function}} AS v
+				FROM (
+					SELECT s, g, {{.timestamp}} AS ts, max(value) AS val
+					FROM {{.table}}
+					INNER JOIN ids USING id
+					WHERE id IN (SELECT id FROM ids)
+						AND timestamp >= {{.start_table|quote}}
+						AND timestamp <= {{.end_table|quote}}
+					GROUP BY s, g, ts
+					HAVING reinterpretAsUInt64(val) != {{.stale_nan}}
+				)
+				ARRAY JOIN range(
+					toUInt64({{.base}} + intDiv(ts - {{.base}} + {{.step}} - 1, {{.step}}) * {{.step}}),
+					toUInt64(least(ts + {{.window}} - 1, {{.end}}) + 1),
+					toUInt64({{.step}})
+				) AS t
+				GROUP BY s, g, t
+			)
+			GROUP BY g, t
+			FORMAT RowBinary
+		`
+	}
+	qq, err := sql.Template(tmpl, params)
+	if err != nil {
+		slog.ErrorContext(ctx, "can't create request to clickhouse", lg.Error(err))
+		return errorSeriesSet(err)
+	}
+
+	chRequest, err := q.requestWithIDs(ctx, samplesCfg.ClickHouse, qq, "id String, s UInt32, g UInt32", func(w io.Writer) error {
+		schemaWriter := schema.NewWriter(w).
+			Format(schema.RowBinary).
+			Column("id", rowbinary.String).
+			Column("s", rowbinary.UInt32).
+			Column("g", rowbinary.UInt32)
+
+		for _, r := range rows {
+			if err := schemaWriter.WriteValues(r.id, r.series, r.group); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return errorSeriesSet(err)
+	}
+	defer chRequest.Close()
+
+	chResponse, err := chRequest.Finish()
+	if err != nil {
+		if !errors.Is(err, context.Canceled) {
+			slog.ErrorContext(ctx, "can't finish request to clickhouse", lg.Error(err))
+		}
+		return errorSeriesSet(err)
+	}
+	defer chResponse.Close()
+
+	r := schema.NewReader(bufio.NewReader(newLimitedReader(chResponse, limits.MaxResultBytes))).
+		Format(schema.RowBinary).
+		Column(rowbinary.UInt32). // group
+		Column(rowbinary.UInt64). // evaluation timestamp
+		Column(rowbinary.Float64) // value
+
+	fetched := 0
+	for r.Next() {
+		g, _ := schema.Read(r, rowbinary.UInt32)
+		t, _ := schema.Read(r, rowbinary.UInt64)
+		v, _ := schema.Read(r, rowbinary.Float64)
+		if r.Err() != nil {
+			break
+		}
+		fetched++
+		if limits.MaxSamples > 0 && fetched > limits.MaxSamples {
+			return errorSeriesSet(limitError("max_samples", limits.MaxSamples))
+		}
+		if int(g) < len(data) {
+			data[g].sampleAppend(int64(t), v)
+		}
+	}
+	if r.Err() != nil {
+		slog.ErrorContext(ctx, "can't read response from clickhouse", lg.Error(r.Err()))
+		return errorSeriesSet(r.Err())
+	}
+
+	ret := make([]series, 0, len(data))
+	for _, s := range data {
+		if len(s.samples) == 0 {
+			continue
+		}
+		s.samples = fillStale(s.samples, step, hints.End)
+		ret = append(ret, s)
+	}
+
+	ss, err := makeSeriesSet(ret)
+	if err != nil {
+		slog.ErrorContext(ctx, "can't make series", lg.Error(err))
+		return errorSeriesSet(err)
+	}
+	return ss
+}
+
+// fillStale adds staleness markers at evaluation timestamps where the group has no value.
+// Otherwise the engine would take the previous pre-aggregated sample from the lookback window
+func fillStale(samples []sample, step int64, end int64) []sample {
+	sort.Slice(samples, func(i, j int) bool {
+		return samples[i].timestamp < samples[j].timestamp
+	})
+	stale := math.Float64frombits(value.StaleNaN)
+
+	ret := make([]sample, 0, len(samples))
+	for i := 0; i < len(samples); i++ {
+		ret = append(ret, samples[i])
+		next := samples[i].timestamp + step
+		if next > end {
+			continue
+		}
+		if i+1 < len(samples) && samples[i+1].timestamp == next {
+			continue
+		}
+		ret = append(ret, sample{timestamp: next, value: stale})
+	}
+	return ret
+}
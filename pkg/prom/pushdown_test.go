@@ -0,0 +1,116 @@
+package prom
+
+import (
+	"math"
+	"testing"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/value"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPushdownRewrite(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string // empty if not changed
+	}{
+		{`sum by (job) (up)`, `sum by (job) (up{__pluto_pushdown__="sum"})`},
+		{`count(up{job="a"})`, `sum(up{__pluto_pushdown__="count",job="a"})`},
+		{`max by (job) ((up offset 5m)) / 2`, `max by (job) ((up{__pluto_pushdown__="max"} offset 5m)) / 2`},
+		{`min by (job) (up) + sum(x)`, `min by (job) (up{__pluto_pushdown__="min"}) + sum(x{__pluto_pushdown__="sum"})`},
+		{`sum by (job) (sum_over_time(x[5m]))`, `sum by (job) (x{__pluto_pushdown__="sum:sum_over_time:300000"})`},
+		{`count(max_over_time(x{job="a"}[1m] offset 5m))`, `sum(x{__pluto_pushdown__="count:max_over_time:60000",job="a"} offset 5m)`},
+		{`max by (job) ((count_over_time(x[1h])))`, `max by (job) (x{__pluto_pushdown__="max:count_over_time:3600000"})`},
+		// not eligible
+		{`sum by (job) (rate(x[5m]))`, ""},
+		{`sum by (job) (avg_over_time(x[5m]))`, ""},
+		{`sum by (job) (sum_over_time(x[5m] @ 100))`, ""},
+		{`sum by (job) (sum_over_time(rate(x[5m])[1h:1m]))`, ""},
+		{`sum without (job) (up)`, ""},
+		{`avg by (job) (up)`, ""},
+		{`topk(5, up)`, ""},
+		{`sum(up @ 100)`, ""},
+		{`max_over_time(sum by (job) (up)[1h:1m])`, ""},
+		{`up`, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			expr, err := parser.ParseExpr(tt.query)
+			require.NoError(t, err)
+			changed := pushdownRewrite(expr)
+			if tt.want == "" {
+				assert.False(t, changed)
+				return
+			}
+			assert.True(t, changed)
+			// the engine parses the result again
+			_, err = parser.ParseExpr(expr.String())
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, expr.String())
+		})
+	}
+}
+
+func TestPushdownOp(t *testing.T) {
+	up := labels.MustNewMatcher(labels.MatchEqual, "__name__", "up")
+	marker := func(op string) *labels.Matcher {
+		return labels.MustNewMatcher(labels.MatchEqual, pushdownLabel, op)
+	}
+
+	p, matchers, err := pushdownOp(&storage.SelectHints{Func: "sum", By: true}, []*labels.Matcher{up, marker("count")})
+	require.NoError(t, err)
+	assert.Equal(t, pushdownMarker{op: "count"}, p)
+	assert.Equal(t, []*labels.Matcher{up}, matchers)
+
+	p, matchers, err = pushdownOp(&storage.SelectHints{Func: "max", By: true}, []*labels.Matcher{up, marker("max:sum_over_time:300000")})
+	require.NoError(t, err)
+	assert.Equal(t, pushdownMarker{op: "max", fn: "sum_over_time", window: 300000}, p)
+	assert.Equal(t, []*labels.Matcher{up}, matchers)
+
+	p, matchers, err = pushdownOp(&storage.SelectHints{Func: "rate", Range: 300000}, []*labels.Matcher{up})
+	require.NoError(t, err)
+	assert.Equal(t, pushdownMarker{}, p)
+	assert.Equal(t, []*labels.Matcher{up}, matchers)
+
+	// marker without the rewritten aggregation
+	_, _, err = pushdownOp(&storage.SelectHints{Func: "abs"}, []*labels.Matcher{up, marker("sum")})
+	assert.Error(t, err)
+	_, _, err = pushdownOp(&storage.SelectHints{Func: "avg", By: true}, []*labels.Matcher{up, marker("avg")})
+	assert.Error(t, err)
+	_, _, err = pushdownOp(&storage.SelectHints{Func: "sum", By: true}, []*labels.Matcher{up, marker("sum:rate:300000")})
+	assert.Error(t, err)
+	_, _, err = pushdownOp(&storage.SelectHints{Func: "sum", By: true}, []*labels.Matcher{up, marker("sum:sum_over_time:0")})
+	assert.Error(t, err)
+}
+
+func TestPushdownHints(t *testing.T) {
+	// range query from 1000000 with the default lookback delta
+	hints := &storage.SelectHints{Start: 1000000 - 300000 + 1, End: 2000000, Step: 60000, Func: "sum", By: true}
+
+	assert.Same(t, hints, pushdownHints(hints, pushdownMarker{op: "sum"}, 300000))
+
+	got := pushdownHints(hints, pushdownMarker{op: "sum", fn: "sum_over_time", window: 3600000}, 300000)
+	assert.Equal(t, int64(1000000-3600000+1), got.Start)
+	assert.Equal(t, hints.End, got.End)
+	assert.Equal(t, int64(1000000-300000+1), hints.Start)
+}
+
+func TestFillStale(t *testing.T) {
+	stale := math.Float64frombits(value.StaleNaN)
+	got := fillStale([]sample{
+		{timestamp: 3000, value: 3},
+		{timestamp: 1000, value: 1},
+		{timestamp: 6000, value: 6},
+		{timestamp: 2000, value: 2},
+	}, 1000, 6000)
+
+	want := []sample{{1000, 1}, {2000, 2}, {3000, 3}, {4000, stale}, {6000, 6}}
+	require.Len(t, got, len(want))
+	for i := range want {
+		assert.Equal(t, want[i].timestamp, got[i].timestamp)
+		assert.Equal(t, math.Float64bits(want[i].value), math.Float64bits(got[i].value))
+	}
+}
@@ -1,6 +1,8 @@
 package prom
 
 import (
+	"sync"
+
 	"github.com/pluto-metrics/pluto/pkg/config"
 )
 
@@ -9,9 +11,31 @@ type Querier struct {
 	config *config.Config
 	mint   int64
 	maxt   int64
+
+	mu      sync.Mutex
+	streams []*streamSeriesSet
+	// selects of sharded legs running in background
+	prefetching sync.WaitGroup
 }
 
 // Close releases the resources of the Querier.
+// Unread responses are closed, series returned by Select must not be used after it
 func (q *Querier) Close() error {
+	q.prefetching.Wait()
+
+	q.mu.Lock()
+	streams := q.streams
+	q.streams = nil
+	q.mu.Unlock()
+
+	for _, ss := range streams {
+		ss.release()
+	}
 	return nil
 }
+
+func (q *Querier) closeOnExit(ss *streamSeriesSet) {
+	q.mu.Lock()
+	q.streams = append(q.streams, ss)
+	q.mu.Unlock()
+}
@@ -2,26 +2,43 @@ package prom
 
 import (
 	"context"
+	"net/http"
 
 	"github.com/pluto-metrics/pluto/pkg/config"
+	"github.com/pluto-metrics/pluto/pkg/errs"
 	"github.com/pluto-metrics/pluto/pkg/sql"
+	"github.com/pluto-metrics/pluto/pkg/tenant"
 	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/timestamp"
+	api_v1 "github.com/prometheus/prometheus/web/api/v1"
 )
 
-func (q *Querier) whereMatchLabels(_ context.Context, cfg config.ConfigSeries, where *sql.Where, matchers []*labels.Matcher) {
-	mp := map[string]bool{}
-	for _, v := range cfg.SeriesMaterializedLabels {
-		mp[v] = true
+// tenantMatchers restricts matchers to series of the tenant from context
+func (q *Querier) tenantMatchers(ctx context.Context, matchers []*labels.Matcher) ([]*labels.Matcher, error) {
+	if !q.config.Tenant.Enabled {
+		return matchers, nil
+	}
+
+	id := tenant.FromContext(ctx)
+	if id == "" {
+		return nil, errs.NewErrorWithCode("no tenant id", http.StatusUnauthorized)
+	}
+
+	// series tables are selected by tenant in override_series, see config validation
+	if q.config.Tenant.Label == "" {
+		return matchers, nil
 	}
 
+	ret := make([]*labels.Matcher, 0, len(matchers)+1)
+	ret = append(ret, matchers...)
+	ret = append(ret, labels.MustNewMatcher(labels.MatchEqual, q.config.Tenant.Label, id))
+	return ret, nil
+}
+
+func (q *Querier) whereMatchLabels(_ context.Context, cfg config.ConfigSeries, where *sql.Where, matchers []*labels.Matcher) {
+	mp := materializedLabels(cfg)
 	for _, m := range matchers {
-		column := sql.ArrayElement("labels", sql.Quote(m.Name))
-		if m.Name == "__name__" {
-			column = sql.Column("name")
-		}
-		if mp[m.Name] {
-			column = sql.Column("label_" + m.Name)
-		}
+		column := labelColumn(mp, m.Name)
 
 		switch m.Type {
 		case labels.MatchEqual:
@@ -36,6 +53,40 @@ func (q *Querier) whereMatchLabels(_ context.Context, cfg config.ConfigSeries, w
 	}
 }
 
+func materializedLabels(cfg config.ConfigSeries) map[string]bool {
+	mp := make(map[string]bool, len(cfg.SeriesMaterializedLabels))
+	for _, v := range cfg.SeriesMaterializedLabels {
+		mp[v] = true
+	}
+	return mp
+}
+
+// labelColumn returns expression with value of the label: name column, materialized label_<name> or element of labels map
+func labelColumn(materialized map[string]bool, name string) string {
+	if name == "__name__" {
+		return sql.Column("name")
+	}
+	if materialized[name] {
+		return sql.Column("label_" + name)
+	}
+	return sql.ArrayElement("labels", sql.Quote(name))
+}
+
+// apiMinTime is the start of label names and values requests without start
+var apiMinTime = timestamp.FromTime(api_v1.MinTime)
+
+// labelsTimeRange returns time range of label names and values requests.
+// API passes min and max possible time if start or end is not set, autocomplete_lookback is used instead
+func (q *Querier) labelsTimeRange(cfg config.ConfigSeries) (int64, int64) {
+	now := timeNow().UnixMilli()
+	end := min(q.maxt, now)
+	start := q.mint
+	if start <= apiMinTime {
+		start = end - cfg.AutocompleteLookback.Milliseconds()
+	}
+	return start, end
+}
+
 func (q *Querier) whereSeriesTimeRange(_ context.Context, where *sql.Where, start int64, end int64) {
 	where.And(
 		sql.Gte(sql.Column("timestamp_min"), sql.Quote(start-q.config.Select.SeriesPartitionMs)),
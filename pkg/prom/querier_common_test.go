@@ -0,0 +1,89 @@
+package prom
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pluto-metrics/pluto/pkg/config"
+	"github.com/pluto-metrics/pluto/pkg/tenant"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/timestamp"
+	api_v1 "github.com/prometheus/prometheus/web/api/v1"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTenantMatchers(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg := &config.Config{}
+	q := &Querier{config: cfg}
+	matchers := []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "__name__", "up")}
+
+	// disabled
+	ret, err := q.tenantMatchers(context.Background(), matchers)
+	assert.NoError(err)
+	assert.Equal(matchers, ret)
+
+	cfg.Tenant.Enabled = true
+
+	// no tenant in context
+	_, err = q.tenantMatchers(context.Background(), matchers)
+	assert.Error(err)
+
+	ctx := tenant.With(context.Background(), "team1")
+
+	// overrides only
+	ret, err = q.tenantMatchers(ctx, matchers)
+	assert.NoError(err)
+	assert.Equal(matchers, ret)
+
+	cfg.Tenant.Label = "tenant"
+	ret, err = q.tenantMatchers(ctx, matchers)
+	assert.NoError(err)
+	assert.Len(ret, 2)
+	assert.Equal(`tenant="team1"`, ret[1].String())
+	assert.Len(matchers, 1)
+}
+
+func TestLabelColumn(t *testing.T) {
+	mp := materializedLabels(config.ConfigSeries{SeriesMaterializedLabels: []string{"job"}})
+	assert.Equal(t, "`name`", labelColumn(mp, "__name__"))
+	assert.Equal(t, "`label_job`", labelColumn(mp, "job"))
+	assert.Equal(t, "arrayElement(labels, 'instance')", labelColumn(mp, "instance"))
+}
+
+func TestLabelsTimeRange(t *testing.T) {
+	defer func(f func() time.Time) { timeNow = f }(timeNow)
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	timeNow = func() time.Time { return now }
+
+	cfg := config.ConfigSeries{AutocompleteLookback: time.Hour}
+	hour := time.Hour.Milliseconds()
+
+	// unbounded
+	q := &Querier{mint: apiMinTime, maxt: timestamp.FromTime(api_v1.MaxTime)}
+	start, end := q.labelsTimeRange(cfg)
+	assert.Equal(t, now.UnixMilli()-hour, start)
+	assert.Equal(t, now.UnixMilli(), end)
+
+	// requested range
+	q = &Querier{mint: now.UnixMilli() - 3*hour, maxt: now.UnixMilli() - 2*hour}
+	start, end = q.labelsTimeRange(cfg)
+	assert.Equal(t, now.UnixMilli()-3*hour, start)
+	assert.Equal(t, now.UnixMilli()-2*hour, end)
+
+	// end only
+	q = &Querier{mint: apiMinTime, maxt: now.UnixMilli() - 2*hour}
+	start, end = q.labelsTimeRange(cfg)
+	assert.Equal(t, now.UnixMilli()-3*hour, start)
+	assert.Equal(t, now.UnixMilli()-2*hour, end)
+
+	// explicit epoch and negative start
+	for _, mint := range []int64{0, -hour} {
+		q = &Querier{mint: mint, maxt: now.UnixMilli()}
+		start, end = q.labelsTimeRange(cfg)
+		assert.Equal(t, mint, start)
+		assert.Equal(t, now.UnixMilli(), end)
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"github.com/pluto-metrics/pluto/pkg/config"
 	"github.com/pluto-metrics/pluto/pkg/lg"
 	"github.com/pluto-metrics/pluto/pkg/sql"
+	"github.com/pluto-metrics/pluto/pkg/tenant"
 	"github.com/pluto-metrics/rowbinary"
 	"github.com/pluto-metrics/rowbinary/schema"
 	"github.com/prometheus/prometheus/storage"
@@ -18,14 +19,22 @@ import (
 
 // LabelNames returns all the unique label names present in the block in sorted order.
 func (q *Querier) LabelNames(ctx context.Context, hints *storage.LabelHints, matchers ...*labels.Matcher) ([]string, annotations.Annotations, error) {
-	seriesCfg, err := q.config.GetSeries(&config.EnvSeries{Limit: hints.Limit})
+	matchers, err := q.tenantMatchers(ctx, matchers)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	now := timeNow()
-	start := now.Add(-seriesCfg.AutocompleteLookback).UnixMilli()
-	end := now.UnixMilli()
+	limit := 0
+	if hints != nil {
+		limit = hints.Limit
+	}
+
+	seriesCfg, err := q.config.GetSeries(&config.EnvSeries{Start: q.mint, End: q.maxt, Limit: limit, Tenant: tenant.FromContext(ctx)})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	start, end := q.labelsTimeRange(seriesCfg)
 
 	where := sql.NewWhere()
 	q.whereSeriesTimeRange(ctx, where, start, end)
@@ -37,10 +46,12 @@ func (q *Querier) LabelNames(ctx context.Context, hints *storage.LabelHints, mat
 		{{.where.SQL}}
 		GROUP BY value
 		ORDER BY value
+		{{if .limit}}LIMIT {{.limit}}{{end}}
 		FORMAT RowBinary
 	`, map[string]interface{}{
 		"table": seriesCfg.Table,
 		"where": where,
+		"limit": limit,
 	})
 	if err != nil {
 		return nil, nil, err
@@ -73,7 +84,7 @@ func (q *Querier) LabelNames(ctx context.Context, hints *storage.LabelHints, mat
 	}
 
 	if r.Err() != nil {
-		return nil, nil, err
+		return nil, nil, r.Err()
 	}
 
 	return rows, nil, nil
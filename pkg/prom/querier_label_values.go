@@ -8,6 +8,7 @@ import (
 	"github.com/pluto-metrics/pluto/pkg/config"
 	"github.com/pluto-metrics/pluto/pkg/lg"
 	"github.com/pluto-metrics/pluto/pkg/sql"
+	"github.com/pluto-metrics/pluto/pkg/tenant"
 	"github.com/pluto-metrics/rowbinary"
 	"github.com/pluto-metrics/rowbinary/schema"
 	"github.com/prometheus/prometheus/storage"
@@ -18,36 +19,44 @@ import (
 
 // LabelValues returns all potential values for a label name.
 func (q *Querier) LabelValues(ctx context.Context, label string, hints *storage.LabelHints, matchers ...*labels.Matcher) ([]string, annotations.Annotations, error) {
-	seriesCfg, err := q.config.GetSeries(&config.EnvSeries{Limit: hints.Limit})
+	matchers, err := q.tenantMatchers(ctx, matchers)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	now := timeNow()
-	start := now.Add(-seriesCfg.AutocompleteLookback).UnixMilli()
-	end := now.UnixMilli()
+	limit := 0
+	if hints != nil {
+		limit = hints.Limit
+	}
+
+	seriesCfg, err := q.config.GetSeries(&config.EnvSeries{Start: q.mint, End: q.maxt, Limit: limit, Tenant: tenant.FromContext(ctx)})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	start, end := q.labelsTimeRange(seriesCfg)
 
 	where := sql.NewWhere()
 	q.whereSeriesTimeRange(ctx, where, start, end)
 	q.whereMatchLabels(ctx, seriesCfg, where, matchers)
 
+	column := labelColumn(materializedLabels(seriesCfg), label)
+	// series without the label
+	where.And(sql.Ne(column, sql.Quote("")))
+
 	qq, err := sql.Template(`
-		SELECT
-			{{if (eq .label "__name__")}}
-				name
-			{{else}}
-				arrayElement(labels, {{.label|quote}})
-			{{end}}
-			AS value
+		SELECT {{.column}} AS value
 		FROM {{.table}}
 		{{.where.SQL}}
 		GROUP BY value
 		ORDER BY value
+		{{if .limit}}LIMIT {{.limit}}{{end}}
 		FORMAT RowBinary
 	`, map[string]interface{}{
-		"label": label,
-		"table": seriesCfg.Table,
-		"where": where,
+		"column": column,
+		"table":  seriesCfg.Table,
+		"where":  where,
+		"limit":  limit,
 	})
 	if err != nil {
 		return nil, nil, err
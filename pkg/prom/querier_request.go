@@ -1,9 +1,13 @@
 package prom
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"fmt"
+	"io"
 	"log/slog"
+	"mime/multipart"
 
 	"github.com/pluto-metrics/pluto/pkg/config"
 	"github.com/pluto-metrics/pluto/pkg/lg"
@@ -23,6 +27,69 @@ func (q *Querier) request(ctx context.Context, ch *config.ClickHouse, qq string)
 	_, err = fmt.Fprint(chRequest, qq)
 	if err != nil {
 		slog.ErrorContext(ctx, "can't write query to clickhouse", lg.Error(err))
+		chRequest.Close()
+		return nil, err
+	}
+
+	return chRequest, nil
+}
+
+// requestWithIDs sends the query with external table "ids" in RowBinary format written by writeIDs
+func (q *Querier) requestWithIDs(ctx context.Context, ch *config.ClickHouse, qq string, structure string, writeIDs func(w io.Writer) error) (*query.Request, error) {
+	reqBuf := new(bytes.Buffer)
+	reqWriter := multipart.NewWriter(reqBuf)
+
+	createErr := func(err error) (*query.Request, error) {
+		slog.ErrorContext(ctx, "can't create request to clickhouse", lg.Error(err))
+		return nil, err
+	}
+
+	if err := reqWriter.WriteField("query", qq); err != nil {
+		return createErr(err)
+	}
+
+	if err := reqWriter.WriteField("ids_format", "RowBinary"); err != nil {
+		return createErr(err)
+	}
+
+	if err := reqWriter.WriteField("ids_structure", structure); err != nil {
+		return createErr(err)
+	}
+
+	idsWriter, err := reqWriter.CreateFormFile("ids", "ids.bin")
+	if err != nil {
+		return createErr(err)
+	}
+
+	idsWriterBuf := bufio.NewWriter(idsWriter)
+
+	if err = writeIDs(idsWriterBuf); err != nil {
+		return createErr(err)
+	}
+
+	if err = idsWriterBuf.Flush(); err != nil {
+		return createErr(err)
+	}
+
+	if err = reqWriter.Close(); err != nil {
+		return createErr(err)
+	}
+
+	chRequest, err := query.NewRequest(ctx, *ch, query.Opts{
+		Headers: map[string]string{
+			"Content-Type": reqWriter.FormDataContentType(),
+		},
+		Discovery:  q.config.Extension.ClickHouseDiscovery,
+		HTTPClient: q.config.Extension.HTTPClient,
+	})
+	if err != nil {
+		return createErr(err)
+	}
+
+	_, err = io.Copy(chRequest, reqBuf)
+	if err != nil {
+		slog.ErrorContext(ctx, "can't write query to clickhouse", lg.Error(err))
+		chRequest.Close()
 		return nil, err
 	}
 
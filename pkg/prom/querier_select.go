@@ -2,24 +2,22 @@ package prom
 
 import (
 	"bufio"
-	"bytes"
 	"context"
 	"errors"
-	"io"
 	"log/slog"
 	"maps"
-	"mime/multipart"
 	"slices"
+	"sync/atomic"
 	"time"
 
 	"github.com/jinzhu/copier"
 	"github.com/pluto-metrics/pluto/pkg/config"
 	"github.com/pluto-metrics/pluto/pkg/lg"
-	"github.com/pluto-metrics/pluto/pkg/query"
 	"github.com/pluto-metrics/pluto/pkg/sql"
-	"github.com/pluto-metrics/rowbinary"
-	"github.com/pluto-metrics/rowbinary/schema"
+	"github.com/pluto-metrics/pluto/pkg/tenant"
+	"github.com/pluto-metrics/pluto/pkg/watermark"
 	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/value"
 	"github.com/prometheus/prometheus/storage"
 )
 
@@ -28,205 +26,293 @@ var timeNow = time.Now
 
 // Select returns a set of series that matches the given label matchers.
 func (q *Querier) Select(ctx context.Context, sortSeries bool, selectHints *storage.SelectHints, labelsMatcher ...*labels.Matcher) storage.SeriesSet {
-	seriesMap, err := q.selectSeries(ctx, selectHints, labelsMatcher)
+	if selectHints == nil {
+		// remote read without hints
+		selectHints = &storage.SelectHints{Start: q.mint, End: q.maxt}
+	}
+
+	// leg of aggregation sharded by shardingEngine
+	selectHints, labelsMatcher, err := shardHints(selectHints, labelsMatcher)
 	if err != nil {
-		slog.ErrorContext(ctx, "can't find series", lg.Error(err))
 		return errorSeriesSet(err)
 	}
-
-	if len(seriesMap) == 0 {
-		return emptySeriesSet()
+	if selectHints.ShardCount > 0 {
+		return q.prefetch(func() storage.SeriesSet {
+			return q.selectSet(ctx, sortSeries, selectHints, labelsMatcher)
+		})
 	}
+	return q.selectSet(ctx, sortSeries, selectHints, labelsMatcher)
+}
 
-	if selectHints != nil && selectHints.Func == "series" {
-		// /api/v1/series?match[]=...
-		return newLabelsSeriesSet(slices.Collect(maps.Values(seriesMap)))
+func (q *Querier) selectSet(ctx context.Context, sortSeries bool, selectHints *storage.SelectHints, labelsMatcher []*labels.Matcher) storage.SeriesSet {
+	// aggregation marked by pushdownEngine
+	pushdown, labelsMatcher, err := pushdownOp(selectHints, labelsMatcher)
+	if err != nil {
+		return errorSeriesSet(err)
 	}
+	selectHints = pushdownHints(selectHints, pushdown, lookbackDelta(q.config).Milliseconds())
 
-	// select config with overrides
-	envSamples := config.EnvSamples{}
-	if err := copier.Copy(&envSamples, selectHints); err != nil {
+	// count_over_time or avg_over_time rewritten by rangeReduceEngine
+	reduce, selectHints, labelsMatcher, err := rangeReduceOp(selectHints, labelsMatcher)
+	if err != nil {
 		return errorSeriesSet(err)
 	}
+	if reduce != "" {
+		ctx = withRangeReduce(ctx, reduce)
+	}
 
-	samplesCfg, err := q.config.GetSamples(&envSamples)
+	seriesMap, limits, err := q.selectSeries(ctx, selectHints, labelsMatcher)
 	if err != nil {
+		slog.ErrorContext(ctx, "can't find series", lg.Error(err))
 		return errorSeriesSet(err)
 	}
 
-	var step int64 = 1000 // 1 second
-	if selectHints.Step != 0 {
-		step = selectHints.Step
+	if len(seriesMap) == 0 {
+		return emptySeriesSet()
 	}
 
-	// don't fetch full ids, use hash
-	unhash := NewHashSelector(maps.Keys(seriesMap))
-
-	timestampDiv := int64(1)
-	if samplesCfg.SamplesTimestampUInt32 {
-		timestampDiv = 1000
+	if selectHints.Func == "series" {
+		// /api/v1/series?match[]=...
+		return newLabelsSeriesSet(slices.Collect(maps.Values(seriesMap)))
 	}
 
-	// fetch data by ids
-	qq, err := sql.Template(`
-		SELECT {{.id_hash}} as id_hash, min(timestamp), maxArgMin(value, timestamp)
-		FROM {{.table}}
-		WHERE id IN ids
-			AND timestamp >= {{.start|quote}}-{{.step|quote}}
-			AND timestamp <= {{.end|quote}}
-		GROUP BY id_hash, intDiv(timestamp-{{.start|quote}}, {{.step|quote}})
-		FORMAT RowBinary
-	`, map[string]interface{}{
-		"id_hash": unhash.SelectColumn("id"),
-		"table":   samplesCfg.Table,
-		"start":   selectHints.Start / timestampDiv,
-		"end":     selectHints.End / timestampDiv,
-		"step":    step / timestampDiv,
-	})
-	if err != nil {
-		slog.ErrorContext(ctx, "can't create request to clickhouse", lg.Error(err))
-		return errorSeriesSet(err)
+	if pushdown.op != "" {
+		samplesCfg, err := q.samplesConfig(ctx, selectHints, selectHints.Start, selectHints.End)
+		if err != nil {
+			return errorSeriesSet(err)
+		}
+		return q.selectPushdown(ctx, pushdown, selectHints, seriesMap, &samplesCfg, limits)
 	}
 
-	reqBuf := new(bytes.Buffer)
-	reqWriter := multipart.NewWriter(reqBuf)
+	// series with the same labels are merged by index, the response is ordered by it
+	index := newSeriesIndex(seriesMap, sortSeries)
 
-	createErr := func(err error) storage.SeriesSet {
-		slog.ErrorContext(ctx, "can't create request to clickhouse", lg.Error(err))
-		return errorSeriesSet(err)
+	slices := timeSlices(selectHints.Start, selectHints.End, q.config.Select.SplitInterval.Milliseconds())
+	if len(slices) > 1 {
+		return q.selectSlices(ctx, selectHints, slices, index, limits)
 	}
 
-	if err = reqWriter.WriteField("query", qq); err != nil {
-		return createErr(err)
+	ss, raw, err := q.selectSamples(ctx, selectHints, slices[0], index, limits, new(atomic.Int64))
+	if err != nil {
+		return errorSeriesSet(err)
 	}
+	q.closeOnExit(ss)
 
-	if err = reqWriter.WriteField("ids_format", "RowBinary"); err != nil {
-		return createErr(err)
+	if q.histogramHacks(raw, index.series()) {
+		// histogram hacks need all series at once
+		data, err := ss.collect()
+		if err != nil {
+			return errorSeriesSet(err)
+		}
+		hss, err := makeSeriesSet(hackSeries(data, selectHints))
+		if err != nil {
+			slog.ErrorContext(ctx, "can't make series", lg.Error(err))
+			return errorSeriesSet(err)
+		}
+		return hss
 	}
 
-	if err = reqWriter.WriteField("ids_structure", "id String"); err != nil {
-		return createErr(err)
-	}
+	return ss
+}
 
-	idsWriter, err := reqWriter.CreateFormFile("ids", "ids.bin")
-	if err != nil {
-		return createErr(err)
-	}
+type watermarkCutKey struct{}
 
-	idsWriterBuf := bufio.NewWriter(idsWriter)
+// withWatermarkCut returns the flag set if the watermark excludes samples of any select of the request
+func withWatermarkCut(ctx context.Context) (context.Context, *atomic.Bool) {
+	cut := new(atomic.Bool)
+	return context.WithValue(ctx, watermarkCutKey{}, cut), cut
+}
 
-	schemaWriter := schema.NewWriter(idsWriterBuf).
-		Format(schema.RowBinary).
-		Column("id", rowbinary.String)
+// watermarkEnd excludes samples of insert requests of the tenant still being written, a partially written scrape
+// breaks functions over several series like histogram_quantile. See watermark.Tracker
+func watermarkEnd(ctx context.Context, end int64) int64 {
+	w, ok := watermark.Default.Tenant(tenant.FromContext(ctx))
+	if !ok || w >= end {
+		return end
+	}
+	if cut, ok := ctx.Value(watermarkCutKey{}).(*atomic.Bool); ok {
+		cut.Store(true)
+	}
+	return w
+}
 
-	for k := range seriesMap {
-		if err = schemaWriter.WriteValues(k); err != nil {
-			return createErr(err)
-		}
+// samplesConfig returns samples config with overrides for the time range
+func (q *Querier) samplesConfig(ctx context.Context, hints *storage.SelectHints, start, end int64) (config.ConfigSamples, error) {
+	envSamples := config.EnvSamples{}
+	if err := copier.Copy(&envSamples, hints); err != nil {
+		return config.ConfigSamples{}, err
 	}
+	envSamples.Start = start
+	envSamples.End = end
+	envSamples.Tenant = tenant.FromContext(ctx)
 
-	if err = idsWriterBuf.Flush(); err != nil {
-		return createErr(err)
+	return q.config.GetSamples(&envSamples)
+}
+
+// selectSamples starts streaming of samples of the time slice
+// Response bytes are counted in resultBytes shared by all slices of the selector. Returns raw=true if samples are not bucketed
+func (q *Querier) selectSamples(ctx context.Context, hints *storage.SelectHints, slice timeSlice, index *seriesIndex, limits config.QueryLimits, resultBytes *atomic.Int64) (*streamSeriesSet, bool, error) {
+	samplesCfg, err := q.samplesConfig(ctx, hints, slice.start, slice.end)
+	if err != nil {
+		return nil, false, err
 	}
 
-	if err = reqWriter.Close(); err != nil {
-		return createErr(err)
+	step, raw := samplesResolution(ctx, hints, &samplesCfg)
+
+	timestampDiv := int64(1)
+	if samplesCfg.SamplesTimestampUInt32 {
+		timestampDiv = 1000
+		step = max(step, timestampDiv)
 	}
 
-	chRequest, err := query.NewRequest(ctx, *samplesCfg.ClickHouse, query.Opts{
-		Headers: map[string]string{
-			"Content-Type": reqWriter.FormDataContentType(),
-		},
-		Discovery:  q.config.Extension.ClickHouseDiscovery,
-		HTTPClient: q.config.Extension.HTTPClient,
-	})
+	var qq string
+	if raw {
+		// all samples, duplicates are merged as by the samples table engine
+		qq, err = sql.Template(`
+			SELECT s, timestamp, max(value)
+			FROM {{.table}}
+			INNER JOIN ids USING id
+			WHERE id IN (SELECT id FROM ids)
+				AND timestamp >= {{.from|quote}}
+				AND timestamp <= {{.to|quote}}
+			GROUP BY s, timestamp
+			ORDER BY s, timestamp
+			FORMAT RowBinary
+		`, map[string]interface{}{
+			"table": samplesCfg.Table,
+			"from":  slice.start / timestampDiv,
+			"to":    watermarkEnd(ctx, slice.end) / timestampDiv,
+		})
+	} else {
+		// fetch data by ids.
+		// One sample of each step chosen by the reducer and the last sample if it is a staleness marker.
+		// Buckets are counted from the start of the query in every slice
+		from := slice.start
+		if from == hints.Start {
+			from -= step
+		}
+		reduce := bucketReducer(ctx, hints)
+		qq, err = sql.Template(`
+			WITH reinterpretAsUInt64(value) = {{.stale_nan}} AS stale,
+				intDiv(timestamp-{{.start|quote}}{{if .bucket_end}}+{{.step|quote}}-1{{end}}, {{.step|quote}}) AS bucket
+			SELECT s,
+				{{.timestamp_expr}}, {{.value_expr}}, countIf(NOT stale),
+				max(timestamp), argMax(stale, timestamp)
+			FROM {{.table}}
+			INNER JOIN ids USING id
+			WHERE id IN (SELECT id FROM ids)
+				AND timestamp >= {{.from|quote}}
+				AND timestamp <= {{.to|quote}}
+			GROUP BY s, bucket
+			ORDER BY s, bucket
+			FORMAT RowBinary
+		`, map[string]interface{}{
+			"table":          samplesCfg.Table,
+			"start":          hints.Start / timestampDiv,
+			"from":           from / timestampDiv,
+			"to":             watermarkEnd(ctx, slice.end) / timestampDiv,
+			"step":           step / timestampDiv,
+			"stale_nan":      value.StaleNaN,
+			"timestamp_expr": reduce.timestamp,
+			"value_expr":     reduce.value,
+			"bucket_end":     reduce.bucketEnd,
+		})
+	}
 	if err != nil {
-		return createErr(err)
+		slog.ErrorContext(ctx, "can't create request to clickhouse", lg.Error(err))
+		return nil, false, err
 	}
 
-	_, err = io.Copy(chRequest, reqBuf)
+	chRequest, err := q.requestWithIDs(ctx, samplesCfg.ClickHouse, qq, "id String, s UInt32", index.writeIDs)
 	if err != nil {
-		slog.ErrorContext(ctx, "can't write query to clickhouse", lg.Error(err))
-		return errorSeriesSet(err)
+		return nil, false, err
 	}
-	defer chRequest.Close()
 
 	chResponse, err := chRequest.Finish()
 	if err != nil {
+		chRequest.Close()
 		if !errors.Is(err, context.Canceled) {
 			slog.ErrorContext(ctx, "can't finish request to clickhouse", lg.Error(err))
 		}
-		return errorSeriesSet(err)
-	}
-	defer chResponse.Close()
-
-	// fetch results
-	dataMap := make(map[string]*series, len(seriesMap))
-	uniqDataMap := make(map[string]*series, len(seriesMap)) // key = labelsMapKey(labels)
-	for k, v := range seriesMap {
-		uniqKey := labelsMapKey(v)
-		d := uniqDataMap[uniqKey]
-		if d == nil {
-			d = &series{
-				labels:  v,
-				samples: make([]sample, 0),
-			}
-		}
-		uniqDataMap[uniqKey] = d
-		dataMap[k] = d
+		return nil, false, err
 	}
 
-	r := schema.NewReader(bufio.NewReader(chResponse)).
-		Format(schema.RowBinary).
-		Column(unhash.ColumnType()) // id
+	r, readRow := samplesReader(bufio.NewReader(newSharedLimitedReader(chResponse, limits.MaxResultBytes, resultBytes)), raw, samplesCfg.SamplesTimestampUInt32)
 
-	if samplesCfg.SamplesTimestampUInt32 {
-		r = r.Column(rowbinary.UInt32) // timestamp uint32
-	} else {
-		r = r.Column(rowbinary.Int64) // timestamp int64 with ms
-	}
-	r = r.Column(rowbinary.Float64) // value
-
-	var id string
-	var timestamp int64
-	var timestamp32 uint32
-	var value float64
-
-	for r.Next() {
-		id, _ = unhash.SchemaRead(r)
-		if samplesCfg.SamplesTimestampUInt32 {
-			timestamp32, _ = schema.Read(r, rowbinary.UInt32)
-			timestamp = int64(timestamp32) * 1000
-		} else {
-			timestamp, _ = schema.Read(r, rowbinary.Int64)
+	return &streamSeriesSet{
+		ctx:        ctx,
+		labels:     index.labels,
+		reader:     r,
+		readRow:    readRow,
+		closer:     chRequest,
+		maxSamples: limits.MaxSamples,
+	}, raw, nil
+}
+
+// samplesResolution returns bucket width in milliseconds or raw=true if every sample is required.
+// Remote read needs raw samples. Range functions need all samples of the range (or one per scrape
+// interval if range_resolution is set), one sample per step is not enough for rate, increase etc.
+func samplesResolution(ctx context.Context, hints *storage.SelectHints, cfg *config.ConfigSamples) (int64, bool) {
+	if isRawSamples(ctx) {
+		return 0, true
+	}
+	if hints.Range > 0 {
+		// the engine counts samples, buckets are counted only if the function is rewritten by rangeReduceEngine
+		reduced := rangeReducer(ctx) != ""
+		countSamples := hints.Func == "count_over_time" || hints.Func == "avg_over_time"
+		if cfg.RangeResolution > 0 && (reduced || !countSamples) {
+			return cfg.RangeResolution.Milliseconds(), false
 		}
-		value, _ = schema.Read(r, rowbinary.Float64)
-		if r.Err() != nil {
-			slog.ErrorContext(ctx, "can't read row from clickhouse", lg.Error(r.Err()))
-			return errorSeriesSet(r.Err())
+		if reduced {
+			// bucket per timestamp, the engine sums counts of samples
+			return 1, false
 		}
-
-		dataMap[id].sampleAppend(timestamp, value)
+		return 0, true
 	}
-
-	if r.Err() != nil {
-		slog.ErrorContext(ctx, "can't read response from clickhouse", lg.Error(r.Err()))
-		return errorSeriesSet(r.Err())
+	if hints.Step > 0 {
+		return hints.Step, false
 	}
+	return 1000, false // 1 second
+}
 
-	data := make([]series, 0, len(uniqDataMap))
-	for _, v := range uniqDataMap {
-		if len(v.samples) == 0 {
-			continue
-		}
-		data = append(data, *v)
-	}
+// reducer selects one sample of the bucket. Not stale samples only
+type reducer struct {
+	timestamp string
+	value     string
+	// bucket is (T-step, T] instead of [T, T+step)
+	bucketEnd bool
+}
 
-	ss, err := makeSeriesSet(data, selectHints)
-	if err != nil {
-		slog.ErrorContext(ctx, "can't make series", lg.Error(err))
-		return errorSeriesSet(err)
-	}
+var (
+	reduceFirst = reducer{timestamp: "minIf(timestamp, NOT stale)", value: "maxArgMinIf(value, timestamp, NOT stale)"}
+	reduceLast  = reducer{timestamp: "maxIf(timestamp, NOT stale)", value: "maxArgMaxIf(value, timestamp, NOT stale)", bucketEnd: true}
+	reduceMax   = reducer{timestamp: "argMaxIf(timestamp, value, NOT stale)", value: "maxIf(value, NOT stale)"}
+	reduceMin   = reducer{timestamp: "argMinIf(timestamp, value, NOT stale)", value: "minIf(value, NOT stale)"}
+	reduceSum   = reducer{timestamp: "minIf(timestamp, NOT stale)", value: "sumIf(value, NOT stale)"}
+	// duplicated timestamps are counted once as in raw samples
+	reduceCount = reducer{timestamp: "minIf(timestamp, NOT stale)", value: "toFloat64(uniqExactIf(timestamp, NOT stale))"}
+)
 
-	return ss
+// bucketReducer returns the reducer which keeps result of the function.
+// Instant selectors take the last sample before the evaluation timestamp.
+// count_over_time and avg_over_time are bucketed only if rewritten by rangeReduceEngine, see samplesResolution
+func bucketReducer(ctx context.Context, hints *storage.SelectHints) reducer {
+	if hints.Range == 0 {
+		return reduceLast
+	}
+	switch rangeReducer(ctx) {
+	case "count":
+		return reduceCount
+	case "sum":
+		return reduceSum
+	}
+	switch hints.Func {
+	case "max_over_time":
+		return reduceMax
+	case "min_over_time":
+		return reduceMin
+	case "sum_over_time":
+		return reduceSum
+	}
+	return reduceFirst
 }
@@ -9,51 +9,73 @@ import (
 	"github.com/pluto-metrics/pluto/pkg/config"
 	"github.com/pluto-metrics/pluto/pkg/lg"
 	"github.com/pluto-metrics/pluto/pkg/sql"
+	"github.com/pluto-metrics/pluto/pkg/tenant"
 	"github.com/pluto-metrics/rowbinary"
 	"github.com/pluto-metrics/rowbinary/schema"
+	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/storage"
 )
 
-func (q *Querier) selectSeries(ctx context.Context, selectHints *storage.SelectHints, matchers []*labels.Matcher) (map[string]labels.Labels, error) {
+// selectSeries returns labels by series id and limits of the selector
+func (q *Querier) selectSeries(ctx context.Context, selectHints *storage.SelectHints, matchers []*labels.Matcher) (map[string]labels.Labels, config.QueryLimits, error) {
+	var limits config.QueryLimits
+	matchers, err := q.tenantMatchers(ctx, matchers)
+	if err != nil {
+		return nil, limits, err
+	}
+
 	envSeries := config.EnvSeries{}
 	if err := copier.Copy(&envSeries, selectHints); err != nil {
-		return nil, err
+		return nil, limits, err
 	}
+	envSeries.Tenant = tenant.FromContext(ctx)
 
 	seriesCfg, err := q.config.GetSeries(&envSeries)
 	if err != nil {
-		return nil, err
+		return nil, limits, err
+	}
+	limits = seriesCfg.Limits
+
+	if limits.MaxTimeRange > 0 && selectHints.End-selectHints.Start > limits.MaxTimeRange.Milliseconds() {
+		return nil, limits, limitError("max_time_range", model.Duration(limits.MaxTimeRange))
 	}
 
 	where := sql.NewWhere()
 	q.whereSeriesTimeRange(ctx, where, selectHints.Start, selectHints.End)
 	q.whereMatchLabels(ctx, seriesCfg, where, matchers)
+	if selectHints.ShardCount > 0 {
+		// series with different ids and equal labels are merged, so all of them must be read by the same leg
+		where.Andf("cityHash64(arraySort(arrayZip(mapKeys(labels), mapValues(labels)))) %% %d = %d", selectHints.ShardCount, selectHints.ShardIndex)
+	}
 
 	qq, err := sql.Template(`
 		SELECT id, any(labels)
 		FROM {{.table}}
 		{{.where.SQL}}
 		GROUP BY id
+		{{if .limit}}LIMIT {{.limit}}{{end}}
 		FORMAT RowBinary
 	`, map[string]interface{}{
 		"table": seriesCfg.Table,
 		"where": where,
+		// one more to detect exceeded limit
+		"limit": max(limits.MaxSeries, 0) + min(max(limits.MaxSeries, 0), 1),
 	})
 	if err != nil {
-		return nil, err
+		return nil, limits, err
 	}
 
 	chRequest, err := q.request(ctx, seriesCfg.ClickHouse, qq)
 	if err != nil {
-		return nil, err
+		return nil, limits, err
 	}
 	defer chRequest.Close()
 
 	chResponse, err := chRequest.Finish()
 	if err != nil {
 		slog.ErrorContext(ctx, "can't finish request to clickhouse", lg.Error(err))
-		return nil, err
+		return nil, limits, err
 	}
 	defer chResponse.Close()
 
@@ -67,18 +89,22 @@ func (q *Querier) selectSeries(ctx context.Context, selectHints *storage.SelectH
 	for r.Next() {
 		id, err := schema.Read(r, rowbinary.String)
 		if err != nil {
-			return nil, err
+			return nil, limits, err
 		}
 		lb, err := schema.Read(r, ColumnLabels)
 		if err != nil {
-			return nil, err
+			return nil, limits, err
 		}
 
 		ret[id] = lb
 	}
 	if r.Err() != nil {
-		return nil, err
+		return nil, limits, r.Err()
+	}
+
+	if limits.MaxSeries > 0 && len(ret) > limits.MaxSeries {
+		return nil, limits, limitError("max_series", limits.MaxSeries)
 	}
 
-	return ret, nil
+	return ret, limits, nil
 }
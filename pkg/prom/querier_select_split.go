@@ -0,0 +1,198 @@
+package prom
+
+import (
+	"context"
+	"log/slog"
+	"sync/atomic"
+
+	"github.com/pluto-metrics/pluto/pkg/config"
+	"github.com/pluto-metrics/pluto/pkg/lg"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/util/annotations"
+	"golang.org/x/sync/errgroup"
+)
+
+// timeSlice is a part of the select range. Timestamps in milliseconds, inclusive
+type timeSlice struct {
+	start int64
+	end   int64
+}
+
+// timeSlices splits [start, end] by multiples of interval. Zero interval returns the whole range
+func timeSlices(start, end, interval int64) []timeSlice {
+	if interval <= 0 || end < start {
+		return []timeSlice{{start: start, end: end}}
+	}
+	var ret []timeSlice
+	for t := start; t <= end; {
+		next := (t/interval + 1) * interval
+		if t < 0 && t%interval != 0 {
+			next = t / interval * interval
+		}
+		ret = append(ret, timeSlice{start: t, end: min(end, next-1)})
+		t = next
+	}
+	return ret
+}
+
+// selectSlices starts streams of slices concurrently and merges them by series.
+// All streams are open while the result is read, split_concurrency limits the queries started at once.
+// Limits are checked for all slices together while reading, so memory is bounded as for a single select
+func (q *Querier) selectSlices(ctx context.Context, hints *storage.SelectHints, slices []timeSlice, index *seriesIndex, limits config.QueryLimits) storage.SeriesSet {
+	sets := make([]*streamSeriesSet, len(slices))
+	raw := make([]bool, len(slices))
+	var resultBytes atomic.Int64
+
+	// streams read with the context of the select after the group is done
+	var g errgroup.Group
+	if q.config.Select.SplitConcurrency > 0 {
+		g.SetLimit(q.config.Select.SplitConcurrency)
+	}
+	for i := range slices {
+		g.Go(func() error {
+			ss, isRaw, err := q.selectSamples(ctx, hints, slices[i], index, limits, &resultBytes)
+			if err != nil {
+				return err
+			}
+			sets[i], raw[i] = ss, isRaw
+			return nil
+		})
+	}
+	err := g.Wait()
+	for _, ss := range sets {
+		if ss != nil {
+			q.closeOnExit(ss)
+		}
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "can't select slices", lg.Error(err))
+		for _, ss := range sets {
+			if ss != nil {
+				ss.finish(nil)
+			}
+		}
+		return errorSeriesSet(err)
+	}
+
+	ss := &sliceSeriesSet{sets: sets, maxSamples: limits.MaxSamples}
+
+	// histogram hacks are applied to bucketed samples only
+	anyRaw := false
+	for _, r := range raw {
+		anyRaw = anyRaw || r
+	}
+	if q.histogramHacks(anyRaw, index.series()) {
+		// histogram hacks need all series at once
+		data, err := ss.collect()
+		if err != nil {
+			return errorSeriesSet(err)
+		}
+		hss, err := makeSeriesSet(hackSeries(data, hints))
+		if err != nil {
+			slog.ErrorContext(ctx, "can't make series", lg.Error(err))
+			return errorSeriesSet(err)
+		}
+		return hss
+	}
+	return ss
+}
+
+// sliceSeriesSet merges streams of sequential time slices ordered by series index.
+// Samples of the same series are concatenated in order of slices
+type sliceSeriesSet struct {
+	sets []*streamSeriesSet
+	// the stream has the current series not merged yet
+	ready   []bool
+	started bool
+	// zero is no limit
+	maxSamples int
+	samples    int
+
+	current *series
+	err     error
+}
+
+var _ storage.SeriesSet = &sliceSeriesSet{}
+
+// Next merges the series with the lowest index of all streams
+func (ss *sliceSeriesSet) Next() bool {
+	if !ss.started {
+		ss.started = true
+		ss.ready = make([]bool, len(ss.sets))
+		for i := range ss.sets {
+			ss.advance(i)
+		}
+	}
+	ss.current = nil
+	if ss.err != nil {
+		return false
+	}
+
+	index, found := uint32(0), false
+	for i, s := range ss.sets {
+		if ss.ready[i] && (!found || s.currentIndex < index) {
+			index, found = s.currentIndex, true
+		}
+	}
+	if !found {
+		return false
+	}
+
+	var current *series
+	for i, s := range ss.sets {
+		if !ss.ready[i] || s.currentIndex != index {
+			continue
+		}
+		if current == nil {
+			current = s.current
+		} else {
+			// samples of the stream are released with it, merged ones are allocated
+			samples := make([]sample, 0, len(current.samples)+len(s.current.samples))
+			samples = append(samples, current.samples...)
+			current = &series{labels: current.labels, samples: append(samples, s.current.samples...)}
+		}
+		ss.advance(i)
+	}
+	if ss.err != nil {
+		return false
+	}
+
+	ss.samples += len(current.samples)
+	if ss.maxSamples > 0 && ss.samples > ss.maxSamples {
+		ss.err = limitError("max_samples", ss.maxSamples)
+		return false
+	}
+	ss.current = current
+	return true
+}
+
+// advance reads the next series of the stream
+func (ss *sliceSeriesSet) advance(i int) {
+	ss.ready[i] = ss.sets[i].Next()
+	if err := ss.sets[i].Err(); err != nil && ss.err == nil {
+		ss.err = err
+	}
+}
+
+// collect reads all series
+func (ss *sliceSeriesSet) collect() ([]series, error) {
+	var ret []series
+	for ss.Next() {
+		ret = append(ret, *ss.current)
+	}
+	return ret, ss.Err()
+}
+
+// At returns the current series
+func (ss *sliceSeriesSet) At() storage.Series {
+	if ss.current == nil {
+		return nil
+	}
+	return ss.current
+}
+
+// Err returns the current error.
+func (ss *sliceSeriesSet) Err() error { return ss.err }
+
+// Warnings ...
+func (ss *sliceSeriesSet) Warnings() annotations.Annotations { return nil }
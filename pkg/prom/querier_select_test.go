@@ -0,0 +1,208 @@
+package prom
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pluto-metrics/pluto/pkg/config"
+	"github.com/pluto-metrics/pluto/pkg/tenant"
+	"github.com/pluto-metrics/pluto/pkg/watermark"
+	"github.com/pluto-metrics/rowbinary"
+	"github.com/pluto-metrics/rowbinary/schema"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSamplesResolution(t *testing.T) {
+	tests := []struct {
+		name       string
+		ctx        context.Context
+		hints      storage.SelectHints
+		resolution time.Duration
+		step       int64
+		raw        bool
+	}{
+		{"instant selector", context.Background(), storage.SelectHints{Step: 60000}, 0, 60000, false},
+		{"no step", context.Background(), storage.SelectHints{}, 0, 1000, false},
+		{"rate", context.Background(), storage.SelectHints{Step: 60000, Range: 300000, Func: "rate"}, 0, 0, true},
+		{"rate with resolution", context.Background(), storage.SelectHints{Step: 60000, Range: 300000, Func: "rate"}, 15 * time.Second, 15000, false},
+		{"avg_over_time with resolution", context.Background(), storage.SelectHints{Step: 60000, Range: 300000, Func: "avg_over_time"}, 15 * time.Second, 0, true},
+		{"reduced avg_over_time with resolution", withRangeReduce(context.Background(), "sum"), storage.SelectHints{Step: 60000, Range: 300000, Func: "avg_over_time"}, 15 * time.Second, 15000, false},
+		{"reduced count_over_time", withRangeReduce(context.Background(), "count"), storage.SelectHints{Step: 60000, Range: 300000, Func: "count_over_time"}, 0, 1, false},
+		{"remote read", withRawSamples(context.Background()), storage.SelectHints{Step: 60000}, 15 * time.Second, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			step, raw := samplesResolution(tt.ctx, &tt.hints, &config.ConfigSamples{RangeResolution: tt.resolution})
+			assert.Equal(t, tt.step, step)
+			assert.Equal(t, tt.raw, raw)
+		})
+	}
+}
+
+func TestBucketReducer(t *testing.T) {
+	tests := []struct {
+		ctx   context.Context
+		hints storage.SelectHints
+		want  reducer
+	}{
+		{context.Background(), storage.SelectHints{Step: 60000}, reduceLast},
+		{context.Background(), storage.SelectHints{Step: 60000, Func: "abs"}, reduceLast},
+		// subquery, the inner selector is evaluated as instant
+		{context.Background(), storage.SelectHints{Step: 60000, Func: "max_over_time"}, reduceLast},
+		{context.Background(), storage.SelectHints{Range: 300000, Func: "max_over_time"}, reduceMax},
+		{context.Background(), storage.SelectHints{Range: 300000, Func: "min_over_time"}, reduceMin},
+		{context.Background(), storage.SelectHints{Range: 300000, Func: "sum_over_time"}, reduceSum},
+		{context.Background(), storage.SelectHints{Range: 300000, Func: "rate"}, reduceFirst},
+		{withRangeReduce(context.Background(), "count"), storage.SelectHints{Range: 300000, Func: "count_over_time"}, reduceCount},
+		{withRangeReduce(context.Background(), "sum"), storage.SelectHints{Range: 300000, Func: "avg_over_time"}, reduceSum},
+	}
+	for _, tt := range tests {
+		t.Run(tt.hints.Func, func(t *testing.T) {
+			assert.Equal(t, tt.want, bucketReducer(tt.ctx, &tt.hints))
+		})
+	}
+}
+
+func TestTimeSlices(t *testing.T) {
+	day := int64(86400000)
+	assert.Equal(t, []timeSlice{{start: 10, end: 3 * day}}, timeSlices(10, 3*day, 0))
+	assert.Equal(t, []timeSlice{{start: 10, end: 20}}, timeSlices(10, 20, day))
+	assert.Equal(t, []timeSlice{
+		{start: 10, end: day - 1},
+		{start: day, end: 2*day - 1},
+		{start: 2 * day, end: 2*day + 5},
+	}, timeSlices(10, 2*day+5, day))
+	assert.Equal(t, []timeSlice{
+		{start: day, end: 2*day - 1},
+		{start: 2 * day, end: 2 * day},
+	}, timeSlices(day, 2*day, day))
+}
+
+func TestSelectSlicesOverride(t *testing.T) {
+	day := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).UnixMilli()
+	// the override boundary is in the middle of the second slice
+	boundary := day + dayMs + dayMs/2
+	fromRe := regexp.MustCompile(`timestamp >= (\d+)`)
+	tableRe := regexp.MustCompile(`FROM (samples\w*)`)
+
+	ch := newFakeClickHouse(t, func(w io.Writer, qq string) {
+		if strings.Contains(qq, "FROM series") {
+			wr := schema.NewWriter(w).Format(schema.RowBinary).
+				Column("id", rowbinary.String).Column("labels", rowbinary.Map(rowbinary.String, rowbinary.String))
+			assert.NoError(t, wr.WriteValues("a", map[string]string{"__name__": "up", "job": "a"}))
+			assert.NoError(t, wr.WriteValues("b", map[string]string{"__name__": "up", "job": "b"}))
+			return
+		}
+		// one sample at the start of the slice, the old table has both series
+		m := fromRe.FindStringSubmatch(qq)
+		if !assert.Len(t, m, 2) {
+			return
+		}
+		from, _ := strconv.ParseInt(m[1], 10, 64)
+		wr := schema.NewWriter(w).Format(schema.RowBinary).
+			Column("s", rowbinary.UInt32).Column("timestamp", rowbinary.Int64).Column("value", rowbinary.Float64)
+		assert.NoError(t, wr.WriteValues(uint32(0), from, float64(from)))
+		if strings.Contains(qq, "FROM samples_old") {
+			assert.NoError(t, wr.WriteValues(uint32(1), from, float64(from)))
+		}
+	})
+
+	cfg := ch.config()
+	cfg.Select.TableSeries = "series"
+	cfg.Select.TableSamples = "samples"
+	cfg.Select.SplitInterval = 24 * time.Hour
+	cfg.Select.SplitConcurrency = 2
+	cfg.OverrideSamples = slices.Grow(cfg.OverrideSamples, 1)[:1]
+	cfg.OverrideSamples[0].Table = "samples_old"
+	cfg.OverrideSamples[0].WhenStr = fmt.Sprintf("end < %d", boundary)
+	require.NoError(t, cfg.Compile())
+
+	q := &Querier{config: cfg}
+	defer q.Close()
+	// raw samples of three slices
+	hints := &storage.SelectHints{Start: day, End: day + 2*dayMs + 1000, Step: 60000, Range: 300000, Func: "rate"}
+	ss := q.Select(context.Background(), true, hints, labels.MustNewMatcher(labels.MatchEqual, "__name__", "up"))
+
+	type result struct {
+		job        string
+		timestamps []int64
+	}
+	var got []result
+	for ss.Next() {
+		r := result{job: ss.At().Labels().Get("job")}
+		it := ss.At().Iterator(nil)
+		for it.Next() != 0 {
+			ts, v := it.At()
+			assert.Equal(t, float64(ts), v)
+			r.timestamps = append(r.timestamps, ts)
+		}
+		got = append(got, r)
+	}
+	require.NoError(t, ss.Err())
+	assert.Equal(t, []result{
+		{job: "a", timestamps: []int64{day, day + dayMs, day + 2*dayMs}},
+		{job: "b", timestamps: []int64{day}},
+	}, got)
+
+	// the slice crossing the boundary doesn't match the override
+	tables := make(map[int64]string)
+	for _, qq := range ch.received() {
+		if m := fromRe.FindStringSubmatch(qq); m != nil {
+			from, _ := strconv.ParseInt(m[1], 10, 64)
+			tables[from] = tableRe.FindStringSubmatch(qq)[1]
+		}
+	}
+	assert.Equal(t, map[int64]string{
+		day:           "samples_old",
+		day + dayMs:   "samples",
+		day + 2*dayMs: "samples",
+	}, tables)
+}
+
+func TestHistogramHacks(t *testing.T) {
+	buckets := []series{
+		{labels: labels.FromStrings("__name__", "x_bucket", "le", "1")},
+		{labels: labels.FromStrings("__name__", "x_bucket", "le", "+Inf")},
+	}
+	cfg := &config.Config{}
+	q := &Querier{config: cfg}
+	assert.True(t, q.histogramHacks(false, buckets))
+	assert.False(t, q.histogramHacks(true, buckets))
+
+	// other writers are not covered by the watermark of local insert
+	cfg.Insert.Enabled = true
+	assert.True(t, q.histogramHacks(false, buckets))
+
+	cfg.Insert.Watermark.AllWritersLocal = true
+	assert.False(t, q.histogramHacks(false, buckets))
+}
+
+func TestWatermarkEnd(t *testing.T) {
+	ctx, cut := withWatermarkCut(tenant.With(context.Background(), "t1"))
+	assert.Equal(t, int64(5000), watermarkEnd(ctx, 5000))
+
+	// other tenants are not affected
+	doneOther := watermark.Default.Begin("t2", 1000)
+	defer doneOther()
+	assert.Equal(t, int64(5000), watermarkEnd(ctx, 5000))
+	assert.False(t, cut.Load())
+
+	done := watermark.Default.Begin("t1", 3000)
+	assert.Equal(t, int64(2000), watermarkEnd(ctx, 2000))
+	assert.False(t, cut.Load())
+	assert.Equal(t, int64(2999), watermarkEnd(ctx, 5000))
+	assert.True(t, cut.Load())
+
+	done()
+	assert.Equal(t, int64(5000), watermarkEnd(ctx, 5000))
+}
@@ -0,0 +1,197 @@
+package prom
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pluto-metrics/pluto/pkg/config"
+	"github.com/pluto-metrics/pluto/pkg/errs"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/prometheus/prometheus/storage"
+)
+
+// rangeReduceLabel is added to the selector of rewritten function. The value is "function:reducer"
+const rangeReduceLabel = "__pluto_reduce__"
+
+// rangeReduceEngine rewrites functions counting samples into sums of bucket reducers, so they can use range_resolution:
+//
+//	count_over_time(x[5m]) => sum_over_time(x{__pluto_reduce__="count_over_time:count"}[5m])
+//	avg_over_time(x[5m]) => sum_over_time(x{__pluto_reduce__="avg_over_time:sum"}[5m]) / sum_over_time(x{__pluto_reduce__="avg_over_time:count"}[5m])
+type rangeReduceEngine struct {
+	promql.QueryEngine
+}
+
+var _ promql.QueryEngine = &rangeReduceEngine{}
+
+// newRangeReduceEngine returns the engine as is if range_resolution is not configured
+func newRangeReduceEngine(engine promql.QueryEngine, cfg *config.Config) promql.QueryEngine {
+	enabled := cfg.Select.RangeResolution > 0
+	for _, o := range cfg.OverrideSamples {
+		enabled = enabled || o.RangeResolution > 0
+	}
+	if !enabled {
+		return engine
+	}
+	return &rangeReduceEngine{QueryEngine: engine}
+}
+
+// NewInstantQuery implements promql.QueryEngine.
+func (e *rangeReduceEngine) NewInstantQuery(ctx context.Context, q storage.Queryable, opts promql.QueryOpts, qs string, ts time.Time) (promql.Query, error) {
+	return e.QueryEngine.NewInstantQuery(ctx, q, opts, rangeReduceQuery(qs), ts)
+}
+
+// NewRangeQuery implements promql.QueryEngine.
+func (e *rangeReduceEngine) NewRangeQuery(ctx context.Context, q storage.Queryable, opts promql.QueryOpts, qs string, start, end time.Time, interval time.Duration) (promql.Query, error) {
+	return e.QueryEngine.NewRangeQuery(ctx, q, opts, rangeReduceQuery(qs), start, end, interval)
+}
+
+// rangeReduceQuery returns the original query if nothing can be rewritten or the query is invalid
+func rangeReduceQuery(qs string) string {
+	expr, err := parser.ParseExpr(qs)
+	if err != nil {
+		return qs
+	}
+	expr, changed := rangeReduceRewrite(expr)
+	if !changed {
+		return qs
+	}
+	return expr.String()
+}
+
+// rangeReduceRewrite replaces count_over_time and avg_over_time of selectors. Returns false if nothing is changed
+func rangeReduceRewrite(expr parser.Expr) (parser.Expr, bool) {
+	root := expr
+	changed := false
+	parser.Inspect(expr, func(node parser.Node, path []parser.Node) error {
+		n, ok := node.(*parser.Call)
+		if !ok || (n.Func.Name != "count_over_time" && n.Func.Name != "avg_over_time") {
+			return nil
+		}
+		ms := rangeReduceSelector(n)
+		if ms == nil {
+			return nil
+		}
+
+		if n.Func.Name == "count_over_time" {
+			markRangeReduce(ms.VectorSelector.(*parser.VectorSelector), "count_over_time:count")
+			n.Func = parser.Functions["sum_over_time"]
+			changed = true
+			return nil
+		}
+
+		sum := &parser.Call{Func: parser.Functions["sum_over_time"], Args: parser.Expressions{ms}, PosRange: n.PosRange}
+		countSelector, err := parser.ParseExpr(ms.String())
+		if err != nil {
+			return nil
+		}
+		markRangeReduce(ms.VectorSelector.(*parser.VectorSelector), "avg_over_time:sum")
+		markRangeReduce(countSelector.(*parser.MatrixSelector).VectorSelector.(*parser.VectorSelector), "avg_over_time:count")
+		count := &parser.Call{Func: parser.Functions["sum_over_time"], Args: parser.Expressions{countSelector}, PosRange: n.PosRange}
+		avg := &parser.BinaryExpr{Op: parser.DIV, LHS: sum, RHS: count}
+
+		if len(path) == 0 {
+			root = avg
+		} else {
+			replaceChild(path[len(path)-1], n, avg)
+		}
+		changed = true
+		return nil
+	})
+	return root, changed
+}
+
+// rangeReduceSelector returns the range selector of the function if it reads the storage directly
+func rangeReduceSelector(n *parser.Call) *parser.MatrixSelector {
+	if len(n.Args) != 1 {
+		return nil
+	}
+	ms, ok := n.Args[0].(*parser.MatrixSelector)
+	if !ok {
+		return nil
+	}
+	vs, ok := ms.VectorSelector.(*parser.VectorSelector)
+	if !ok {
+		return nil
+	}
+	for _, m := range vs.LabelMatchers {
+		if m.Name == rangeReduceLabel {
+			return nil
+		}
+	}
+	return ms
+}
+
+func markRangeReduce(vs *parser.VectorSelector, value string) {
+	vs.LabelMatchers = append(vs.LabelMatchers, labels.MustNewMatcher(labels.MatchEqual, rangeReduceLabel, value))
+}
+
+// replaceChild replaces the argument of the parent expression
+func replaceChild(parent parser.Node, old, new parser.Expr) {
+	switch p := parent.(type) {
+	case *parser.AggregateExpr:
+		if p.Expr == old {
+			p.Expr = new
+		}
+	case *parser.BinaryExpr:
+		if p.LHS == old {
+			p.LHS = new
+		}
+		if p.RHS == old {
+			p.RHS = new
+		}
+	case *parser.Call:
+		for i := range p.Args {
+			if p.Args[i] == old {
+				p.Args[i] = new
+			}
+		}
+	case *parser.ParenExpr:
+		p.Expr = new
+	case *parser.SubqueryExpr:
+		p.Expr = new
+	case *parser.UnaryExpr:
+		p.Expr = new
+	}
+}
+
+// rangeReduceOp extracts the function and the reducer marked by rangeReduceEngine. The original function
+// is restored in hints, so overrides see it in func
+func rangeReduceOp(hints *storage.SelectHints, matchers []*labels.Matcher) (string, *storage.SelectHints, []*labels.Matcher, error) {
+	op := ""
+	ret := make([]*labels.Matcher, 0, len(matchers))
+	for _, m := range matchers {
+		if m.Name == rangeReduceLabel {
+			op = m.Value
+			continue
+		}
+		ret = append(ret, m)
+	}
+	if op == "" {
+		return "", hints, matchers, nil
+	}
+
+	fn, reduce, _ := strings.Cut(op, ":")
+	valid := (fn == "count_over_time" && reduce == "count") || (fn == "avg_over_time" && (reduce == "sum" || reduce == "count"))
+	if !valid || hints == nil || hints.Func != "sum_over_time" || hints.Range == 0 {
+		return "", nil, nil, errs.NewErrorWithCode("unexpected "+rangeReduceLabel+" matcher", http.StatusBadRequest)
+	}
+	reduced := *hints
+	reduced.Func = fn
+	return reduce, &reduced, ret, nil
+}
+
+type rangeReduceKey struct{}
+
+// withRangeReduce makes Select return buckets reduced by count or sum regardless of the function
+func withRangeReduce(ctx context.Context, reduce string) context.Context {
+	return context.WithValue(ctx, rangeReduceKey{}, reduce)
+}
+
+func rangeReducer(ctx context.Context) string {
+	reduce, _ := ctx.Value(rangeReduceKey{}).(string)
+	return reduce
+}
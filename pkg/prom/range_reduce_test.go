@@ -0,0 +1,67 @@
+package prom
+
+import (
+	"testing"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRangeReduceRewrite(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string // empty if not changed
+	}{
+		{`count_over_time(up[5m])`, `sum_over_time(up{__pluto_reduce__="count_over_time:count"}[5m])`},
+		{`avg_over_time(up{job="a"}[5m])`, `sum_over_time(up{__pluto_reduce__="avg_over_time:sum",job="a"}[5m]) / sum_over_time(up{__pluto_reduce__="avg_over_time:count",job="a"}[5m])`},
+		{`sum by (job) (avg_over_time(up[5m] offset 1m))`, `sum by (job) (sum_over_time(up{__pluto_reduce__="avg_over_time:sum"}[5m] offset 1m) / sum_over_time(up{__pluto_reduce__="avg_over_time:count"}[5m] offset 1m))`},
+		{`1 - count_over_time(up[5m])`, `1 - sum_over_time(up{__pluto_reduce__="count_over_time:count"}[5m])`},
+		// not eligible
+		{`avg_over_time(rate(x[5m])[1h:1m])`, ""},
+		{`sum_over_time(up[5m])`, ""},
+		{`up`, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			expr, err := parser.ParseExpr(tt.query)
+			require.NoError(t, err)
+			expr, changed := rangeReduceRewrite(expr)
+			if tt.want == "" {
+				assert.False(t, changed)
+				return
+			}
+			assert.True(t, changed)
+			// the engine parses the result again
+			_, err = parser.ParseExpr(expr.String())
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, expr.String())
+		})
+	}
+}
+
+func TestRangeReduceOp(t *testing.T) {
+	up := labels.MustNewMatcher(labels.MatchEqual, "__name__", "up")
+	marker := func(op string) *labels.Matcher {
+		return labels.MustNewMatcher(labels.MatchEqual, rangeReduceLabel, op)
+	}
+
+	reduce, hints, matchers, err := rangeReduceOp(&storage.SelectHints{Func: "sum_over_time", Range: 300000}, []*labels.Matcher{up, marker("avg_over_time:count")})
+	require.NoError(t, err)
+	assert.Equal(t, "count", reduce)
+	assert.Equal(t, &storage.SelectHints{Func: "avg_over_time", Range: 300000}, hints)
+	assert.Equal(t, []*labels.Matcher{up}, matchers)
+
+	reduce, _, matchers, err = rangeReduceOp(&storage.SelectHints{Func: "rate", Range: 300000}, []*labels.Matcher{up})
+	require.NoError(t, err)
+	assert.Equal(t, "", reduce)
+	assert.Equal(t, []*labels.Matcher{up}, matchers)
+
+	// marker without the rewritten function
+	_, _, _, err = rangeReduceOp(&storage.SelectHints{Func: "abs"}, []*labels.Matcher{up, marker("count_over_time:count")})
+	assert.Error(t, err)
+	_, _, _, err = rangeReduceOp(&storage.SelectHints{Func: "sum_over_time", Range: 300000}, []*labels.Matcher{up, marker("count_over_time:sum")})
+	assert.Error(t, err)
+}
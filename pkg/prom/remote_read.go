@@ -0,0 +1,45 @@
+package prom
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/storage"
+)
+
+type rawSamplesKey struct{}
+
+// withRawSamples makes Select return all samples instead of one per step
+func withRawSamples(ctx context.Context) context.Context {
+	return context.WithValue(ctx, rawSamplesKey{}, true)
+}
+
+func isRawSamples(ctx context.Context) bool {
+	raw, _ := ctx.Value(rawSamplesKey{}).(bool)
+	return raw
+}
+
+// rawSamplesHandler marks remote read requests: Prometheus passes the hints of the original query,
+// but the client expects raw samples
+func rawSamplesHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/read") {
+			r = r.WithContext(withRawSamples(r.Context()))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// chunkQuerier encodes raw samples to XOR chunks
+type chunkQuerier struct {
+	*Querier
+}
+
+var _ storage.ChunkQuerier = &chunkQuerier{}
+
+// Select returns a set of series that matches the given label matchers.
+func (q *chunkQuerier) Select(ctx context.Context, sortSeries bool, selectHints *storage.SelectHints, labelsMatcher ...*labels.Matcher) storage.ChunkSeriesSet {
+	return storage.NewSeriesSetToChunkSet(q.Querier.Select(withRawSamples(ctx), sortSeries, selectHints, labelsMatcher...))
+}
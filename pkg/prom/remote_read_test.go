@@ -0,0 +1,63 @@
+package prom
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRawSamplesHandler(t *testing.T) {
+	tests := []struct {
+		path string
+		raw  bool
+	}{
+		{"/api/v1/read", true},
+		{"/api/v1/query_range", false},
+		{"/api/v1/series", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			var raw bool
+			h := rawSamplesHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				raw = isRawSamples(r.Context())
+			}))
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, tt.path, nil))
+			assert.Equal(t, tt.raw, raw)
+		})
+	}
+}
+
+func TestRawSeriesSetToChunks(t *testing.T) {
+	s := &series{labels: labels.FromStrings("__name__", "up")}
+	for i := int64(0); i < 10; i++ {
+		s.sampleAppend(i*1000, float64(i))
+	}
+
+	ss, err := makeSeriesSet([]series{*s})
+	require.NoError(t, err)
+
+	cs := storage.NewSeriesSetToChunkSet(ss)
+	require.True(t, cs.Next())
+
+	var got []int64
+	it := cs.At().Iterator(nil)
+	for it.Next() {
+		chk := it.At()
+		assert.Equal(t, chunkenc.EncXOR, chk.Chunk.Encoding())
+		sit := chk.Chunk.Iterator(nil)
+		for sit.Next() == chunkenc.ValFloat {
+			ts, _ := sit.At()
+			got = append(got, ts)
+		}
+	}
+	require.NoError(t, it.Err())
+	// every sample is returned despite of the step
+	assert.Len(t, got, 10)
+	assert.False(t, cs.Next())
+}
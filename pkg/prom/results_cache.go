@@ -0,0 +1,415 @@
+package prom
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pluto-metrics/pluto/pkg/config"
+	"github.com/pluto-metrics/pluto/pkg/tenant"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql/parser"
+	"golang.org/x/sync/errgroup"
+)
+
+const dayMs = int64(24 * time.Hour / time.Millisecond)
+
+var resultsCacheExtents = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "pluto_results_cache_extents_total",
+	Help: "Extents of query_range requests by cache result",
+}, []string{"result"})
+
+// parameters of query_range which can be cached, others bypass the cache
+var resultsCacheParams = map[string]bool{
+	"query":   true,
+	"start":   true,
+	"end":     true,
+	"step":    true,
+	"timeout": true,
+}
+
+// resultsCache splits query_range requests by days and caches results of every day.
+// Results newer than now-freshness are always requested from the storage
+type resultsCache struct {
+	next        http.Handler
+	freshness   int64
+	concurrency int
+	store       *extentStore
+}
+
+// errExtentFailed stops other extents of the request, the failed response is returned as is
+var errExtentFailed = errors.New("extent failed")
+
+func newResultsCache(cfg *config.Config, next http.Handler) http.Handler {
+	if !cfg.Prometheus.ResultsCache.Enabled {
+		return next
+	}
+	return &resultsCache{
+		next:        next,
+		freshness:   cfg.Prometheus.ResultsCache.Freshness.Milliseconds(),
+		concurrency: cfg.Prometheus.ResultsCache.Concurrency,
+		store:       newExtentStore(cfg.Prometheus.ResultsCache.MaxItems, cfg.Prometheus.ResultsCache.Dir, cfg.Prometheus.ResultsCache.TTL),
+	}
+}
+
+// rangeRequest is a cacheable query_range request. Timestamps in milliseconds
+type rangeRequest struct {
+	form  url.Values
+	key   string
+	start int64
+	end   int64
+	step  int64
+}
+
+// rangeExtent is a part of the request within one day
+type rangeExtent struct {
+	start     int64
+	end       int64
+	cacheable bool
+}
+
+// extent is a cached result. Matrix contains samples from start to end inclusive
+type extent struct {
+	Start  int64        `json:"start"`
+	End    int64        `json:"end"`
+	Matrix model.Matrix `json:"matrix"`
+}
+
+// apiResponse is a response of query_range
+type apiResponse struct {
+	Status string `json:"status"`
+	Data   struct {
+		ResultType string       `json:"resultType"`
+		Result     model.Matrix `json:"result"`
+	} `json:"data"`
+	Warnings []string `json:"warnings,omitempty"`
+	Infos    []string `json:"infos,omitempty"`
+	// samples newer than the watermark are not returned yet
+	watermarkCut bool
+}
+
+// responseRecorder keeps response of the wrapped handler
+type responseRecorder struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func (rec *responseRecorder) Header() http.Header { return rec.header }
+
+func (rec *responseRecorder) Write(p []byte) (int, error) { return rec.body.Write(p) }
+
+func (rec *responseRecorder) WriteHeader(code int) { rec.code = code }
+
+func (rec *responseRecorder) writeTo(w http.ResponseWriter) {
+	for k, v := range rec.header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(rec.code)
+	w.Write(rec.body.Bytes())
+}
+
+func (c *resultsCache) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasSuffix(r.URL.Path, "/query_range") {
+		c.next.ServeHTTP(w, r)
+		return
+	}
+	req, ok := parseRangeRequest(r)
+	if !ok {
+		resultsCacheExtents.WithLabelValues("bypass").Inc()
+		c.next.ServeHTTP(w, r)
+		return
+	}
+
+	extents := req.extents(timeNow().UnixMilli() - c.freshness)
+	responses := make([]*apiResponse, len(extents))
+	var failed *responseRecorder
+	var failedOnce sync.Once
+
+	g, ctx := errgroup.WithContext(r.Context())
+	if c.concurrency > 0 {
+		g.SetLimit(c.concurrency)
+	}
+	sub := r.WithContext(ctx)
+	for i, e := range extents {
+		g.Go(func() error {
+			resp, f := c.extent(sub, req, e)
+			if f != nil {
+				// responses of extents canceled after the first failure are ignored
+				failedOnce.Do(func() { failed = f })
+				return errExtentFailed
+			}
+			responses[i] = resp
+			return nil
+		})
+	}
+	if g.Wait() != nil {
+		// errors are returned as is
+		failed.writeTo(w)
+		return
+	}
+
+	result := &apiResponse{Status: "success"}
+	result.Data.ResultType = "matrix"
+	matrices := make([]model.Matrix, 0, len(extents))
+	for _, resp := range responses {
+		matrices = append(matrices, resp.Data.Result)
+		result.Warnings = appendUniq(result.Warnings, resp.Warnings...)
+		result.Infos = appendUniq(result.Infos, resp.Infos...)
+	}
+	result.Data.Result = mergeMatrix(matrices...)
+
+	body, err := json.Marshal(result)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// extent returns result of the extent from the cache or storage. Failed response is returned if storage fails
+func (c *resultsCache) extent(r *http.Request, req *rangeRequest, e rangeExtent) (*apiResponse, *responseRecorder) {
+	if !e.cacheable {
+		resultsCacheExtents.WithLabelValues("fresh").Inc()
+		return c.run(r, req, e.start, e.end)
+	}
+
+	key := fmt.Sprintf("%s\xff%d", req.key, e.start/dayMs)
+	cached, ok := c.store.get(key)
+	if ok && cached.Start <= e.start && cached.End >= e.end {
+		resultsCacheExtents.WithLabelValues("hit").Inc()
+		resp := &apiResponse{Status: "success"}
+		resp.Data.Result = trimMatrix(cached.Matrix, e.start, e.end)
+		return resp, nil
+	}
+
+	start := e.start
+	if ok && cached.Start <= e.start && cached.End >= e.start-req.step {
+		// only the tail is requested
+		start = cached.End + req.step
+		resultsCacheExtents.WithLabelValues("partial").Inc()
+	} else {
+		ok = false
+		resultsCacheExtents.WithLabelValues("miss").Inc()
+	}
+
+	resp, failed := c.run(r, req, start, e.end)
+	if failed != nil {
+		return nil, failed
+	}
+
+	stored := &extent{Start: start, End: e.end, Matrix: resp.Data.Result}
+	if ok {
+		stored = &extent{Start: cached.Start, End: e.end, Matrix: mergeMatrix(cached.Matrix, resp.Data.Result)}
+	}
+	// results with warnings or cut by the watermark may be incomplete
+	if len(resp.Warnings) == 0 && !resp.watermarkCut {
+		c.store.put(key, stored)
+	}
+	resp.Data.Result = trimMatrix(stored.Matrix, e.start, e.end)
+	return resp, nil
+}
+
+// run executes the request with the range replaced
+func (c *resultsCache) run(r *http.Request, req *rangeRequest, start, end int64) (*apiResponse, *responseRecorder) {
+	form := url.Values{}
+	for k, v := range req.form {
+		form[k] = v
+	}
+	form.Set("start", formatTimestamp(start))
+	form.Set("end", formatTimestamp(end))
+
+	ctx, cut := withWatermarkCut(r.Context())
+	sub := r.Clone(ctx)
+	sub.Method = http.MethodGet
+	sub.URL.RawQuery = form.Encode()
+	sub.Body = http.NoBody
+	sub.ContentLength = 0
+	sub.Form = nil
+	sub.PostForm = nil
+	sub.Header.Del("Content-Type")
+	sub.Header.Del("Accept-Encoding")
+
+	rec := &responseRecorder{header: make(http.Header), code: http.StatusOK}
+	c.next.ServeHTTP(rec, sub)
+	if rec.code != http.StatusOK {
+		return nil, rec
+	}
+
+	resp := &apiResponse{}
+	if err := json.Unmarshal(rec.body.Bytes(), resp); err != nil || resp.Status != "success" || resp.Data.ResultType != "matrix" {
+		return nil, rec
+	}
+	resp.watermarkCut = cut.Load()
+	return resp, nil
+}
+
+func parseRangeRequest(r *http.Request) (*rangeRequest, bool) {
+	if err := r.ParseForm(); err != nil {
+		return nil, false
+	}
+	for k := range r.Form {
+		if !resultsCacheParams[k] {
+			return nil, false
+		}
+	}
+
+	start, err := parseTimestamp(r.Form.Get("start"))
+	if err != nil {
+		return nil, false
+	}
+	end, err := parseTimestamp(r.Form.Get("end"))
+	if err != nil {
+		return nil, false
+	}
+	step, err := parseStep(r.Form.Get("step"))
+	if err != nil || step <= 0 || end < start || start%step != 0 {
+		// evaluation timestamps of not aligned requests don't match extents of other requests
+		return nil, false
+	}
+
+	expr, err := parser.ParseExpr(r.Form.Get("query"))
+	if err != nil || dependsOnRange(expr) {
+		return nil, false
+	}
+
+	return &rangeRequest{
+		form: r.Form,
+		// formatting and comments of the query don't change the result
+		key:   fmt.Sprintf("%s\xff%s\xff%d", tenant.FromContext(r.Context()), expr.String(), step),
+		start: start,
+		end:   end,
+		step:  step,
+	}, true
+}
+
+// dependsOnRange reports if the result depends on start and end of the query: @ start() and @ end()
+func dependsOnRange(expr parser.Expr) bool {
+	found := false
+	parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+		switch n := node.(type) {
+		case *parser.VectorSelector:
+			found = found || n.StartOrEnd != 0
+		case *parser.SubqueryExpr:
+			found = found || n.StartOrEnd != 0
+		}
+		return nil
+	})
+	return found
+}
+
+// extents splits the request by days. The part after cutoff is not cacheable
+func (req *rangeRequest) extents(cutoff int64) []rangeExtent {
+	var ret []rangeExtent
+	add := func(start, last int64) {
+		// last evaluation timestamp not after last
+		end := start + (last-start)/req.step*req.step
+		if start <= end && end < cutoff {
+			ret = append(ret, rangeExtent{start: start, end: end, cacheable: true})
+			return
+		}
+		if start < cutoff {
+			fresh := cutoff + (req.step-cutoff%req.step)%req.step
+			ret = append(ret, rangeExtent{start: start, end: fresh - req.step, cacheable: true})
+			start = fresh
+		}
+		if start <= end {
+			ret = append(ret, rangeExtent{start: start, end: end})
+		}
+	}
+
+	for t := req.start; t <= req.end; {
+		last := min(req.end, (t/dayMs+1)*dayMs-1)
+		add(t, last)
+		// the next evaluation timestamp after the day
+		t = req.start + ((last-req.start)/req.step+1)*req.step
+	}
+	return ret
+}
+
+// trimMatrix returns samples within [start, end]
+func trimMatrix(m model.Matrix, start, end int64) model.Matrix {
+	ret := make(model.Matrix, 0, len(m))
+	for _, s := range m {
+		i := sort.Search(len(s.Values), func(i int) bool { return int64(s.Values[i].Timestamp) >= start })
+		j := sort.Search(len(s.Values), func(i int) bool { return int64(s.Values[i].Timestamp) > end })
+		if i >= j {
+			continue
+		}
+		ret = append(ret, &model.SampleStream{Metric: s.Metric, Values: s.Values[i:j]})
+	}
+	return ret
+}
+
+// mergeMatrix concatenates samples of the same series from sequential ranges
+func mergeMatrix(ms ...model.Matrix) model.Matrix {
+	index := make(map[model.Fingerprint]*model.SampleStream)
+	ret := make(model.Matrix, 0)
+	for _, m := range ms {
+		for _, s := range m {
+			fp := s.Metric.Fingerprint()
+			if d, ok := index[fp]; ok {
+				d.Values = append(d.Values, s.Values...)
+				continue
+			}
+			d := &model.SampleStream{Metric: s.Metric, Values: append([]model.SamplePair(nil), s.Values...)}
+			index[fp] = d
+			ret = append(ret, d)
+		}
+	}
+	sort.Sort(ret)
+	return ret
+}
+
+func appendUniq(dst []string, values ...string) []string {
+	for _, v := range values {
+		found := false
+		for _, d := range dst {
+			found = found || d == v
+		}
+		if !found {
+			dst = append(dst, v)
+		}
+	}
+	return dst
+}
+
+// parseTimestamp parses unix timestamp in seconds or RFC3339 as prometheus API does
+func parseTimestamp(s string) (int64, error) {
+	if t, err := strconv.ParseFloat(s, 64); err == nil {
+		return int64(math.Round(t * 1000)), nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return 0, err
+	}
+	return t.UnixMilli(), nil
+}
+
+// parseStep parses duration in seconds or prometheus format to milliseconds
+func parseStep(s string) (int64, error) {
+	if d, err := strconv.ParseFloat(s, 64); err == nil {
+		return int64(math.Round(d * 1000)), nil
+	}
+	d, err := model.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(d).Milliseconds(), nil
+}
+
+func formatTimestamp(ms int64) string {
+	return strconv.FormatFloat(float64(ms)/1000, 'f', -1, 64)
+}
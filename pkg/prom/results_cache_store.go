@@ -0,0 +1,137 @@
+package prom
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pluto-metrics/pluto/pkg/lg"
+)
+
+type extentItem struct {
+	key   string
+	value *extent
+}
+
+// extentStore is in-memory LRU of extents with optional on-disk backend
+type extentStore struct {
+	maxItems int
+	dir      string
+	ttl      time.Duration
+
+	sync.Mutex
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+func newExtentStore(maxItems int, dir string, ttl time.Duration) *extentStore {
+	return &extentStore{
+		maxItems: maxItems,
+		dir:      dir,
+		ttl:      ttl,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+func (s *extentStore) get(key string) (*extent, bool) {
+	s.Lock()
+	if el, ok := s.items[key]; ok {
+		s.ll.MoveToFront(el)
+		s.Unlock()
+		return el.Value.(*extentItem).value, true
+	}
+	s.Unlock()
+
+	if s.dir == "" {
+		return nil, false
+	}
+	value, ok := s.readFile(key)
+	if ok {
+		s.add(key, value)
+	}
+	return value, ok
+}
+
+func (s *extentStore) put(key string, value *extent) {
+	s.add(key, value)
+	if s.dir != "" {
+		s.writeFile(key, value)
+	}
+}
+
+func (s *extentStore) add(key string, value *extent) {
+	s.Lock()
+	defer s.Unlock()
+
+	if el, ok := s.items[key]; ok {
+		el.Value.(*extentItem).value = value
+		s.ll.MoveToFront(el)
+		return
+	}
+	s.items[key] = s.ll.PushFront(&extentItem{key: key, value: value})
+	for s.maxItems > 0 && s.ll.Len() > s.maxItems {
+		el := s.ll.Back()
+		s.ll.Remove(el)
+		delete(s.items, el.Value.(*extentItem).key)
+	}
+}
+
+func (s *extentStore) filename(key string) string {
+	h := sha256.Sum256([]byte(key))
+	return filepath.Join(s.dir, hex.EncodeToString(h[:])+".json")
+}
+
+func (s *extentStore) readFile(key string) (*extent, bool) {
+	filename := s.filename(key)
+	st, err := os.Stat(filename)
+	if err != nil {
+		return nil, false
+	}
+	if s.ttl > 0 && time.Since(st.ModTime()) > s.ttl {
+		os.Remove(filename)
+		return nil, false
+	}
+	// #nosec G304
+	body, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, false
+	}
+	value := &extent{}
+	if err := json.Unmarshal(body, value); err != nil {
+		slog.Error("can't read results cache file", slog.String("filename", filename), lg.Error(err))
+		os.Remove(filename)
+		return nil, false
+	}
+	return value, true
+}
+
+func (s *extentStore) writeFile(key string, value *extent) {
+	body, err := json.Marshal(value)
+	if err != nil {
+		return
+	}
+	filename := s.filename(key)
+	tmp, err := os.CreateTemp(s.dir, ".tmp-*")
+	if err == nil {
+		_, err = tmp.Write(body)
+		if closeErr := tmp.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = os.Rename(tmp.Name(), filename)
+		}
+		if err != nil {
+			os.Remove(tmp.Name())
+		}
+	}
+	if err != nil {
+		slog.Error("can't write results cache file", slog.String("filename", filename), lg.Error(err))
+	}
+}
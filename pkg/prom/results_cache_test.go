@@ -0,0 +1,285 @@
+package prom
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pluto-metrics/pluto/pkg/config"
+	"github.com/pluto-metrics/pluto/pkg/watermark"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// rangeBackend returns one series with value=timestamp for every step of the request
+type rangeBackend struct {
+	sync.Mutex
+	calls [][2]int64
+	code  int
+	// select is cut by the watermark if not zero
+	watermark int64
+	// requests are served after the delay, maxRunning counts concurrent ones
+	delay      time.Duration
+	running    int
+	maxRunning int
+}
+
+func (b *rangeBackend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start, _ := parseTimestamp(r.FormValue("start"))
+	end, _ := parseTimestamp(r.FormValue("end"))
+	step, _ := parseStep(r.FormValue("step"))
+	b.Lock()
+	b.calls = append(b.calls, [2]int64{start, end})
+	b.running++
+	b.maxRunning = max(b.maxRunning, b.running)
+	b.Unlock()
+	defer func() {
+		b.Lock()
+		b.running--
+		b.Unlock()
+	}()
+	time.Sleep(b.delay)
+
+	if b.watermark != 0 {
+		done := watermark.Default.Begin("", b.watermark)
+		watermarkEnd(r.Context(), end)
+		done()
+	}
+	if b.code != 0 {
+		http.Error(w, "failed", b.code)
+		return
+	}
+
+	resp := &apiResponse{Status: "success"}
+	resp.Data.ResultType = "matrix"
+	s := &model.SampleStream{Metric: model.Metric{"job": "a"}}
+	for t := start; t <= end; t += step {
+		s.Values = append(s.Values, model.SamplePair{Timestamp: model.Time(t), Value: model.SampleValue(t)})
+	}
+	resp.Data.Result = model.Matrix{s}
+	body, _ := json.Marshal(resp)
+	w.Write(body)
+}
+
+// received returns ranges of requests ordered by start, extents are requested concurrently
+func (b *rangeBackend) received() [][2]int64 {
+	b.Lock()
+	defer b.Unlock()
+	ret := append([][2]int64{}, b.calls...)
+	sort.Slice(ret, func(i, j int) bool { return ret[i][0] < ret[j][0] })
+	return ret
+}
+
+func (b *rangeBackend) reset() {
+	b.Lock()
+	defer b.Unlock()
+	b.calls = nil
+}
+
+func newTestResultsCache(t *testing.T, next http.Handler, dir string) http.Handler {
+	cfg := &config.Config{}
+	cfg.Prometheus.ResultsCache.Enabled = true
+	cfg.Prometheus.ResultsCache.MaxItems = 100
+	cfg.Prometheus.ResultsCache.Freshness = 10 * time.Minute
+	cfg.Prometheus.ResultsCache.Dir = dir
+	cfg.Prometheus.ResultsCache.TTL = time.Hour
+	cfg.Prometheus.ResultsCache.Concurrency = 2
+	return newResultsCache(cfg, next)
+}
+
+func queryRange(t *testing.T, h http.Handler, form url.Values) (int, *apiResponse) {
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/query_range?"+form.Encode(), nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	resp := &apiResponse{}
+	if w.Code == http.StatusOK {
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), resp))
+	}
+	return w.Code, resp
+}
+
+func rangeForm(start, end int64, step string) url.Values {
+	return url.Values{
+		"query": {"up"},
+		"start": {formatTimestamp(start)},
+		"end":   {formatTimestamp(end)},
+		"step":  {step},
+	}
+}
+
+func TestResultsCache(t *testing.T) {
+	now := time.Date(2024, 1, 3, 12, 0, 0, 0, time.UTC)
+	defer func(f func() time.Time) { timeNow = f }(timeNow)
+	timeNow = func() time.Time { return now }
+
+	day := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).UnixMilli()
+	backend := &rangeBackend{}
+	h := newTestResultsCache(t, backend, "")
+
+	// two days and the fresh tail
+	start := day + 23*time.Hour.Milliseconds()
+	end := now.UnixMilli()
+	code, resp := queryRange(t, h, rangeForm(start, end, "60"))
+	require.Equal(t, http.StatusOK, code)
+	require.Len(t, resp.Data.Result, 1)
+	values := resp.Data.Result[0].Values
+	assert.Equal(t, int((end-start)/60000+1), len(values))
+	for i, v := range values {
+		assert.Equal(t, model.Time(start+int64(i)*60000), v.Timestamp)
+	}
+	cutoff := now.UnixMilli() - 10*time.Minute.Milliseconds()
+	assert.Equal(t, [][2]int64{
+		{start, day + dayMs - 60000},
+		{day + dayMs, day + 2*dayMs - 60000},
+		{day + 2*dayMs, cutoff - 60000},
+		{cutoff, end},
+	}, backend.received())
+
+	// cached days, only fresh part is requested
+	backend.reset()
+	code, resp2 := queryRange(t, h, rangeForm(start, end, "60"))
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, resp.Data.Result, resp2.Data.Result)
+	assert.Equal(t, [][2]int64{{cutoff, end}}, backend.received())
+
+	// tail of the last day
+	now = now.Add(time.Hour)
+	backend.reset()
+	code, resp3 := queryRange(t, h, rangeForm(start, now.UnixMilli(), "60"))
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, int((now.UnixMilli()-start)/60000+1), len(resp3.Data.Result[0].Values))
+	assert.Equal(t, [][2]int64{
+		{cutoff, cutoff + time.Hour.Milliseconds() - 60000},
+		{cutoff + time.Hour.Milliseconds(), now.UnixMilli()},
+	}, backend.received())
+
+	// part of cached day
+	backend.reset()
+	code, resp4 := queryRange(t, h, rangeForm(day+dayMs+60000, day+dayMs+120000, "60"))
+	require.Equal(t, http.StatusOK, code)
+	assert.Empty(t, backend.received())
+	assert.Len(t, resp4.Data.Result[0].Values, 2)
+}
+
+func TestResultsCacheBypass(t *testing.T) {
+	backend := &rangeBackend{}
+	h := newTestResultsCache(t, backend, "")
+	day := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).UnixMilli()
+
+	// not aligned start
+	queryRange(t, h, rangeForm(day+1000, day+dayMs+1000, "60"))
+	assert.Equal(t, [][2]int64{{day + 1000, day + dayMs + 1000}}, backend.received())
+
+	// unknown parameter
+	backend.reset()
+	form := rangeForm(day, day+dayMs, "60")
+	form.Set("lookback_delta", "1m")
+	queryRange(t, h, form)
+	assert.Equal(t, [][2]int64{{day, day + dayMs}}, backend.received())
+
+	// @ start()
+	backend.reset()
+	form = rangeForm(day, day+dayMs, "60")
+	form.Set("query", "up @ start()")
+	queryRange(t, h, form)
+	assert.Equal(t, [][2]int64{{day, day + dayMs}}, backend.received())
+}
+
+func TestResultsCacheError(t *testing.T) {
+	backend := &rangeBackend{code: http.StatusUnprocessableEntity}
+	h := newTestResultsCache(t, backend, "")
+	day := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).UnixMilli()
+
+	code, _ := queryRange(t, h, rangeForm(day, day+dayMs, "60"))
+	assert.Equal(t, http.StatusUnprocessableEntity, code)
+
+	// errors are not cached
+	backend.code = 0
+	backend.reset()
+	code, _ = queryRange(t, h, rangeForm(day, day+dayMs, "60"))
+	assert.Equal(t, http.StatusOK, code)
+	assert.Len(t, backend.received(), 2)
+}
+
+func TestResultsCacheConcurrency(t *testing.T) {
+	backend := &rangeBackend{delay: 50 * time.Millisecond}
+	h := newTestResultsCache(t, backend, "")
+	day := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).UnixMilli()
+
+	// four days are requested two at a time
+	code, resp := queryRange(t, h, rangeForm(day, day+4*dayMs-60000, "60"))
+	require.Equal(t, http.StatusOK, code)
+	assert.Len(t, resp.Data.Result[0].Values, int(4*dayMs/60000))
+	assert.Len(t, backend.received(), 4)
+	assert.Equal(t, 2, backend.maxRunning)
+}
+
+func TestResultsCacheKey(t *testing.T) {
+	backend := &rangeBackend{}
+	h := newTestResultsCache(t, backend, "")
+	day := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).UnixMilli()
+
+	code, _ := queryRange(t, h, rangeForm(day, day+dayMs-60000, "60"))
+	require.Equal(t, http.StatusOK, code)
+
+	// the same parsed query
+	backend.reset()
+	form := rangeForm(day, day+dayMs-60000, "60")
+	form.Set("query", "  up # comment")
+	code, _ = queryRange(t, h, form)
+	require.Equal(t, http.StatusOK, code)
+	assert.Empty(t, backend.received())
+}
+
+func TestResultsCacheWatermark(t *testing.T) {
+	day := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).UnixMilli()
+	backend := &rangeBackend{watermark: day + time.Hour.Milliseconds()}
+	h := newTestResultsCache(t, backend, "")
+
+	code, _ := queryRange(t, h, rangeForm(day, day+dayMs-1, "60"))
+	assert.Equal(t, http.StatusOK, code)
+
+	// results cut by the watermark are not cached
+	backend.watermark = 0
+	backend.reset()
+	code, _ = queryRange(t, h, rangeForm(day, day+dayMs-1, "60"))
+	assert.Equal(t, http.StatusOK, code)
+	assert.Len(t, backend.received(), 1)
+
+	backend.reset()
+	code, _ = queryRange(t, h, rangeForm(day, day+dayMs-1, "60"))
+	assert.Equal(t, http.StatusOK, code)
+	assert.Empty(t, backend.received())
+}
+
+func TestExtentStore(t *testing.T) {
+	dir := t.TempDir()
+	value := &extent{Start: 1000, End: 2000, Matrix: model.Matrix{
+		{Metric: model.Metric{"job": "a"}, Values: []model.SamplePair{{Timestamp: 1000, Value: 1}}},
+	}}
+
+	s := newExtentStore(1, dir, time.Hour)
+	s.put("a", value)
+	s.put("b", value)
+
+	// evicted from memory, loaded from disk
+	s2 := newExtentStore(1, dir, time.Hour)
+	v, ok := s2.get("a")
+	require.True(t, ok)
+	assert.Equal(t, value, v)
+
+	// memory only
+	s3 := newExtentStore(1, "", time.Hour)
+	s3.put("a", value)
+	s3.put("b", value)
+	_, ok = s3.get("a")
+	assert.False(t, ok)
+	_, ok = s3.get("b")
+	assert.True(t, ok)
+}
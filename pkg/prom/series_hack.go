@@ -1,13 +1,19 @@
 package prom
 
 import (
-	"math"
 	"strings"
 
 	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/storage"
 )
 
+// histogramHacks reports if incomplete scrapes of histograms are removed after select.
+// The watermark covers only requests of insert running in the same process, so it replaces hacks only if all writers are local
+func (q *Querier) histogramHacks(raw bool, data []series) bool {
+	local := q.config.Insert.Enabled && q.config.Insert.Watermark.AllWritersLocal
+	return !raw && !local && isHistogram(data)
+}
+
 func isHistogram(data []series) bool {
 	if len(data) < 2 {
 		return false
@@ -86,27 +92,10 @@ func hackHistogram(data []series, hints *storage.SelectHints) []series {
 	return data
 }
 
-func hackRate(data []series, hints *storage.SelectHints) []series {
-	for i := 0; i < len(data); i++ {
-		if len(data[i].samples) == 0 {
-			continue
-		}
-		data[i].samples = append(data[i].samples, sample{
-			timestamp: data[i].samples[len(data[i].samples)-1].timestamp + hints.Step,
-			value:     math.NaN(),
-		})
-	}
-	return data
-}
-
 func hackSeries(data []series, hints *storage.SelectHints) []series {
 	if isHistogram(data) {
 		return hackHistogram(data, hints)
 	}
 
-	if hints.Step > 0 && hints.Func == "rate" {
-		return hackRate(data, hints)
-	}
-
 	return data
 }
@@ -2,12 +2,14 @@ package prom
 
 import (
 	"log"
+	"math"
 	"sort"
 
 	"github.com/prometheus/prometheus/util/annotations"
 
 	"github.com/prometheus/prometheus/model/histogram"
 	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/value"
 	"github.com/prometheus/prometheus/storage"
 	"github.com/prometheus/prometheus/tsdb/chunkenc"
 )
@@ -40,15 +42,9 @@ type seriesSet struct {
 
 var _ storage.SeriesSet = &seriesSet{}
 
-func makeSeriesSet(data []series, hints *storage.SelectHints) (storage.SeriesSet, error) {
+// makeSeriesSet sorts samples
+func makeSeriesSet(data []series) (storage.SeriesSet, error) {
 	ss := &seriesSet{data: data, current: -1}
-	if len(ss.data) == 0 {
-		return ss, nil
-	}
-
-	if len(data) == 0 {
-		return ss, nil
-	}
 
 	// sort all samples
 	for index := 0; index < len(ss.data); index++ {
@@ -57,9 +53,6 @@ func makeSeriesSet(data []series, hints *storage.SelectHints) (storage.SeriesSet
 		})
 	}
 
-	// some points may not be saved in the storage yet and this breaks the histogram_quantile function. incomplete data needs to be removed
-	ss.data = hackSeries(ss.data, hints)
-
 	return ss, nil
 }
 
@@ -172,6 +165,28 @@ func (s *series) Labels() labels.Labels {
 	return s.labels
 }
 
+// bucket is a step of samples aggregated by ClickHouse
+type bucket struct {
+	timestamp     int64
+	value         float64
+	count         uint64 // not stale samples, timestamp and value are empty if zero
+	lastTimestamp int64
+	lastStale     uint8
+}
+
+// bucketAppend adds the first sample of the bucket and staleness marker if the series ended in the bucket
+func (s *series) bucketAppend(b bucket) {
+	if s == nil {
+		return
+	}
+	if b.count > 0 {
+		s.sampleAppend(b.timestamp, b.value)
+	}
+	if b.lastStale != 0 && (b.count == 0 || b.lastTimestamp > b.timestamp) {
+		s.sampleAppend(b.lastTimestamp, math.Float64frombits(value.StaleNaN))
+	}
+}
+
 func (s *series) sampleAppend(timestamp int64, value float64) {
 	if s == nil {
 		return
@@ -0,0 +1,48 @@
+package prom
+
+import (
+	"math"
+	"testing"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/value"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBucketAppendStaleness(t *testing.T) {
+	assert := assert.New(t)
+
+	s := &series{labels: labels.FromStrings("__name__", "up")}
+	// regular bucket
+	s.bucketAppend(bucket{timestamp: 1000, value: 1, count: 2, lastTimestamp: 5000})
+	// series ended inside of the bucket
+	s.bucketAppend(bucket{timestamp: 15000, value: 1, count: 1, lastTimestamp: 20000, lastStale: 1})
+	// only staleness marker in the bucket
+	s.bucketAppend(bucket{lastTimestamp: 45000, lastStale: 1})
+
+	ss, err := makeSeriesSet([]series{*s})
+	require.NoError(t, err)
+	require.True(t, ss.Next())
+
+	it := ss.At().Iterator(nil)
+	var timestamps []int64
+	var stale []bool
+	for it.Next() == chunkenc.ValFloat {
+		ts, v := it.At()
+		timestamps = append(timestamps, ts)
+		stale = append(stale, value.IsStaleNaN(v))
+	}
+
+	assert.Equal([]int64{1000, 15000, 20000, 45000}, timestamps)
+	assert.Equal([]bool{false, false, true, true}, stale)
+}
+
+func TestBucketAppendNaN(t *testing.T) {
+	s := &series{}
+	s.bucketAppend(bucket{timestamp: 1000, value: math.NaN(), count: 1, lastTimestamp: 1000})
+	require.Len(t, s.samples, 1)
+	assert.True(t, math.IsNaN(s.samples[0].value))
+	assert.False(t, value.IsStaleNaN(s.samples[0].value))
+}
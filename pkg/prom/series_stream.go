@@ -0,0 +1,263 @@
+package prom
+
+import (
+	"context"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/pluto-metrics/rowbinary"
+	"github.com/pluto-metrics/rowbinary/schema"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/util/annotations"
+)
+
+// sample slices are reused after the querier is closed
+var samplesPool = sync.Pool{
+	New: func() interface{} { return make([]sample, 0, 128) },
+}
+
+// seriesIndex numbers unique label sets of found series.
+// Ids with the same labels get the same index and are merged by ClickHouse
+type seriesIndex struct {
+	ids    []string
+	index  []uint32
+	labels []labels.Labels
+}
+
+// newSeriesIndex orders indexes by labels if sortSeries is set
+func newSeriesIndex(seriesMap map[string]labels.Labels, sortSeries bool) *seriesIndex {
+	uniq := make(map[string]labels.Labels, len(seriesMap))
+	for _, lb := range seriesMap {
+		uniq[labelsMapKey(lb)] = lb
+	}
+
+	x := &seriesIndex{
+		ids:    make([]string, 0, len(seriesMap)),
+		index:  make([]uint32, 0, len(seriesMap)),
+		labels: make([]labels.Labels, 0, len(uniq)),
+	}
+	for _, lb := range uniq {
+		x.labels = append(x.labels, lb)
+	}
+	if sortSeries {
+		sort.Slice(x.labels, func(i, j int) bool {
+			return labels.Compare(x.labels[i], x.labels[j]) < 0
+		})
+	}
+
+	keyIndex := make(map[string]uint32, len(x.labels))
+	for i, lb := range x.labels {
+		keyIndex[labelsMapKey(lb)] = uint32(i)
+	}
+	for id, lb := range seriesMap {
+		x.ids = append(x.ids, id)
+		x.index = append(x.index, keyIndex[labelsMapKey(lb)])
+	}
+	return x
+}
+
+// writeIDs writes external table with structure "id String, s UInt32"
+func (x *seriesIndex) writeIDs(w io.Writer) error {
+	schemaWriter := schema.NewWriter(w).
+		Format(schema.RowBinary).
+		Column("id", rowbinary.String).
+		Column("s", rowbinary.UInt32)
+
+	for i := 0; i < len(x.ids); i++ {
+		if err := schemaWriter.WriteValues(x.ids[i], x.index[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// series returns unique series without samples
+func (x *seriesIndex) series() []series {
+	ret := make([]series, len(x.labels))
+	for i := 0; i < len(x.labels); i++ {
+		ret[i].labels = x.labels[i]
+	}
+	return ret
+}
+
+// samplesReader reads rows of the select response: series index and raw sample or bucket
+func samplesReader(rd rowbinary.Reader, raw bool, timestampUInt32 bool) (*schema.Reader, func() (uint32, bucket, error)) {
+	r := schema.NewReader(rd).
+		Format(schema.RowBinary).
+		Column(rowbinary.UInt32) // series index
+
+	timestampType := rowbinary.Any(rowbinary.Int64) // timestamp int64 with ms
+	if timestampUInt32 {
+		timestampType = rowbinary.UInt32 // timestamp uint32
+	}
+	if raw {
+		r = r.Column(timestampType)     // timestamp
+		r = r.Column(rowbinary.Float64) // value
+	} else {
+		r = r.Column(timestampType)     // bucket timestamp
+		r = r.Column(rowbinary.Float64) // bucket value
+		r = r.Column(rowbinary.UInt64)  // not stale samples count
+		r = r.Column(timestampType)     // last timestamp
+		r = r.Column(rowbinary.UInt8)   // last sample is stale
+	}
+
+	readTimestamp := func() int64 {
+		if timestampUInt32 {
+			timestamp32, _ := schema.Read(r, rowbinary.UInt32)
+			return int64(timestamp32) * 1000
+		}
+		timestamp, _ := schema.Read(r, rowbinary.Int64)
+		return timestamp
+	}
+
+	return r, func() (uint32, bucket, error) {
+		var b bucket
+		s, _ := schema.Read(r, rowbinary.UInt32)
+		b.timestamp = readTimestamp()
+		b.value, _ = schema.Read(r, rowbinary.Float64)
+		if raw {
+			// raw sample is a bucket with the only sample, staleness markers are kept as is
+			b.count = 1
+			return s, b, r.Err()
+		}
+		b.count, _ = schema.Read(r, rowbinary.UInt64)
+		b.lastTimestamp = readTimestamp()
+		b.lastStale, _ = schema.Read(r, rowbinary.UInt8)
+		return s, b, r.Err()
+	}
+}
+
+// streamSeriesSet reads series from ClickHouse response ordered by series index and timestamp.
+// Each series is returned as soon as its last row is read
+type streamSeriesSet struct {
+	ctx     context.Context
+	labels  []labels.Labels // by series index
+	reader  *schema.Reader
+	readRow func() (uint32, bucket, error)
+	closer  io.Closer
+	// zero is no limit
+	maxSamples int
+	samples    int
+
+	current      *series
+	currentIndex uint32
+	// first row of the next series
+	pending      bucket
+	pendingIndex uint32
+	hasPending   bool
+
+	done      bool
+	err       error
+	allocated [][]sample
+}
+
+var _ storage.SeriesSet = &streamSeriesSet{}
+
+// Next reads rows of the next series
+func (ss *streamSeriesSet) Next() bool {
+	for !ss.done {
+		if !ss.hasPending && !ss.readPending() {
+			break
+		}
+
+		s := &series{labels: ss.labels[ss.pendingIndex], samples: samplesPool.Get().([]sample)[:0]}
+		index := ss.pendingIndex
+		for ss.hasPending && ss.pendingIndex == index {
+			n := len(s.samples)
+			s.bucketAppend(ss.pending)
+			ss.hasPending = false
+			ss.samples += len(s.samples) - n
+			if ss.maxSamples > 0 && ss.samples > ss.maxSamples {
+				ss.finish(limitError("max_samples", ss.maxSamples))
+				break
+			}
+			ss.readPending()
+		}
+		ss.allocated = append(ss.allocated, s.samples)
+
+		if ss.err != nil {
+			// incomplete series
+			break
+		}
+		if len(s.samples) > 0 {
+			ss.current, ss.currentIndex = s, index
+			return true
+		}
+	}
+	ss.current = nil
+	return false
+}
+
+// readPending reads the next row. Returns false on the end of response or error
+func (ss *streamSeriesSet) readPending() bool {
+	if ss.done {
+		return false
+	}
+	if err := ss.ctx.Err(); err != nil {
+		ss.finish(err)
+		return false
+	}
+	if !ss.reader.Next() {
+		ss.finish(ss.reader.Err())
+		return false
+	}
+	index, b, err := ss.readRow()
+	if err != nil {
+		ss.finish(err)
+		return false
+	}
+	if int(index) >= len(ss.labels) {
+		ss.finish(errors.Errorf("unexpected series index %d", index))
+		return false
+	}
+	ss.pending, ss.pendingIndex, ss.hasPending = b, index, true
+	return true
+}
+
+// finish closes the response. Safe to call several times
+func (ss *streamSeriesSet) finish(err error) {
+	if ss.done {
+		return
+	}
+	ss.done = true
+	ss.err = err
+	if ss.closer != nil {
+		ss.closer.Close()
+	}
+}
+
+// release returns sample slices to the pool. Series must not be used after it
+func (ss *streamSeriesSet) release() {
+	ss.finish(nil)
+	for _, s := range ss.allocated {
+		samplesPool.Put(s[:0]) // nolint:staticcheck
+	}
+	ss.allocated = nil
+	ss.current = nil
+}
+
+// collect reads all series
+func (ss *streamSeriesSet) collect() ([]series, error) {
+	var ret []series
+	for ss.Next() {
+		ret = append(ret, *ss.current)
+	}
+	return ret, ss.Err()
+}
+
+// At returns the current series
+func (ss *streamSeriesSet) At() storage.Series {
+	if ss.current == nil {
+		return nil
+	}
+	return ss.current
+}
+
+// Err returns the current error.
+func (ss *streamSeriesSet) Err() error { return ss.err }
+
+// Warnings ...
+func (ss *streamSeriesSet) Warnings() annotations.Annotations { return nil }
@@ -0,0 +1,109 @@
+package prom
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/pluto-metrics/rowbinary"
+	"github.com/pluto-metrics/rowbinary/schema"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type closeCounter struct {
+	closed int
+}
+
+func (c *closeCounter) Close() error {
+	c.closed++
+	return nil
+}
+
+func TestSeriesIndex(t *testing.T) {
+	x := newSeriesIndex(map[string]labels.Labels{
+		"b":  labels.FromStrings("__name__", "up", "job", "b"),
+		"a1": labels.FromStrings("__name__", "up", "job", "a"),
+		"a2": labels.FromStrings("__name__", "up", "job", "a"),
+	}, true)
+
+	require.Len(t, x.labels, 2)
+	assert.Equal(t, "a", x.labels[0].Get("job"))
+	assert.Equal(t, "b", x.labels[1].Get("job"))
+
+	index := make(map[string]uint32)
+	for i, id := range x.ids {
+		index[id] = x.index[i]
+	}
+	assert.Equal(t, map[string]uint32{"a1": 0, "a2": 0, "b": 1}, index)
+}
+
+func TestStreamSeriesSet(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := schema.NewWriter(buf).
+		Format(schema.RowBinary).
+		Column("s", rowbinary.UInt32).
+		Column("timestamp", rowbinary.Int64).
+		Column("value", rowbinary.Float64)
+	require.NoError(t, w.WriteValues(uint32(0), int64(1000), float64(1)))
+	require.NoError(t, w.WriteValues(uint32(0), int64(2000), float64(2)))
+	require.NoError(t, w.WriteValues(uint32(2), int64(1000), float64(3)))
+
+	closer := &closeCounter{}
+	r, readRow := samplesReader(buf, true, false)
+	ss := &streamSeriesSet{
+		ctx:     context.Background(),
+		labels:  []labels.Labels{labels.FromStrings("job", "a"), labels.FromStrings("job", "b"), labels.FromStrings("job", "c")},
+		reader:  r,
+		readRow: readRow,
+		closer:  closer,
+	}
+
+	type result struct {
+		job        string
+		timestamps []int64
+	}
+	var got []result
+	for ss.Next() {
+		res := result{job: ss.At().Labels().Get("job")}
+		it := ss.At().Iterator(nil)
+		for it.Next() == chunkenc.ValFloat {
+			ts, _ := it.At()
+			res.timestamps = append(res.timestamps, ts)
+		}
+		got = append(got, res)
+	}
+	require.NoError(t, ss.Err())
+	// series without samples are skipped
+	assert.Equal(t, []result{{"a", []int64{1000, 2000}}, {"c", []int64{1000}}}, got)
+	assert.Equal(t, 1, closer.closed)
+
+	ss.release()
+	assert.Equal(t, 1, closer.closed)
+	assert.False(t, ss.Next())
+}
+
+func TestStreamSeriesSetError(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := schema.NewWriter(buf).
+		Format(schema.RowBinary).
+		Column("s", rowbinary.UInt32).
+		Column("timestamp", rowbinary.Int64)
+	require.NoError(t, w.WriteValues(uint32(0), int64(1000)))
+
+	closer := &closeCounter{}
+	r, readRow := samplesReader(buf, true, false)
+	ss := &streamSeriesSet{
+		ctx:     context.Background(),
+		labels:  []labels.Labels{labels.FromStrings("job", "a")},
+		reader:  r,
+		readRow: readRow,
+		closer:  closer,
+	}
+	assert.False(t, ss.Next())
+	assert.ErrorIs(t, ss.Err(), io.EOF)
+	assert.Equal(t, 1, closer.closed)
+}
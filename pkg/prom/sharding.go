@@ -0,0 +1,236 @@
+package prom
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pluto-metrics/pluto/pkg/config"
+	"github.com/pluto-metrics/pluto/pkg/errs"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/util/annotations"
+)
+
+// shardLabel is added to the selector of a sharded leg. The value is "index/count"
+const shardLabel = "__pluto_shard__"
+
+// functions which need all series of the selector at once or create series from nothing
+var shardUnsafeFunctions = map[string]bool{
+	"absent":             true,
+	"absent_over_time":   true,
+	"histogram_quantile": true,
+	"histogram_fraction": true,
+	"info":               true,
+	"scalar":             true,
+	"vector":             true,
+}
+
+// shardingEngine rewrites aggregations into legs reading disjoint subsets of series:
+//
+//	sum by (job) (x) => sum by (job) (label_replace(sum by (job) (x{__pluto_shard__="0/2"}), "__pluto_shard__", "0", "", "") or label_replace(...))
+//
+// Select of every leg is executed in background, so shards are read by ClickHouse and decoded concurrently
+type shardingEngine struct {
+	promql.QueryEngine
+	shards int
+}
+
+var _ promql.QueryEngine = &shardingEngine{}
+
+func newShardingEngine(engine promql.QueryEngine, cfg *config.Config) promql.QueryEngine {
+	if cfg.Prometheus.QueryShards < 2 {
+		return engine
+	}
+	return &shardingEngine{QueryEngine: engine, shards: cfg.Prometheus.QueryShards}
+}
+
+// NewInstantQuery implements promql.QueryEngine.
+func (e *shardingEngine) NewInstantQuery(ctx context.Context, q storage.Queryable, opts promql.QueryOpts, qs string, ts time.Time) (promql.Query, error) {
+	return e.QueryEngine.NewInstantQuery(ctx, q, opts, e.rewrite(qs), ts)
+}
+
+// NewRangeQuery implements promql.QueryEngine.
+func (e *shardingEngine) NewRangeQuery(ctx context.Context, q storage.Queryable, opts promql.QueryOpts, qs string, start, end time.Time, interval time.Duration) (promql.Query, error) {
+	return e.QueryEngine.NewRangeQuery(ctx, q, opts, e.rewrite(qs), start, end, interval)
+}
+
+// rewrite returns the original query if nothing can be sharded or the query is invalid
+func (e *shardingEngine) rewrite(qs string) string {
+	expr, err := parser.ParseExpr(qs)
+	if err != nil {
+		return qs
+	}
+	if !shardRewrite(expr, e.shards) {
+		return qs
+	}
+	return expr.String()
+}
+
+// shardRewrite replaces argument of eligible aggregations with union of sharded legs. Returns false if nothing is changed
+func shardRewrite(expr parser.Expr, shards int) bool {
+	changed := false
+	parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+		n, ok := node.(*parser.AggregateExpr)
+		if !ok || !shardable(n) {
+			return nil
+		}
+
+		legs := make([]string, shards)
+		for i := 0; i < shards; i++ {
+			inner, err := parser.ParseExpr(n.Expr.String())
+			if err != nil {
+				return nil
+			}
+			parser.Inspect(inner, func(node parser.Node, _ []parser.Node) error {
+				if vs, ok := node.(*parser.VectorSelector); ok {
+					vs.LabelMatchers = append(vs.LabelMatchers, labels.MustNewMatcher(labels.MatchEqual, shardLabel, fmt.Sprintf("%d/%d", i, shards)))
+				}
+				return nil
+			})
+			leg := &parser.AggregateExpr{Op: n.Op, Expr: inner, Grouping: n.Grouping}
+			// results of legs have the same labels, the shard label keeps all of them in the union
+			legs[i] = fmt.Sprintf(`label_replace(%s, %q, "%d", "", "")`, leg, shardLabel, i)
+		}
+		union, err := parser.ParseExpr(strings.Join(legs, " or "))
+		if err != nil {
+			return nil
+		}
+
+		n.Expr = union
+		if n.Op == parser.COUNT {
+			n.Op = parser.SUM
+		}
+		changed = true
+		return nil
+	})
+	return changed
+}
+
+// shardable reports if the aggregation can be computed from the same aggregations of disjoint sets of series.
+// The argument must read one selector and must not combine series
+func shardable(n *parser.AggregateExpr) bool {
+	if n.Without || n.Param != nil {
+		return false
+	}
+	switch n.Op {
+	case parser.SUM, parser.MIN, parser.MAX, parser.COUNT:
+	default:
+		return false
+	}
+
+	ok := true
+	selectors := 0
+	parser.Inspect(n.Expr, func(node parser.Node, _ []parser.Node) error {
+		switch e := node.(type) {
+		case *parser.AggregateExpr:
+			ok = false
+		case *parser.BinaryExpr:
+			// vector matching joins series of different shards
+			if e.LHS.Type() == parser.ValueTypeVector && e.RHS.Type() == parser.ValueTypeVector {
+				ok = false
+			}
+		case *parser.Call:
+			if shardUnsafeFunctions[e.Func.Name] {
+				ok = false
+			}
+		case *parser.VectorSelector:
+			selectors++
+			for _, m := range e.LabelMatchers {
+				if m.Name == shardLabel {
+					ok = false
+				}
+			}
+		}
+		return nil
+	})
+	return ok && selectors == 1
+}
+
+// shardHints extracts the shard marked by shardingEngine
+func shardHints(hints *storage.SelectHints, matchers []*labels.Matcher) (*storage.SelectHints, []*labels.Matcher, error) {
+	shard := ""
+	ret := make([]*labels.Matcher, 0, len(matchers))
+	for _, m := range matchers {
+		if m.Name == shardLabel {
+			shard = m.Value
+			continue
+		}
+		ret = append(ret, m)
+	}
+	if shard == "" {
+		return hints, matchers, nil
+	}
+
+	var index, count uint64
+	if _, err := fmt.Sscanf(shard, "%d/%d", &index, &count); err != nil || count == 0 || index >= count {
+		return nil, nil, errs.NewErrorWithCode("unexpected "+shardLabel+" matcher", http.StatusBadRequest)
+	}
+	sharded := *hints
+	sharded.ShardIndex = index
+	sharded.ShardCount = count
+	return &sharded, ret, nil
+}
+
+// prefetchSeriesSet reads all series of the select in background
+type prefetchSeriesSet struct {
+	done    chan struct{}
+	series  []storage.Series
+	current int
+	err     error
+	ann     annotations.Annotations
+}
+
+var _ storage.SeriesSet = &prefetchSeriesSet{}
+
+// prefetch runs the select in background. Querier.Close waits for it
+func (q *Querier) prefetch(fn func() storage.SeriesSet) storage.SeriesSet {
+	ps := &prefetchSeriesSet{done: make(chan struct{}), current: -1}
+	q.prefetching.Add(1)
+	go func() {
+		defer q.prefetching.Done()
+		defer close(ps.done)
+
+		ss := fn()
+		for ss.Next() {
+			ps.series = append(ps.series, ss.At())
+		}
+		ps.err = ss.Err()
+		ps.ann = ss.Warnings()
+	}()
+	return ps
+}
+
+// Next waits for the select
+func (ps *prefetchSeriesSet) Next() bool {
+	<-ps.done
+	if ps.err != nil || ps.current+1 >= len(ps.series) {
+		return false
+	}
+	ps.current++
+	return true
+}
+
+// At returns the current series
+func (ps *prefetchSeriesSet) At() storage.Series {
+	if ps.current < 0 || ps.current >= len(ps.series) {
+		return nil
+	}
+	return ps.series[ps.current]
+}
+
+// Err returns the current error.
+func (ps *prefetchSeriesSet) Err() error {
+	<-ps.done
+	return ps.err
+}
+
+// Warnings ...
+func (ps *prefetchSeriesSet) Warnings() annotations.Annotations {
+	<-ps.done
+	return ps.ann
+}
@@ -0,0 +1,226 @@
+package prom
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pluto-metrics/pluto/pkg/config"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/util/teststorage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShardRewrite(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string // empty if not changed
+	}{
+		{`sum by (job) (up)`, `sum by (job) (label_replace(sum by (job) (up{__pluto_shard__="0/2"}), "__pluto_shard__", "0", "", "") or label_replace(sum by (job) (up{__pluto_shard__="1/2"}), "__pluto_shard__", "1", "", ""))`},
+		{`count(rate(x[5m]))`, `sum(label_replace(count(rate(x{__pluto_shard__="0/2"}[5m])), "__pluto_shard__", "0", "", "") or label_replace(count(rate(x{__pluto_shard__="1/2"}[5m])), "__pluto_shard__", "1", "", ""))`},
+		{`max(up * 2)`, `max(label_replace(max(up{__pluto_shard__="0/2"} * 2), "__pluto_shard__", "0", "", "") or label_replace(max(up{__pluto_shard__="1/2"} * 2), "__pluto_shard__", "1", "", ""))`},
+		// inner aggregation only
+		{`avg(sum by (job) (up))`, `avg(sum by (job) (label_replace(sum by (job) (up{__pluto_shard__="0/2"}), "__pluto_shard__", "0", "", "") or label_replace(sum by (job) (up{__pluto_shard__="1/2"}), "__pluto_shard__", "1", "", "")))`},
+		// not eligible
+		{`sum(a / b)`, ""},
+		{`sum without (job) (up)`, ""},
+		{`avg by (job) (up)`, ""},
+		{`topk(5, up)`, ""},
+		{`sum(histogram_quantile(0.9, x))`, ""},
+		{`count(absent(up))`, ""},
+		{`up`, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			expr, err := parser.ParseExpr(tt.query)
+			require.NoError(t, err)
+			changed := shardRewrite(expr, 2)
+			if tt.want == "" {
+				assert.False(t, changed)
+				return
+			}
+			assert.True(t, changed)
+			_, err = parser.ParseExpr(expr.String())
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, expr.String())
+		})
+	}
+}
+
+// shardedQueryable reads legs marked by shardingEngine as Querier does
+type shardedQueryable struct {
+	storage.Queryable
+	legs atomic.Int64
+}
+
+func (s *shardedQueryable) Querier(mint, maxt int64) (storage.Querier, error) {
+	q, err := s.Queryable.Querier(mint, maxt)
+	if err != nil {
+		return nil, err
+	}
+	return &shardedQuerier{Querier: q, legs: &s.legs}, nil
+}
+
+type shardedQuerier struct {
+	storage.Querier
+	legs *atomic.Int64
+}
+
+func (q *shardedQuerier) Select(ctx context.Context, sortSeries bool, hints *storage.SelectHints, matchers ...*labels.Matcher) storage.SeriesSet {
+	hints, matchers, err := shardHints(hints, matchers)
+	if err != nil {
+		return storage.ErrSeriesSet(err)
+	}
+	if hints == nil || hints.ShardCount == 0 {
+		return q.Querier.Select(ctx, sortSeries, hints, matchers...)
+	}
+	q.legs.Add(1)
+	all := *hints
+	all.ShardIndex, all.ShardCount = 0, 0
+	return &shardSeriesSet{SeriesSet: q.Querier.Select(ctx, sortSeries, &all, matchers...), index: hints.ShardIndex, count: hints.ShardCount}
+}
+
+// shardSeriesSet skips series of other shards
+type shardSeriesSet struct {
+	storage.SeriesSet
+	index, count uint64
+}
+
+func (ss *shardSeriesSet) Next() bool {
+	for ss.SeriesSet.Next() {
+		if ss.At().Labels().Hash()%ss.count == ss.index {
+			return true
+		}
+	}
+	return false
+}
+
+func TestShardingEngine(t *testing.T) {
+	st := teststorage.New(t)
+	defer st.Close()
+
+	// counters of 12 series, one of them is reset in the middle
+	start := time.Unix(0, 0).UTC()
+	app := st.Appender(context.Background())
+	for i := 0; i < 12; i++ {
+		lb := labels.FromStrings("__name__", "x", "job", fmt.Sprintf("job%d", i%3), "instance", fmt.Sprintf("i%d", i))
+		for k := int64(0); k < 240; k++ {
+			v := float64(k * int64(i+1))
+			if i == 5 && k >= 120 {
+				v = float64(k - 120)
+			}
+			_, err := app.Append(0, lb, start.Add(time.Duration(k)*15*time.Second).UnixMilli(), v)
+			require.NoError(t, err)
+		}
+	}
+	require.NoError(t, app.Commit())
+
+	engine := promql.NewEngine(promql.EngineOpts{MaxSamples: 1000000, Timeout: time.Minute})
+	cfg := &config.Config{}
+	cfg.Prometheus.QueryShards = 3
+	sharding := newShardingEngine(engine, cfg)
+
+	queries := []string{
+		`sum by (job) (x)`,
+		`count by (job) (x)`,
+		`min by (job) (x)`,
+		`max by (job) (x)`,
+		`sum(x)`,
+		`sum by (job) (rate(x[5m]))`,
+		`count(rate(x[5m]))`,
+		`min by (job) (increase(x[5m]))`,
+		`max by (job) (rate(x{job!="job1"}[5m]) * 60)`,
+		`sum by (job) (rate(x[5m])) / on (job) count by (job) (x)`,
+	}
+	for _, qs := range queries {
+		t.Run(qs, func(t *testing.T) {
+			run := func(e promql.QueryEngine, q storage.Queryable) promql.Matrix {
+				query, err := e.NewRangeQuery(context.Background(), q, nil, qs, start.Add(10*time.Minute), start.Add(time.Hour), time.Minute)
+				require.NoError(t, err)
+				// samples of the result are reused after close
+				t.Cleanup(query.Close)
+				res := query.Exec(context.Background())
+				require.NoError(t, res.Err)
+				m, err := res.Matrix()
+				require.NoError(t, err)
+				return m
+			}
+
+			sharded := &shardedQueryable{Queryable: st}
+			want := run(engine, st)
+			got := run(sharding, sharded)
+			assert.Positive(t, sharded.legs.Load(), "the query is not sharded")
+
+			require.NotEmpty(t, want)
+			require.Len(t, got, len(want))
+			for i := range want {
+				assert.False(t, got[i].Metric.Has(shardLabel), got[i].Metric.String())
+				require.Equal(t, want[i].Metric, got[i].Metric)
+				require.Len(t, got[i].Floats, len(want[i].Floats), want[i].Metric.String())
+				for j := range want[i].Floats {
+					assert.Equal(t, want[i].Floats[j].T, got[i].Floats[j].T)
+					// sums of legs are added in other order
+					assert.InDelta(t, want[i].Floats[j].F, got[i].Floats[j].F, 1e-9, want[i].Metric.String())
+				}
+			}
+		})
+	}
+}
+
+func TestShardingEngineDisabled(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Prometheus.QueryShards = 1
+	assert.Nil(t, newShardingEngine(nil, cfg))
+}
+
+func TestShardHints(t *testing.T) {
+	up := labels.MustNewMatcher(labels.MatchEqual, "__name__", "up")
+	shard := labels.MustNewMatcher(labels.MatchEqual, shardLabel, "1/4")
+	hints := &storage.SelectHints{Start: 1000, End: 2000, Func: "sum"}
+
+	sharded, matchers, err := shardHints(hints, []*labels.Matcher{up, shard})
+	require.NoError(t, err)
+	assert.Equal(t, []*labels.Matcher{up}, matchers)
+	assert.Equal(t, &storage.SelectHints{Start: 1000, End: 2000, Func: "sum", ShardIndex: 1, ShardCount: 4}, sharded)
+	// hints of the engine are not changed
+	assert.Equal(t, uint64(0), hints.ShardCount)
+
+	same, matchers, err := shardHints(hints, []*labels.Matcher{up})
+	require.NoError(t, err)
+	assert.Same(t, hints, same)
+	assert.Equal(t, []*labels.Matcher{up}, matchers)
+
+	for _, v := range []string{"4/4", "1/0", "x"} {
+		_, _, err = shardHints(hints, []*labels.Matcher{up, labels.MustNewMatcher(labels.MatchEqual, shardLabel, v)})
+		assert.Error(t, err, v)
+	}
+}
+
+func TestPrefetchSeriesSet(t *testing.T) {
+	q := &Querier{}
+	release := make(chan struct{})
+	ss := q.prefetch(func() storage.SeriesSet {
+		<-release
+		return newLabelsSeriesSet([]labels.Labels{labels.FromStrings("job", "a"), labels.FromStrings("job", "b")})
+	})
+	close(release)
+
+	var names []string
+	for ss.Next() {
+		names = append(names, ss.At().Labels().Get("job"))
+	}
+	require.NoError(t, ss.Err())
+	assert.Equal(t, []string{"a", "b"}, names)
+	require.NoError(t, q.Close())
+
+	failed := q.prefetch(func() storage.SeriesSet { return errorSeriesSet(errors.New("failed")) })
+	assert.False(t, failed.Next())
+	assert.EqualError(t, failed.Err(), "failed")
+}
@@ -9,12 +9,13 @@ import (
 
 type storageImpl struct {
 	config *config.Config
+	stats  *tsdbStats
 }
 
 var _ storage.Storage = &storageImpl{}
 
 func newStorage(config *config.Config) *storageImpl {
-	return &storageImpl{config: config}
+	return &storageImpl{config: config, stats: newTSDBStats(config)}
 }
 
 // Querier returns a new Querier on the storage.
@@ -26,9 +27,15 @@ func (s *storageImpl) Querier(mint, maxt int64) (storage.Querier, error) {
 	}, nil
 }
 
-// ChunkQuerier ...
+// ChunkQuerier returns a new ChunkQuerier on the storage. Used by remote read with streamed chunks
 func (s *storageImpl) ChunkQuerier(mint, maxt int64) (storage.ChunkQuerier, error) {
-	return nil, nil
+	return &chunkQuerier{
+		Querier: &Querier{
+			config: s.config,
+			mint:   mint,
+			maxt:   maxt,
+		},
+	}, nil
 }
 
 // Appender ...
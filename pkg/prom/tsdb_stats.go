@@ -0,0 +1,273 @@
+package prom
+
+import (
+	"bufio"
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/pluto-metrics/pluto/pkg/config"
+	"github.com/pluto-metrics/pluto/pkg/lg"
+	"github.com/pluto-metrics/pluto/pkg/sql"
+	"github.com/pluto-metrics/rowbinary"
+	"github.com/pluto-metrics/rowbinary/schema"
+	"github.com/prometheus/prometheus/tsdb"
+	"github.com/prometheus/prometheus/tsdb/index"
+)
+
+// tsdbStats computes cardinality statistics of /api/v1/status/tsdb from the series table.
+// Statistics are cached and refreshed in background
+type tsdbStats struct {
+	config *config.Config
+
+	// one refresh at once
+	refreshMu sync.Mutex
+
+	mu    sync.Mutex
+	stats *tsdb.Stats
+}
+
+func newTSDBStats(cfg *config.Config) *tsdbStats {
+	return &tsdbStats{config: cfg}
+}
+
+// run refreshes statistics until ctx is done
+func (ts *tsdbStats) run(ctx context.Context) {
+	cfg := ts.config.Prometheus.TSDBStatus
+	if !cfg.Enabled || cfg.RefreshInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(cfg.RefreshInterval)
+	defer ticker.Stop()
+	for {
+		if err := ts.refresh(ctx); err != nil && ctx.Err() == nil {
+			slog.ErrorContext(ctx, "can't refresh tsdb stats", lg.Error(err))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// get returns cached statistics with top limit items. Statistics are computed on the first call if not ready yet
+func (ts *tsdbStats) get(limit int) (*tsdb.Stats, error) {
+	if !ts.config.Prometheus.TSDBStatus.Enabled {
+		return &tsdb.Stats{IndexPostingStats: &index.PostingsStats{}}, nil
+	}
+	if ts.config.Tenant.Enabled {
+		// statistics are computed over all series
+		return nil, errors.New("tsdb status is not available with multi-tenancy")
+	}
+
+	ts.mu.Lock()
+	stats := ts.stats
+	ts.mu.Unlock()
+
+	if stats == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), ts.config.Prometheus.QueryTimeout)
+		defer cancel()
+		if err := ts.refresh(ctx); err != nil {
+			return nil, err
+		}
+		ts.mu.Lock()
+		stats = ts.stats
+		ts.mu.Unlock()
+	}
+
+	ret := *stats
+	ret.IndexPostingStats = &index.PostingsStats{
+		CardinalityMetricsStats: topStats(stats.IndexPostingStats.CardinalityMetricsStats, limit),
+		CardinalityLabelStats:   topStats(stats.IndexPostingStats.CardinalityLabelStats, limit),
+		LabelValueStats:         topStats(stats.IndexPostingStats.LabelValueStats, limit),
+		LabelValuePairsStats:    topStats(stats.IndexPostingStats.LabelValuePairsStats, limit),
+		NumLabelPairs:           stats.IndexPostingStats.NumLabelPairs,
+	}
+	return &ret, nil
+}
+
+func topStats(s []index.Stat, limit int) []index.Stat {
+	if limit > 0 && len(s) > limit {
+		return s[:limit]
+	}
+	return s
+}
+
+func (ts *tsdbStats) refresh(ctx context.Context) error {
+	ts.refreshMu.Lock()
+	defer ts.refreshMu.Unlock()
+
+	stats, err := ts.compute(ctx)
+	if err != nil {
+		return err
+	}
+
+	ts.mu.Lock()
+	ts.stats = stats
+	ts.mu.Unlock()
+	return nil
+}
+
+// compute reads statistics of series seen during the window
+func (ts *tsdbStats) compute(ctx context.Context) (*tsdb.Stats, error) {
+	cfg := ts.config.Prometheus.TSDBStatus
+	q := &Querier{config: ts.config}
+
+	now := timeNow()
+	start := now.Add(-cfg.Window).UnixMilli()
+	end := now.UnixMilli()
+
+	seriesCfg, err := ts.config.GetSeries(&config.EnvSeries{Start: start, End: end})
+	if err != nil {
+		return nil, err
+	}
+
+	where := sql.NewWhere()
+	q.whereSeriesTimeRange(ctx, where, start, end)
+
+	params := map[string]interface{}{
+		"table": seriesCfg.Table,
+		"where": where,
+		"limit": cfg.Limit,
+	}
+
+	stats := &tsdb.Stats{IndexPostingStats: &index.PostingsStats{}}
+
+	// head stats
+	head, err := q.statsQuery(ctx, seriesCfg, `
+		SELECT 'series', uniqExact(id) FROM {{.table}} {{.where.SQL}}
+		UNION ALL
+		SELECT 'min_time', toUInt64(greatest(min(timestamp_min), 0)) FROM {{.table}} {{.where.SQL}}
+		UNION ALL
+		SELECT 'max_time', toUInt64(greatest(max(timestamp_max), 0)) FROM {{.table}} {{.where.SQL}}
+		UNION ALL
+		SELECT 'label_pairs', uniqExact(k, v) FROM {{.table}} ARRAY JOIN mapKeys(labels) AS k, mapValues(labels) AS v {{.where.SQL}}
+		FORMAT RowBinary
+	`, params)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range head {
+		switch s.Name {
+		case "series":
+			stats.NumSeries = s.Count
+		case "min_time":
+			stats.MinTime = int64(s.Count)
+		case "max_time":
+			stats.MaxTime = int64(s.Count)
+		case "label_pairs":
+			stats.IndexPostingStats.NumLabelPairs = int(s.Count)
+		}
+	}
+
+	queries := []struct {
+		dst *[]index.Stat
+		qq  string
+	}{
+		{
+			// series count by metric name
+			dst: &stats.IndexPostingStats.CardinalityMetricsStats,
+			qq: `
+				SELECT name AS k, uniqExact(id) AS c
+				FROM {{.table}}
+				{{.where.SQL}}
+				GROUP BY k ORDER BY c DESC, k LIMIT {{.limit}}
+				FORMAT RowBinary
+			`,
+		},
+		{
+			// label value count by label name
+			dst: &stats.IndexPostingStats.CardinalityLabelStats,
+			qq: `
+				SELECT k, uniqExact(v) AS c
+				FROM {{.table}}
+				ARRAY JOIN mapKeys(labels) AS k, mapValues(labels) AS v
+				{{.where.SQL}}
+				GROUP BY k ORDER BY c DESC, k LIMIT {{.limit}}
+				FORMAT RowBinary
+			`,
+		},
+		{
+			// approximate memory by label name: length of unique values
+			dst: &stats.IndexPostingStats.LabelValueStats,
+			qq: `
+				SELECT k, sum(length(v)) AS c
+				FROM (
+					SELECT DISTINCT k, v
+					FROM {{.table}}
+					ARRAY JOIN mapKeys(labels) AS k, mapValues(labels) AS v
+					{{.where.SQL}}
+				)
+				GROUP BY k ORDER BY c DESC, k LIMIT {{.limit}}
+				FORMAT RowBinary
+			`,
+		},
+		{
+			// series count by label value pair
+			dst: &stats.IndexPostingStats.LabelValuePairsStats,
+			qq: `
+				SELECT concat(k, '=', v) AS pair, uniqExact(id) AS c
+				FROM {{.table}}
+				ARRAY JOIN mapKeys(labels) AS k, mapValues(labels) AS v
+				{{.where.SQL}}
+				GROUP BY pair ORDER BY c DESC, pair LIMIT {{.limit}}
+				FORMAT RowBinary
+			`,
+		},
+	}
+	for _, sq := range queries {
+		*sq.dst, err = q.statsQuery(ctx, seriesCfg, sq.qq, params)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return stats, nil
+}
+
+// statsQuery returns rows of (String, UInt64)
+func (q *Querier) statsQuery(ctx context.Context, seriesCfg config.ConfigSeries, tpl string, params map[string]interface{}) ([]index.Stat, error) {
+	qq, err := sql.Template(tpl, params)
+	if err != nil {
+		return nil, err
+	}
+
+	chRequest, err := q.request(ctx, seriesCfg.ClickHouse, qq)
+	if err != nil {
+		return nil, err
+	}
+	defer chRequest.Close()
+
+	chResponse, err := chRequest.Finish()
+	if err != nil {
+		slog.ErrorContext(ctx, "can't finish request to clickhouse", lg.Error(err))
+		return nil, err
+	}
+	defer chResponse.Close()
+
+	r := schema.NewReader(bufio.NewReader(chResponse)).
+		Format(schema.RowBinary).
+		Column(rowbinary.String).
+		Column(rowbinary.UInt64)
+
+	ret := []index.Stat{}
+	for r.Next() {
+		name, err := schema.Read(r, rowbinary.String)
+		if err != nil {
+			return nil, err
+		}
+		count, err := schema.Read(r, rowbinary.UInt64)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, index.Stat{Name: name, Count: count})
+	}
+	if r.Err() != nil {
+		return nil, r.Err()
+	}
+	return ret, nil
+}
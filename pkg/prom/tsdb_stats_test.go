@@ -0,0 +1,88 @@
+package prom
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pluto-metrics/pluto/pkg/config"
+	"github.com/pluto-metrics/rowbinary"
+	"github.com/pluto-metrics/rowbinary/schema"
+	"github.com/prometheus/prometheus/tsdb/index"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestStatsConfig(t *testing.T) (*config.Config, *fakeClickHouse) {
+	ch := newFakeClickHouse(t, func(w io.Writer, qq string) {
+		var rows []index.Stat
+		switch {
+		case strings.Contains(qq, "UNION ALL"):
+			rows = []index.Stat{{Name: "series", Count: 10}, {Name: "min_time", Count: 1000}, {Name: "max_time", Count: 2000}, {Name: "label_pairs", Count: 25}}
+		case strings.Contains(qq, "name AS k"):
+			rows = []index.Stat{{Name: "up", Count: 6}, {Name: "go_goroutines", Count: 4}}
+		case strings.Contains(qq, "length(v)"):
+			rows = []index.Stat{{Name: "instance", Count: 60}}
+		case strings.Contains(qq, "uniqExact(v)"):
+			rows = []index.Stat{{Name: "instance", Count: 5}, {Name: "job", Count: 2}}
+		case strings.Contains(qq, "pair"):
+			rows = []index.Stat{{Name: "job=node", Count: 7}}
+		}
+
+		wr := schema.NewWriter(w).
+			Format(schema.RowBinary).
+			Column("k", rowbinary.String).
+			Column("c", rowbinary.UInt64)
+		for _, row := range rows {
+			assert.NoError(t, wr.WriteValues(row.Name, row.Count))
+		}
+	})
+
+	cfg := ch.config()
+	cfg.Select.TableSeries = "series"
+	cfg.Prometheus.QueryTimeout = time.Minute
+	cfg.Prometheus.TSDBStatus.Enabled = true
+	cfg.Prometheus.TSDBStatus.Window = 24 * time.Hour
+	cfg.Prometheus.TSDBStatus.Limit = 100
+	return cfg, ch
+}
+
+func TestTSDBStats(t *testing.T) {
+	cfg, ch := newTestStatsConfig(t)
+	ts := newTSDBStats(cfg)
+
+	stats, err := ts.get(1)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(10), stats.NumSeries)
+	assert.Equal(t, int64(1000), stats.MinTime)
+	assert.Equal(t, int64(2000), stats.MaxTime)
+	assert.Equal(t, 25, stats.IndexPostingStats.NumLabelPairs)
+	assert.Equal(t, []index.Stat{{Name: "up", Count: 6}}, stats.IndexPostingStats.CardinalityMetricsStats)
+	assert.Equal(t, []index.Stat{{Name: "instance", Count: 5}}, stats.IndexPostingStats.CardinalityLabelStats)
+	assert.Equal(t, []index.Stat{{Name: "instance", Count: 60}}, stats.IndexPostingStats.LabelValueStats)
+	assert.Equal(t, []index.Stat{{Name: "job=node", Count: 7}}, stats.IndexPostingStats.LabelValuePairsStats)
+
+	// cached
+	n := len(ch.received())
+	stats, err = ts.get(10)
+	require.NoError(t, err)
+	assert.Len(t, stats.IndexPostingStats.CardinalityMetricsStats, 2)
+	assert.Len(t, ch.received(), n)
+}
+
+func TestTSDBStatsDisabled(t *testing.T) {
+	cfg, ch := newTestStatsConfig(t)
+	cfg.Prometheus.TSDBStatus.Enabled = false
+
+	stats, err := newTSDBStats(cfg).get(10)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(0), stats.NumSeries)
+	assert.NotNil(t, stats.IndexPostingStats)
+	assert.Empty(t, ch.received())
+
+	cfg.Prometheus.TSDBStatus.Enabled = true
+	cfg.Tenant.Enabled = true
+	_, err = newTSDBStats(cfg).get(10)
+	assert.Error(t, err)
+}
@@ -0,0 +1,105 @@
+package tenant
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/pluto-metrics/pluto/pkg/config"
+	"github.com/pluto-metrics/pluto/pkg/lg"
+)
+
+type ctxKey string
+
+const (
+	tenantKey  ctxKey = "tenant"
+	unboundKey ctxKey = "unbound"
+)
+
+const maxLength = 150
+
+// With returns context with tenant id
+func With(parent context.Context, id string) context.Context {
+	return context.WithValue(parent, tenantKey, id)
+}
+
+// FromContext returns tenant id or empty string
+func FromContext(ctx context.Context) string {
+	if id, ok := ctx.Value(tenantKey).(string); ok {
+		return id
+	}
+	return ""
+}
+
+// WithoutBinding marks context of an authenticated client which is not bound to a tenant and
+// is not allowed to select one by header
+func WithoutBinding(parent context.Context) context.Context {
+	return context.WithValue(parent, unboundKey, true)
+}
+
+func isUnbound(ctx context.Context) bool {
+	v, _ := ctx.Value(unboundKey).(bool)
+	return v
+}
+
+// Validate checks tenant id. Same rules as in Cortex/Mimir
+func Validate(id string) error {
+	if id == "" {
+		return fmt.Errorf("tenant id is empty")
+	}
+	if len(id) > maxLength {
+		return fmt.Errorf("tenant id is too long: max %d characters", maxLength)
+	}
+	if id == "." || id == ".." {
+		return fmt.Errorf("tenant id is not allowed: %q", id)
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '!', c == '-', c == '_', c == '.', c == '*', c == '\'', c == '(', c == ')':
+		default:
+			return fmt.Errorf("tenant id contains unsupported character %q", c)
+		}
+	}
+	return nil
+}
+
+// NewHandler puts tenant id from request header into the request context
+func NewHandler(cfg *config.Config, next http.Handler) http.Handler {
+	if !cfg.Tenant.Enabled {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(cfg.Tenant.Header)
+
+		// tenant is already bound to the authenticated identity
+		if bound := FromContext(r.Context()); bound != "" {
+			if id != "" && id != bound {
+				http.Error(w, fmt.Sprintf("tenant %q is not allowed", id), http.StatusForbidden)
+				return
+			}
+			id = bound
+		} else if isUnbound(r.Context()) {
+			http.Error(w, "identity is not bound to a tenant", http.StatusForbidden)
+			return
+		}
+
+		if id == "" {
+			id = cfg.Tenant.Default
+		}
+		if id == "" {
+			http.Error(w, fmt.Sprintf("no tenant id: header %s is required", cfg.Tenant.Header), http.StatusUnauthorized)
+			return
+		}
+		if err := Validate(id); err != nil {
+			slog.WarnContext(r.Context(), "invalid tenant id", lg.Error(err))
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		ctx := lg.With(With(r.Context(), id), slog.String("tenant", id))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
@@ -0,0 +1,113 @@
+package tenant
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pluto-metrics/pluto/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError(Validate("team-1"))
+	assert.NoError(Validate("Team_1.prod"))
+	assert.Error(Validate(""))
+	assert.Error(Validate(".."))
+	assert.Error(Validate("team/1"))
+	assert.Error(Validate("team 1"))
+}
+
+func TestHandler(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Tenant.Enabled = true
+	cfg.Tenant.Header = "X-Scope-OrgID"
+
+	var received string
+	h := NewHandler(cfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = FromContext(r.Context())
+	}))
+
+	tests := []struct {
+		name       string
+		header     string
+		defaultID  string
+		wantCode   int
+		wantTenant string
+	}{
+		{name: "header", header: "team1", wantCode: http.StatusOK, wantTenant: "team1"},
+		{name: "missing", wantCode: http.StatusUnauthorized},
+		{name: "default", defaultID: "anonymous", wantCode: http.StatusOK, wantTenant: "anonymous"},
+		{name: "invalid", header: "team/1", wantCode: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert := assert.New(t)
+			received = ""
+			cfg.Tenant.Default = tt.defaultID
+
+			r := httptest.NewRequest(http.MethodGet, "/api/v1/query", nil)
+			if tt.header != "" {
+				r.Header.Set("X-Scope-OrgID", tt.header)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			assert.Equal(tt.wantCode, w.Code)
+			assert.Equal(tt.wantTenant, received)
+		})
+	}
+}
+
+func TestHandlerBoundTenant(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg := &config.Config{}
+	cfg.Tenant.Enabled = true
+	cfg.Tenant.Header = "X-Scope-OrgID"
+
+	var received string
+	h := NewHandler(cfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = FromContext(r.Context())
+	}))
+
+	// tenant from authenticated identity
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/query", nil)
+	r = r.WithContext(With(r.Context(), "team1"))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal("team1", received)
+
+	// header can't switch to another tenant
+	r.Header.Set("X-Scope-OrgID", "team2")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(http.StatusForbidden, w.Code)
+}
+
+func TestHandlerUnbound(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg := &config.Config{}
+	cfg.Tenant.Enabled = true
+	cfg.Tenant.Header = "X-Scope-OrgID"
+	cfg.Tenant.Default = "anonymous"
+
+	h := NewHandler(cfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	// authenticated identity without tenant can't select one
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/query", nil)
+	r = r.WithContext(WithoutBinding(r.Context()))
+	r.Header.Set("X-Scope-OrgID", "team2")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(http.StatusForbidden, w.Code)
+
+	r.Header.Del("X-Scope-OrgID")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(http.StatusForbidden, w.Code)
+}
@@ -0,0 +1,63 @@
+package watermark
+
+import (
+	"sync"
+)
+
+// Default is shared by insert and prometheus running in the same process
+var Default = New()
+
+type batch struct {
+	tenant       string
+	minTimestamp int64
+}
+
+// Tracker keeps batches being written by tenants.
+// All accepted samples of the tenant older than the oldest sample of its batches in flight are written
+type Tracker struct {
+	mu      sync.Mutex
+	seq     uint64
+	batches map[uint64]batch
+}
+
+func New() *Tracker {
+	return &Tracker{batches: make(map[uint64]batch)}
+}
+
+// Begin registers the batch of the tenant. The returned func must be called when the write is finished
+func (t *Tracker) Begin(tenant string, minTimestamp int64) func() {
+	t.mu.Lock()
+	t.seq++
+	seq := t.seq
+	t.batches[seq] = batch{tenant: tenant, minTimestamp: minTimestamp}
+	t.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			t.mu.Lock()
+			delete(t.batches, seq)
+			t.mu.Unlock()
+		})
+	}
+}
+
+// Tenant returns the latest timestamp below which all accepted batches of the tenant are written.
+// Returns false if nothing is in flight
+func (t *Tracker) Tenant(tenant string) (int64, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	found := false
+	var ret int64
+	for _, b := range t.batches {
+		if b.tenant != tenant {
+			continue
+		}
+		if !found || b.minTimestamp-1 < ret {
+			ret = b.minTimestamp - 1
+		}
+		found = true
+	}
+	return ret, found
+}
@@ -0,0 +1,42 @@
+package watermark
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTracker(t *testing.T) {
+	assert := assert.New(t)
+	tr := New()
+
+	_, ok := tr.Tenant("")
+	assert.False(ok)
+
+	doneA := tr.Begin("a", 2000)
+	doneA2 := tr.Begin("a", 1000)
+	doneB := tr.Begin("b", 500)
+
+	w, ok := tr.Tenant("a")
+	assert.True(ok)
+	assert.Equal(int64(999), w)
+
+	doneA2()
+	doneA2()
+	w, ok = tr.Tenant("a")
+	assert.True(ok)
+	assert.Equal(int64(1999), w)
+
+	// other tenants are not affected
+	_, ok = tr.Tenant("c")
+	assert.False(ok)
+
+	doneA()
+	_, ok = tr.Tenant("a")
+	assert.False(ok)
+
+	w, ok = tr.Tenant("b")
+	assert.True(ok)
+	assert.Equal(int64(499), w)
+	doneB()
+}